@@ -0,0 +1,72 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 8*time.Second)
+	// The delay drawn is between half and the whole of the nominal delay
+	for _, test := range []struct {
+		name    string
+		reset   bool
+		nominal time.Duration
+	}{
+		{"first attempt", false, time.Second},
+		{"second attempt", false, 2 * time.Second},
+		{"third attempt", false, 4 * time.Second},
+		{"maximum", false, 8 * time.Second},
+		{"kept at the maximum", false, 8 * time.Second},
+		{"reset", true, time.Second},
+		{"after the reset", false, 2 * time.Second},
+	} {
+		if test.reset {
+			b.reset()
+		}
+		if delay := b.next(); delay < test.nominal/2 || delay > test.nominal {
+			t.Errorf("%s: delay %s, want between %s and %s", test.name, delay, test.nominal/2, test.nominal)
+		}
+	}
+}
+
+func TestSleepCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	start := time.Now()
+	if sleep(ctx, time.Minute) {
+		t.Errorf("sleep not cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancelled after %s", elapsed)
+	}
+	if !sleep(context.Background(), time.Millisecond) {
+		t.Errorf("sleep cancelled without cancellation")
+	}
+}
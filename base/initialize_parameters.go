@@ -26,10 +26,12 @@
 package base
 
 import (
+	"fmt"
 	"github.com/joho/godotenv"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -39,8 +41,63 @@ const (
 	mqttClientIdKey     string = "MQTT_CLIENT_ID"
 	mqttClientIdDefault string = "heatpump"
 
-	mqttTopicKey     string = "MQTT_TOPIC"
-	mqttTopicDefault string = "climatico/vitocal"
+	mqttTopicKey string = "MQTT_TOPIC"
+
+	auditTopicKey string = "AUDIT_TOPIC"
+
+	busTopicKey string = "BUS_TOPIC"
+
+	diagnosticsTopicKey string = "DIAGNOSTICS_TOPIC"
+
+	statusTopicKey string = "STATUS_TOPIC"
+
+	sitesKey     string = "SITES"
+	sitesDefault string = ""
+
+	sinksKey     string = "SINKS"
+	sinksDefault string = "mqtt,files,log,audit"
+
+	sinkBufferKey     string = "SINK_BUFFER"
+	sinkBufferDefault int    = 256
+
+	sinkPolicyKey     string = "SINK_POLICY"
+	sinkPolicyDefault string = "drop"
+
+	metricsListenKey     string = "METRICS_LISTEN"
+	metricsListenDefault string = ""
+
+	influxUrlKey     string = "INFLUX_URL"
+	influxUrlDefault string = ""
+
+	influxTokenKey     string = "INFLUX_TOKEN"
+	influxTokenDefault string = ""
+
+	influxOrgKey     string = "INFLUX_ORG"
+	influxOrgDefault string = ""
+
+	influxBucketKey     string = "INFLUX_BUCKET"
+	influxBucketDefault string = "heatpump"
+
+	influxMeasurementKey     string = "INFLUX_MEASUREMENT"
+	influxMeasurementDefault string = "heatpump"
+
+	influxBatchSizeKey     string = "INFLUX_BATCH_SIZE"
+	influxBatchSizeDefault int    = 100
+
+	influxFlushSecondsKey     string = "INFLUX_FLUSH_SECONDS"
+	influxFlushSecondsDefault int    = 10
+
+	influxSpoolDirKey     string = "INFLUX_SPOOL_DIR"
+	influxSpoolDirDefault string = "/var/lib/heatpump/"
+
+	diagnosticsRawKey     string = "DIAGNOSTICS_RAW"
+	diagnosticsRawDefault bool   = false
+
+	diagnosticsIntervalSecondsKey     string = "DIAGNOSTICS_INTERVAL_SECONDS"
+	diagnosticsIntervalSecondsDefault int    = 60
+
+	auditLogKey     string = "AUDIT_LOG"
+	auditLogDefault string = ""
 
 	vitocalModbusAddrKey     string = "MODBUS_ADDR"
 	vitocalModbusAddrDefault int    = 1
@@ -48,9 +105,62 @@ const (
 	vitocalModbusTcpKey     string = "MODBUS_TCP"
 	vitocalModbusTcpDefault string = "heatpump:502"
 
+	modbusFramingKey     string = "MODBUS_FRAMING"
+	modbusFramingDefault string = "rtu"
+
+	modbusSerialKey     string = "MODBUS_SERIAL"
+	modbusSerialDefault string = ""
+
+	secondaryModbusTcpKey     string = "SECONDARY_MODBUS_TCP"
+	secondaryModbusTcpDefault string = ""
+
+	secondaryModbusSerialKey     string = "SECONDARY_MODBUS_SERIAL"
+	secondaryModbusSerialDefault string = ""
+
+	failoverSecondsKey     string = "FAILOVER_SECONDS"
+	failoverSecondsDefault int    = 5
+
+	failbackSecondsKey     string = "FAILBACK_SECONDS"
+	failbackSecondsDefault int    = 60
+
+	serialBaudKey     string = "SERIAL_BAUD"
+	serialBaudDefault int    = 9600
+
+	serialDataBitsKey     string = "SERIAL_DATA_BITS"
+	serialDataBitsDefault int    = 8
+
+	serialParityKey     string = "SERIAL_PARITY"
+	serialParityDefault string = "E"
+
+	serialStopBitsKey     string = "SERIAL_STOP_BITS"
+	serialStopBitsDefault int    = 1
+
+	pollKey     string = "POLL"
+	pollDefault bool   = false
+
+	pollIntervalSecondsKey     string = "POLL_INTERVAL_SECONDS"
+	pollIntervalSecondsDefault int    = 10
+
+	pollHoldoffSecondsKey     string = "POLL_HOLDOFF_SECONDS"
+	pollHoldoffSecondsDefault int    = 300
+
 	modbusConnectionTimeoutMinutesKey     string = "MODBUS_CONNECTION_TIMEOUT_MINUTES"
 	modbusConnectionTimeoutMinutesDefault int    = 60
 
+	reconnectMinSecondsKey     string = "RECONNECT_MIN_SECONDS"
+	reconnectMinSecondsDefault int    = 1
+
+	reconnectMaxSecondsKey     string = "RECONNECT_MAX_SECONDS"
+	reconnectMaxSecondsDefault int    = 60
+
+	reconnectGiveUpKey     string = "RECONNECT_GIVE_UP"
+	reconnectGiveUpDefault string = GIVE_UP_SITE
+
+	// Policies when a site cannot be connected for MODBUS_CONNECTION_TIMEOUT_MINUTES
+	GIVE_UP_NEVER string = "never"
+	GIVE_UP_SITE  string = "site"
+	GIVE_UP_EXIT  string = "exit"
+
 	standbyThrottleSecondsKey     string = "STANDBY_THROTTLE_SECONDS"
 	standbyThrottleSecondsDefault int    = 60
 
@@ -62,19 +172,70 @@ const (
 
 	rawLogKey     string = "RAWLOG"
 	rawLogDefault bool   = false
+
+	rawRegistersKey     string = "RAW_REGISTERS"
+	rawRegistersDefault bool   = false
+
+	registerMapFileKey     string = "REGISTER_MAP"
+	registerMapFileDefault string = ""
+
+	modelKey     string = "MODEL"
+	modelDefault string = "vitocal100a"
 )
 
 var (
 	MqttServer                     string
 	MqttClientId                   string
 	MqttTopic                      string
-	VitocalModbusAddr              int
+	AuditTopic                     string
+	BusTopic                       string
+	DiagnosticsTopic               string
+	StatusTopic                    string
+	DiagnosticsRaw                 bool
+	DiagnosticsIntervalSeconds     int
+	AuditLog                       string
+	VitocalModbusAddrs             []int
 	VitocalModbusTcp               string
+	ModbusFraming                  string
+	ModbusSerial                   string
+	SecondaryModbusTcp             string
+	SecondaryModbusSerial          string
+	FailoverSeconds                int
+	FailbackSeconds                int
+	SerialBaud                     int
+	SerialDataBits                 int
+	SerialParity                   string
+	SerialStopBits                 int
+	Poll                           bool
+	PollIntervalSeconds            int
+	PollHoldoffSeconds             int
 	ModbusConnectionTimeoutMinutes int
+	ReconnectMinSeconds            int
+	ReconnectMaxSeconds            int
+	ReconnectGiveUp                string
 	StandbyThrottleSeconds         float64
 	RunningThrottleSeconds         float64
 	BaseSHM                        string
 	RawLog                         bool
+	RawRegisters                   bool
+	RegisterMapFile                string
+	Model                          *Profile
+	Sinks                          []string
+	SinkBuffer                     int
+	SinkPolicy                     string
+	MetricsListen                  string
+	InfluxUrl                      string
+	InfluxToken                    string
+	InfluxOrg                      string
+	InfluxBucket                   string
+	InfluxMeasurement              string
+	InfluxBatchSize                int
+	InfluxFlushSeconds             int
+	InfluxSpoolDir                 string
+	// The site configured by the environment variables, used by the offline commands
+	DefaultSite *Site
+	// The sites monitored by the service
+	Sites []*Site
 )
 
 func init() {
@@ -85,27 +246,82 @@ func init() {
 		log.Print(err)
 	}
 
+	modelName := os.Getenv(modelKey)
+	if len(modelName) <= 0 {
+		modelName = modelDefault
+	}
+	Model, err = LoadProfile(modelName)
+	if err != nil {
+		log.Fatalf("error: %s, available models: %s\n", err, strings.Join(Profiles(), ", "))
+	}
+	log.Printf("MODEL: %s %s (%s)\n", Model.Brand, Model.Model, Model.Name)
+
 	MqttServer = os.Getenv(mqttServerKey)
 	if len(MqttServer) <= 0 {
 		MqttServer = mqttServerDefault
 	}
 
 	MqttClientId = os.Getenv(mqttClientIdKey)
-	if len(MqttServer) <= 0 {
+	if len(MqttClientId) <= 0 {
 		MqttClientId = mqttClientIdDefault
 	}
 
 	MqttTopic = os.Getenv(mqttTopicKey)
-	if len(MqttServer) <= 0 {
-		MqttTopic = mqttTopicDefault
+	if len(MqttTopic) <= 0 {
+		MqttTopic = Model.Topic
+	}
+
+	AuditTopic = os.Getenv(auditTopicKey)
+	if len(AuditTopic) <= 0 {
+		AuditTopic = MqttTopic + "/audit"
+	}
+
+	BusTopic = os.Getenv(busTopicKey)
+	if len(BusTopic) <= 0 {
+		BusTopic = MqttTopic + "/bus"
+	}
+
+	DiagnosticsTopic = os.Getenv(diagnosticsTopicKey)
+	if len(DiagnosticsTopic) <= 0 {
+		DiagnosticsTopic = MqttTopic + "/diagnostics"
+	}
+
+	if len(os.Getenv(diagnosticsRawKey)) == 0 {
+		DiagnosticsRaw = diagnosticsRawDefault
+	} else {
+		DiagnosticsRaw, err = strconv.ParseBool(os.Getenv(diagnosticsRawKey))
+		if err != nil {
+			DiagnosticsRaw = diagnosticsRawDefault
+		}
+	}
+
+	if len(os.Getenv(diagnosticsIntervalSecondsKey)) == 0 {
+		DiagnosticsIntervalSeconds = diagnosticsIntervalSecondsDefault
+	} else {
+		DiagnosticsIntervalSeconds, err = strconv.Atoi(os.Getenv(diagnosticsIntervalSecondsKey))
+		if err != nil || DiagnosticsIntervalSeconds < 0 {
+			DiagnosticsIntervalSeconds = diagnosticsIntervalSecondsDefault
+		}
+	}
+
+	StatusTopic = os.Getenv(statusTopicKey)
+	if len(StatusTopic) <= 0 {
+		StatusTopic = MqttTopic + "/status"
+	}
+
+	AuditLog = os.Getenv(auditLogKey)
+	if len(AuditLog) <= 0 {
+		AuditLog = auditLogDefault
 	}
 
+	// A comma separated list when several heatpumps share the bus
 	if len(os.Getenv(vitocalModbusAddrKey)) == 0 {
-		VitocalModbusAddr = vitocalModbusAddrDefault
+		VitocalModbusAddrs = []int{vitocalModbusAddrDefault}
 	} else {
-		VitocalModbusAddr, err = strconv.Atoi(os.Getenv(vitocalModbusAddrKey))
+		VitocalModbusAddrs, err = ParseModbusAddrs(os.Getenv(vitocalModbusAddrKey))
 		if err != nil {
-			VitocalModbusAddr = vitocalModbusAddrDefault
+			log.Printf("invalid %s: %s\n", vitocalModbusAddrKey, err)
+			VitocalModbusAddrs = []int{vitocalModbusAddrDefault}
 		}
 	}
 
@@ -114,6 +330,103 @@ func init() {
 		VitocalModbusTcp = vitocalModbusTcpDefault
 	}
 
+	ModbusFraming = strings.ToLower(os.Getenv(modbusFramingKey))
+	if len(ModbusFraming) <= 0 {
+		ModbusFraming = modbusFramingDefault
+	}
+
+	ModbusSerial = os.Getenv(modbusSerialKey)
+	if len(ModbusSerial) <= 0 {
+		ModbusSerial = modbusSerialDefault
+	}
+
+	SecondaryModbusTcp = os.Getenv(secondaryModbusTcpKey)
+	if len(SecondaryModbusTcp) <= 0 {
+		SecondaryModbusTcp = secondaryModbusTcpDefault
+	}
+
+	SecondaryModbusSerial = os.Getenv(secondaryModbusSerialKey)
+	if len(SecondaryModbusSerial) <= 0 {
+		SecondaryModbusSerial = secondaryModbusSerialDefault
+	}
+
+	if len(os.Getenv(failoverSecondsKey)) == 0 {
+		FailoverSeconds = failoverSecondsDefault
+	} else {
+		FailoverSeconds, err = strconv.Atoi(os.Getenv(failoverSecondsKey))
+		if err != nil || FailoverSeconds <= 0 {
+			FailoverSeconds = failoverSecondsDefault
+		}
+	}
+
+	if len(os.Getenv(failbackSecondsKey)) == 0 {
+		FailbackSeconds = failbackSecondsDefault
+	} else {
+		FailbackSeconds, err = strconv.Atoi(os.Getenv(failbackSecondsKey))
+		if err != nil || FailbackSeconds <= 0 {
+			FailbackSeconds = failbackSecondsDefault
+		}
+	}
+
+	if len(os.Getenv(serialBaudKey)) == 0 {
+		SerialBaud = serialBaudDefault
+	} else {
+		SerialBaud, err = strconv.Atoi(os.Getenv(serialBaudKey))
+		if err != nil {
+			SerialBaud = serialBaudDefault
+		}
+	}
+
+	if len(os.Getenv(serialDataBitsKey)) == 0 {
+		SerialDataBits = serialDataBitsDefault
+	} else {
+		SerialDataBits, err = strconv.Atoi(os.Getenv(serialDataBitsKey))
+		if err != nil {
+			SerialDataBits = serialDataBitsDefault
+		}
+	}
+
+	SerialParity = strings.ToUpper(os.Getenv(serialParityKey))
+	if len(SerialParity) <= 0 {
+		SerialParity = serialParityDefault
+	}
+
+	if len(os.Getenv(serialStopBitsKey)) == 0 {
+		SerialStopBits = serialStopBitsDefault
+	} else {
+		SerialStopBits, err = strconv.Atoi(os.Getenv(serialStopBitsKey))
+		if err != nil {
+			SerialStopBits = serialStopBitsDefault
+		}
+	}
+
+	if len(os.Getenv(pollKey)) == 0 {
+		Poll = pollDefault
+	} else {
+		Poll, err = strconv.ParseBool(os.Getenv(pollKey))
+		if err != nil {
+			Poll = pollDefault
+		}
+	}
+
+	if len(os.Getenv(pollIntervalSecondsKey)) == 0 {
+		PollIntervalSeconds = pollIntervalSecondsDefault
+	} else {
+		PollIntervalSeconds, err = strconv.Atoi(os.Getenv(pollIntervalSecondsKey))
+		if err != nil || PollIntervalSeconds <= 0 {
+			PollIntervalSeconds = pollIntervalSecondsDefault
+		}
+	}
+
+	if len(os.Getenv(pollHoldoffSecondsKey)) == 0 {
+		PollHoldoffSeconds = pollHoldoffSecondsDefault
+	} else {
+		PollHoldoffSeconds, err = strconv.Atoi(os.Getenv(pollHoldoffSecondsKey))
+		if err != nil || PollHoldoffSeconds <= 0 {
+			PollHoldoffSeconds = pollHoldoffSecondsDefault
+		}
+	}
+
 	if len(os.Getenv(modbusConnectionTimeoutMinutesKey)) == 0 {
 		ModbusConnectionTimeoutMinutes = modbusConnectionTimeoutMinutesDefault
 	} else {
@@ -123,6 +436,34 @@ func init() {
 		}
 	}
 
+	if len(os.Getenv(reconnectMinSecondsKey)) == 0 {
+		ReconnectMinSeconds = reconnectMinSecondsDefault
+	} else {
+		ReconnectMinSeconds, err = strconv.Atoi(os.Getenv(reconnectMinSecondsKey))
+		if err != nil || ReconnectMinSeconds <= 0 {
+			ReconnectMinSeconds = reconnectMinSecondsDefault
+		}
+	}
+
+	if len(os.Getenv(reconnectMaxSecondsKey)) == 0 {
+		ReconnectMaxSeconds = reconnectMaxSecondsDefault
+	} else {
+		ReconnectMaxSeconds, err = strconv.Atoi(os.Getenv(reconnectMaxSecondsKey))
+		if err != nil || ReconnectMaxSeconds <= 0 {
+			ReconnectMaxSeconds = reconnectMaxSecondsDefault
+		}
+	}
+	if ReconnectMaxSeconds < ReconnectMinSeconds {
+		ReconnectMaxSeconds = ReconnectMinSeconds
+	}
+
+	ReconnectGiveUp = strings.ToLower(os.Getenv(reconnectGiveUpKey))
+	switch ReconnectGiveUp {
+	case GIVE_UP_NEVER, GIVE_UP_SITE, GIVE_UP_EXIT:
+	default:
+		ReconnectGiveUp = reconnectGiveUpDefault
+	}
+
 	if len(os.Getenv(standbyThrottleSecondsKey)) == 0 {
 		StandbyThrottleSeconds = float64(standbyThrottleSecondsDefault)
 	} else {
@@ -167,4 +508,131 @@ func init() {
 		}
 	}
 	log.Print("RAWLOG: ", RawLog)
+
+	if len(os.Getenv(rawRegistersKey)) == 0 {
+		RawRegisters = rawRegistersDefault
+	} else {
+		RawRegisters, err = strconv.ParseBool(os.Getenv(rawRegistersKey))
+		if err != nil {
+			RawRegisters = rawRegistersDefault
+		}
+	}
+
+	RegisterMapFile = os.Getenv(registerMapFileKey)
+	if len(RegisterMapFile) <= 0 {
+		RegisterMapFile = registerMapFileDefault
+	}
+
+	sinks := os.Getenv(sinksKey)
+	if len(sinks) <= 0 {
+		sinks = sinksDefault
+	}
+	for _, name := range strings.Split(sinks, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); len(name) > 0 {
+			Sinks = append(Sinks, name)
+		}
+	}
+
+	if len(os.Getenv(sinkBufferKey)) == 0 {
+		SinkBuffer = sinkBufferDefault
+	} else {
+		SinkBuffer, err = strconv.Atoi(os.Getenv(sinkBufferKey))
+		if err != nil || SinkBuffer <= 0 {
+			SinkBuffer = sinkBufferDefault
+		}
+	}
+
+	SinkPolicy = strings.ToLower(os.Getenv(sinkPolicyKey))
+	if len(SinkPolicy) <= 0 {
+		SinkPolicy = sinkPolicyDefault
+	}
+
+	MetricsListen = os.Getenv(metricsListenKey)
+	if len(MetricsListen) <= 0 {
+		MetricsListen = metricsListenDefault
+	}
+
+	InfluxUrl = strings.TrimSuffix(os.Getenv(influxUrlKey), "/")
+	if len(InfluxUrl) <= 0 {
+		InfluxUrl = influxUrlDefault
+	}
+
+	InfluxToken = os.Getenv(influxTokenKey)
+	if len(InfluxToken) <= 0 {
+		InfluxToken = influxTokenDefault
+	}
+
+	InfluxOrg = os.Getenv(influxOrgKey)
+	if len(InfluxOrg) <= 0 {
+		InfluxOrg = influxOrgDefault
+	}
+
+	InfluxBucket = os.Getenv(influxBucketKey)
+	if len(InfluxBucket) <= 0 {
+		InfluxBucket = influxBucketDefault
+	}
+
+	InfluxMeasurement = os.Getenv(influxMeasurementKey)
+	if len(InfluxMeasurement) <= 0 {
+		InfluxMeasurement = influxMeasurementDefault
+	}
+
+	if len(os.Getenv(influxBatchSizeKey)) == 0 {
+		InfluxBatchSize = influxBatchSizeDefault
+	} else {
+		InfluxBatchSize, err = strconv.Atoi(os.Getenv(influxBatchSizeKey))
+		if err != nil || InfluxBatchSize <= 0 {
+			InfluxBatchSize = influxBatchSizeDefault
+		}
+	}
+
+	if len(os.Getenv(influxFlushSecondsKey)) == 0 {
+		InfluxFlushSeconds = influxFlushSecondsDefault
+	} else {
+		InfluxFlushSeconds, err = strconv.Atoi(os.Getenv(influxFlushSecondsKey))
+		if err != nil || InfluxFlushSeconds <= 0 {
+			InfluxFlushSeconds = influxFlushSecondsDefault
+		}
+	}
+
+	// The spool files outlive a reboot, unlike the state files in BASE_SHM
+	InfluxSpoolDir = os.Getenv(influxSpoolDirKey)
+	if len(InfluxSpoolDir) <= 0 {
+		InfluxSpoolDir = influxSpoolDirDefault
+	} else if !strings.HasSuffix(InfluxSpoolDir, "/") {
+		InfluxSpoolDir += "/"
+	}
+
+	DefaultSite = defaultSite()
+	sites := os.Getenv(sitesKey)
+	if len(sites) <= 0 {
+		sites = sitesDefault
+	}
+	if len(sites) > 0 {
+		Sites, err = LoadSites(sites)
+		if err != nil {
+			log.Fatalf("error loading sites: %s\n", err)
+		}
+		log.Printf("SITES: %d sites from %s\n", len(Sites), sites)
+	} else {
+		Sites = []*Site{DefaultSite}
+	}
+}
+
+// Parses a comma separated list of slave addresses
+func ParseModbusAddrs(list string) ([]int, error) {
+	var addrs []int
+	seen := make(map[int]bool)
+	for _, field := range strings.Split(list, ",") {
+		addr, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || addr < 1 || addr > 247 {
+			return nil, fmt.Errorf("invalid slave address %q", field)
+		}
+		if seen[addr] {
+			return nil, fmt.Errorf("duplicate slave address %d", addr)
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
 }
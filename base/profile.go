@@ -0,0 +1,121 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package base
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A model profile bundles what differs between the OEM variants of the heatpump: the register map used to decode the
+// Remote Touch Controller traffic, the labels of the status values, the error code table, the default MQTT topic
+// and the prefix of the state flag files in BASE_SHM.
+
+//go:embed profiles/*.json
+var profiles embed.FS
+
+type Profile struct {
+	Name            string                       `json:"name"`
+	Brand           string                       `json:"brand"`
+	Model           string                       `json:"model"`
+	RegisterMap     string                       `json:"register_map"`
+	Topic           string                       `json:"topic"`
+	StateFilePrefix string                       `json:"state_file_prefix"`
+	Labels          map[string]map[string]string `json:"labels"`
+	Errors          map[string]string            `json:"errors"`
+}
+
+// Loads a built-in profile by name, or a profile file when name ends in .json
+func LoadProfile(name string) (*Profile, error) {
+	var data []byte
+	var err error
+	if strings.HasSuffix(name, ".json") {
+		data, err = os.ReadFile(name)
+	} else {
+		data, err = profiles.ReadFile("profiles/" + name + ".json")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unknown model profile %s: %w", name, err)
+	}
+	var profile Profile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("model profile %s: %w", name, err)
+	}
+	if err := profile.validate(); err != nil {
+		return nil, fmt.Errorf("model profile %s: %w", name, err)
+	}
+	return &profile, nil
+}
+
+// Returns the names of the built-in profiles
+func Profiles() []string {
+	var names []string
+	entries, _ := profiles.ReadDir("profiles")
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	return names
+}
+
+// Returns the label of a status value, or the value itself when the profile does not define one
+func (p *Profile) Label(field string, value interface{}) string {
+	text := fmt.Sprint(value)
+	if label, ok := p.Labels[field][text]; ok {
+		return label
+	}
+	return text
+}
+
+// Returns the description of an error code, false if the code is not in the error table
+func (p *Profile) ErrorDescription(code uint16) (string, bool) {
+	description, ok := p.Errors[strconv.Itoa(int(code))]
+	return description, ok
+}
+
+func (p *Profile) validate() error {
+	if len(p.Name) == 0 {
+		return fmt.Errorf("missing name")
+	}
+	if len(p.RegisterMap) == 0 {
+		return fmt.Errorf("missing register map")
+	}
+	if len(p.Topic) == 0 {
+		return fmt.Errorf("missing topic")
+	}
+	if len(p.StateFilePrefix) == 0 {
+		return fmt.Errorf("missing state file prefix")
+	}
+	for code := range p.Errors {
+		if _, err := strconv.ParseUint(code, 10, 16); err != nil {
+			return fmt.Errorf("invalid error code %s", code)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// A site is an installation monitored by the service: the MODBUS gateway or serial port of its bus, the slave
+// addresses of its heatpumps and the MQTT topics its telemetry is published to. Without SITES the service monitors
+// the single site configured by the environment variables. SITES names a JSON file listing several sites:
+//
+//	{"sites": [
+//	    {"name": "home", "modbus_tcp": "10.0.1.5:502", "mqtt_topic": "home/vitocal"},
+//	    {"name": "barn", "modbus_serial": "/dev/ttyUSB0", "modbus_addr": [1, 2], "mqtt_topic": "barn/vitocal"}
+//	]}
+//
+// A site may read its bus through a secondary gateway or serial port as well, used while the primary source stops
+// delivering valid frames. The MODBUS framing and slave addresses default to the environment variables. The other
+// topics default to the site MQTT topic followed by /audit, /bus, /diagnostics and /status, the state file prefix to
+// the model profile prefix followed by the site name.
+type Site struct {
+	Name             string `json:"name"`
+	ModbusTcp        string `json:"modbus_tcp"`
+	ModbusSerial     string `json:"modbus_serial"`
+	SecondaryTcp     string `json:"secondary_modbus_tcp"`
+	SecondarySerial  string `json:"secondary_modbus_serial"`
+	ModbusFraming    string `json:"modbus_framing"`
+	ModbusAddrs      []int  `json:"modbus_addr"`
+	MqttTopic        string `json:"mqtt_topic"`
+	AuditTopic       string `json:"audit_topic"`
+	BusTopic         string `json:"bus_topic"`
+	DiagnosticsTopic string `json:"diagnostics_topic"`
+	StatusTopic      string `json:"status_topic"`
+	AuditLog         string `json:"audit_log"`
+	StateFilePrefix  string `json:"state_file_prefix"`
+}
+
+// The gateway address, or the serial port when the site is read through a serial port
+func (s *Site) Source() string {
+	if len(s.ModbusSerial) > 0 {
+		return s.ModbusSerial
+	}
+	return s.ModbusTcp
+}
+
+// The secondary gateway address or serial port, empty when the site has a single source
+func (s *Site) SecondarySource() string {
+	if len(s.SecondarySerial) > 0 {
+		return s.SecondarySerial
+	}
+	return s.SecondaryTcp
+}
+
+// The site name, or the source of the site configured by the environment variables
+func (s *Site) String() string {
+	if len(s.Name) > 0 {
+		return s.Name
+	}
+	return s.Source()
+}
+
+// Logs with the site name as prefix, so that the logs of several sites can be told apart
+func (s *Site) Logger() *log.Logger {
+	if len(s.Name) == 0 {
+		return log.Default()
+	}
+	return log.New(log.Writer(), s.Name+": ", log.Flags()|log.Lmsgprefix)
+}
+
+// Returns the site configured by the environment variables
+func defaultSite() *Site {
+	return &Site{
+		ModbusTcp:        VitocalModbusTcp,
+		ModbusSerial:     ModbusSerial,
+		SecondaryTcp:     SecondaryModbusTcp,
+		SecondarySerial:  SecondaryModbusSerial,
+		ModbusFraming:    ModbusFraming,
+		ModbusAddrs:      VitocalModbusAddrs,
+		MqttTopic:        MqttTopic,
+		AuditTopic:       AuditTopic,
+		BusTopic:         BusTopic,
+		DiagnosticsTopic: DiagnosticsTopic,
+		StatusTopic:      StatusTopic,
+		AuditLog:         AuditLog,
+		StateFilePrefix:  Model.StateFilePrefix,
+	}
+}
+
+// Loads the sites file
+func LoadSites(name string) ([]*Site, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Sites []*Site `json:"sites"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("sites %s: %w", name, err)
+	}
+	if len(file.Sites) == 0 {
+		return nil, fmt.Errorf("sites %s: no sites defined", name)
+	}
+	unique := make(map[string]string)
+	for _, site := range file.Sites {
+		if err := site.defaults(); err != nil {
+			return nil, fmt.Errorf("sites %s: %w", name, err)
+		}
+		values := []string{"name " + site.Name, "source " + site.Source(), "topic " + site.MqttTopic,
+			"state file prefix " + site.StateFilePrefix}
+		if len(site.SecondarySource()) > 0 {
+			values = append(values, "source "+site.SecondarySource())
+		}
+		for _, value := range values {
+			if other, ok := unique[value]; ok {
+				return nil, fmt.Errorf("sites %s: site %s: same %s as site %s", name, site.Name, value, other)
+			}
+			unique[value] = site.Name
+		}
+	}
+	return file.Sites, nil
+}
+
+func (s *Site) defaults() error {
+	if len(s.Name) == 0 {
+		return fmt.Errorf("site without name")
+	}
+	if len(s.ModbusTcp) == 0 && len(s.ModbusSerial) == 0 {
+		return fmt.Errorf("site %s: missing modbus_tcp or modbus_serial", s.Name)
+	}
+	if len(s.MqttTopic) == 0 {
+		return fmt.Errorf("site %s: missing mqtt_topic", s.Name)
+	}
+	if len(s.ModbusFraming) == 0 {
+		s.ModbusFraming = ModbusFraming
+	}
+	if len(s.ModbusAddrs) == 0 {
+		s.ModbusAddrs = VitocalModbusAddrs
+	}
+	for _, addr := range s.ModbusAddrs {
+		if addr < 1 || addr > 247 {
+			return fmt.Errorf("site %s: invalid slave address %d", s.Name, addr)
+		}
+	}
+	if len(s.AuditTopic) == 0 {
+		s.AuditTopic = s.MqttTopic + "/audit"
+	}
+	if len(s.BusTopic) == 0 {
+		s.BusTopic = s.MqttTopic + "/bus"
+	}
+	if len(s.DiagnosticsTopic) == 0 {
+		s.DiagnosticsTopic = s.MqttTopic + "/diagnostics"
+	}
+	if len(s.StatusTopic) == 0 {
+		s.StatusTopic = s.MqttTopic + "/status"
+	}
+	if len(s.StateFilePrefix) == 0 {
+		s.StateFilePrefix = Model.StateFilePrefix + s.Name
+	}
+	return nil
+}
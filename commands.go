@@ -0,0 +1,362 @@
+// Copyright 2023 by mauro@ezplanet.org (Mauro Mozzarelli)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice,
+// this list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation
+// and/or other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"heatpump/base"
+	"heatpump/decoder"
+	"heatpump/pcap"
+	"heatpump/recorder"
+	"heatpump/simulator"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Commands run instead of the service when named as first argument, e.g. heatpump pcap capture.pcapng
+var commands = map[string]func(args []string) error{
+	"discover": discoverCommand,
+	"pcap":     pcapCommand,
+	"record":   recordCommand,
+	"replay":   replayCommand,
+	"simulate": simulateCommand,
+}
+
+// Decodes a tcpdump capture of the gateway traffic and writes the JSON snapshots, timestamped with the capture time
+func pcapCommand(args []string) error {
+	flags := flag.NewFlagSet("pcap", flag.ExitOnError)
+	port := flags.Int("port", gatewayPort(), "TCP port of the MODBUS gateway")
+	output := flags.String("o", "", "output file (default standard output)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s pcap [-port port] [-o file] capture.pcap|capture.pcapng\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("a capture file is required")
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := pcap.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	w, closer, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	err = decoder.DecodeRecording(pcap.NewStream(reader, uint16(*port)), w)
+	if flushErr := w.Flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// Records the raw byte stream received from the gateway, or from the serial port, until interrupted
+func recordCommand(args []string) error {
+	flags := flag.NewFlagSet("record", flag.ExitOnError)
+	output := flags.String("o", "", "recording file")
+	duration := flags.Duration("duration", 0, "recording duration (default until interrupted)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s record -o file [-duration 1h]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if len(*output) == 0 {
+		flags.Usage()
+		return fmt.Errorf("a recording file is required")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *duration > 0 {
+		ctx, stop = context.WithTimeout(ctx, *duration)
+		defer stop()
+	}
+
+	conn, err := connect(base.DefaultSite)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	recording, err := recorder.NewWriter(file, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// Closing the connection interrupts the read in progress
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	var chunks, size int
+	buf := make([]byte, 4096)
+	for ctx.Err() == nil {
+		conn.SetReadDeadline(time.Now().Add(decoder.READ_TIMEOUT))
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, err := recording.Write(buf[:n]); err != nil {
+				return err
+			}
+			chunks++
+			size += n
+		}
+		if err != nil && !os.IsTimeout(err) {
+			if ctx.Err() == nil && err != io.EOF {
+				return err
+			}
+			break
+		}
+	}
+	log.Printf("recorded %d chunks, %d bytes to %s\n", chunks, size, *output)
+	return nil
+}
+
+// Tracks the registers of every block read on the bus and writes a discovery report. The bus is read from the
+// gateway, or from the serial port, until interrupted, or from a recording or a capture file.
+func discoverCommand(args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	duration := flags.Duration("duration", 0, "discovery duration when reading the bus (default until interrupted)")
+	port := flags.Int("port", gatewayPort(), "TCP port of the MODBUS gateway in capture files")
+	output := flags.String("o", "", "Markdown report file (default standard output)")
+	jsonOutput := flags.String("json", "", "JSON report file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s discover [-duration 1h] [-o report.md] [-json report.json] "+
+			"[recording|capture.pcap|capture.pcapng]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("too many arguments")
+	}
+
+	var recording decoder.Recording
+	if flags.NArg() == 1 {
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if recording, err = recorder.NewReader(file); err != nil {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			reader, err := pcap.NewReader(file)
+			if err != nil {
+				return fmt.Errorf("%s is neither a recording nor a capture file", flags.Arg(0))
+			}
+			recording = pcap.NewStream(reader, uint16(*port))
+		}
+	} else {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if *duration > 0 {
+			ctx, stop = context.WithTimeout(ctx, *duration)
+			defer stop()
+		}
+		conn, err := connect(base.DefaultSite)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// Closing the connection interrupts the read in progress
+		go func() {
+			<-ctx.Done()
+			conn.Close()
+		}()
+		log.Printf("discovering registers, interrupt to write the report\n")
+		recording = &liveRecording{ctx: ctx, conn: conn, buf: make([]byte, 4096)}
+	}
+
+	discovery := decoder.NewDiscovery()
+	if err := decoder.DiscoverRecording(recording, discovery); err != nil {
+		return err
+	}
+	report := discovery.Report()
+
+	w, closer, err := createOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	if err := report.Markdown(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(*jsonOutput) > 0 {
+		data, err := json.MarshalIndent(report, "", "    ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*jsonOutput, append(data, '\n'), 0644)
+	}
+	return nil
+}
+
+// The live byte stream as a recording, which ends when the context is done
+type liveRecording struct {
+	ctx  context.Context
+	conn decoder.Conn
+	buf  []byte
+}
+
+func (l *liveRecording) Next() (time.Time, []byte, error) {
+	for {
+		l.conn.SetReadDeadline(time.Now().Add(decoder.READ_TIMEOUT))
+		n, err := l.conn.Read(l.buf)
+		if n > 0 {
+			return time.Now(), append([]byte(nil), l.buf[:n]...), nil
+		}
+		if err != nil && !os.IsTimeout(err) {
+			if l.ctx.Err() != nil || err == io.EOF {
+				return time.Time{}, nil, io.EOF
+			}
+			return time.Time{}, nil, err
+		}
+	}
+}
+
+// Serves a recording as a local MODBUS gateway
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:5020", "address to listen on")
+	speed := flags.Float64("speed", 1, "replay speed, 1 = original speed, 10 = ten times faster, 0 = as fast as possible")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s replay [-listen host:port] [-speed 1] file\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *speed < 0 {
+		flags.Usage()
+		return fmt.Errorf("a recording file is required")
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("replaying %s on %s\n", flags.Arg(0), listener.Addr())
+	return recorder.Serve(listener, flags.Arg(0), *speed)
+}
+
+// Acts as a MODBUS gateway with a simulated heatpump and Remote Touch Controller driven by a scenario
+func simulateCommand(args []string) error {
+	options := simulator.DefaultOptions()
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:5020", "address to listen on")
+	scenario := flags.String("scenario", "heating", "built-in scenario name or scenario file")
+	slaves := flags.String("slave", "1", "MODBUS address of the heatpump, comma separated addresses for several heatpumps")
+	flags.DurationVar(&options.Period, "period", options.Period, "interval between request/response cycles")
+	flags.Float64Var(&options.Speed, "speed", options.Speed, "simulation speed, 0 = as fast as possible")
+	flags.BoolVar(&options.Loop, "loop", false, "restart the scenario when it ends instead of disconnecting")
+	flags.StringVar(&options.Framing, "framing", base.ModbusFraming, "gateway framing: rtu, mbap or ascii")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s simulate [-listen host:port] [-scenario name|file] [-speed 1] [-loop] "+
+			"[-framing rtu|mbap|ascii] [-slave 1,2]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "built-in scenarios: %s\n", strings.Join(simulator.Scenarios(), ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	framing := false
+	for _, name := range decoder.Framings() {
+		framing = framing || name == options.Framing
+	}
+	addrs, err := base.ParseModbusAddrs(*slaves)
+	if err != nil || options.Period <= 0 || options.Speed < 0 || !framing {
+		flags.Usage()
+		return fmt.Errorf("invalid options")
+	}
+	options.Slaves = nil
+	for _, addr := range addrs {
+		options.Slaves = append(options.Slaves, byte(addr))
+	}
+
+	s, err := simulator.Load(*scenario)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	log.Printf("simulating scenario %s on %s\n", s.Name, listener.Addr())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = s.Serve(ctx, listener, options)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Returns a buffered writer to the output file, or to the standard output when the file name is empty
+func createOutput(name string) (*bufio.Writer, io.Closer, error) {
+	if len(name) == 0 {
+		return bufio.NewWriter(os.Stdout), io.NopCloser(nil), nil
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return bufio.NewWriter(file), file, nil
+}
+
+// Returns the port of MODBUS_TCP, or the MODBUS default port
+func gatewayPort() int {
+	_, port, err := net.SplitHostPort(base.VitocalModbusTcp)
+	if err == nil {
+		if value, err := strconv.Atoi(port); err == nil {
+			return value
+		}
+	}
+	return 502
+}
@@ -0,0 +1,159 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// A Modbus ASCII frame is at most 513 characters: colon, 2 hex characters per byte of address, PDU and LRC,
+	// carriage return and line feed
+	MODBUS_ASCII_MAX_FRAME int = 513
+)
+
+// Modbus ASCII converters send each byte of the frame as two hexadecimal characters, the frame starts with a colon
+// and ends with CR LF, and is verified by a longitudinal redundancy check instead of the RTU CRC.
+// Frames are normalised to the RTU layout (address, function, payload) without checksum.
+type asciiFramer struct {
+	buf       []byte
+	discarded int
+	lrcErrors int
+}
+
+func (f *asciiFramer) feed(data []byte) []frame {
+	f.buf = append(f.buf, data...)
+	return f.scan()
+}
+
+func (f *asciiFramer) flush() []frame {
+	frames := f.scan()
+	f.discarded += len(f.buf)
+	f.buf = f.buf[:0]
+	return frames
+}
+
+func (f *asciiFramer) dropped() int {
+	discarded := f.discarded
+	f.discarded = 0
+	return discarded
+}
+
+func (f *asciiFramer) corrupt() int {
+	lrcErrors := f.lrcErrors
+	f.lrcErrors = 0
+	return lrcErrors
+}
+
+// Modbus ASCII is sequential as RTU
+func (f *asciiFramer) transactions() bool {
+	return false
+}
+
+func (f *asciiFramer) encode(rtu []byte, transaction uint16) []byte {
+	return ASCII(rtu)
+}
+
+func (f *asciiFramer) scan() []frame {
+	var frames []frame
+	for len(f.buf) > 0 {
+		start := bytes.IndexByte(f.buf, ':')
+		if start < 0 {
+			f.discarded += len(f.buf)
+			f.buf = f.buf[:0]
+			break
+		}
+		f.discarded += start
+		f.buf = f.buf[start:]
+		end := bytes.Index(f.buf, []byte("\r\n"))
+		if end < 0 {
+			if len(f.buf) >= MODBUS_ASCII_MAX_FRAME {
+				// No end of frame where one is expected, look for the next colon
+				f.buf = f.buf[1:]
+				f.discarded++
+				continue
+			}
+			// Incomplete frame, kept until more data arrives
+			break
+		}
+		// A colon inside the frame means that the previous frame was truncated
+		if next := bytes.IndexByte(f.buf[1:end], ':'); next >= 0 {
+			f.buf = f.buf[next+1:]
+			f.discarded += next + 1
+			continue
+		}
+		size := end + 2
+		if data, request, ok, corrupt := asciiFrame(f.buf[1:end]); ok {
+			frames = append(frames, frame{data: data, request: request})
+		} else {
+			f.discarded += size
+			if corrupt {
+				f.lrcErrors++
+			}
+		}
+		f.buf = f.buf[size:]
+	}
+	// Release the consumed part of the underlying array
+	f.buf = append([]byte(nil), f.buf...)
+	return frames
+}
+
+// Decodes the hexadecimal characters between colon and CR LF, verifies the LRC and checks whether the frame is
+// a request or a response of the decoded functions, corrupt reports that only the LRC failed
+func asciiFrame(text []byte) (data []byte, request bool, ok bool, corrupt bool) {
+	buf := make([]byte, hex.DecodedLen(len(text)))
+	if _, err := hex.Decode(buf, text); err != nil || len(buf) < 4 {
+		return nil, false, false, false
+	}
+	size := len(buf) - 1
+	data = buf[:size]
+	if data[0] == 0 || data[0] > MODBUS_MAX_ADDRESS {
+		return nil, false, false, false
+	}
+	request, ok = classify(data)
+	if ok && lrc(data) != buf[size] {
+		return nil, false, false, true
+	}
+	return data, request, ok, false
+}
+
+// Modbus ASCII longitudinal redundancy check: the two's complement of the sum of the bytes
+func lrc(buf []byte) byte {
+	var sum byte
+	for _, b := range buf {
+		sum += b
+	}
+	return -sum
+}
+
+// Returns an RTU frame as a Modbus ASCII frame
+func ASCII(rtu []byte) []byte {
+	data := append(append([]byte(nil), rtu[:len(rtu)-2]...), 0)
+	data[len(data)-1] = lrc(data[:len(data)-1])
+	return []byte(":" + strings.ToUpper(hex.EncodeToString(data)) + "\r\n")
+}
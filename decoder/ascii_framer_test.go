@@ -0,0 +1,93 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"testing"
+)
+
+func TestLRC(t *testing.T) {
+	tests := []struct {
+		data []byte
+		lrc  byte
+	}{
+		{[]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a}, 0xf2},
+		{[]byte{0x11, 0x03, 0x00, 0x6b, 0x00, 0x03}, 0x7e},
+		{[]byte{}, 0x00},
+	}
+	for _, test := range tests {
+		if lrc := lrc(test.data); lrc != test.lrc {
+			t.Errorf("lrc(% x) = %02x, want %02x", test.data, lrc, test.lrc)
+		}
+	}
+	if frame := string(ASCII(readRequest10)); frame != ":01030000000AF2\r\n" {
+		t.Errorf("ASCII = %q", frame)
+	}
+}
+
+func TestASCIIFramer(t *testing.T) {
+	request := ASCII(readRequest2)
+	response := ASCII(readResponse2)
+	badLRC := []byte(":010300000002FF\r\n")
+	notHex := []byte(":01030000000ZZZ\r\n")
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		frames  []expected
+		dropped int
+		// Frames failing their checksum
+		corrupt int
+	}{
+		{"request", [][]byte{request}, []expected{{readRequest2, true}}, 0, 0},
+		{"lower case", [][]byte{[]byte(":010300000002fa\r\n")}, []expected{{readRequest2, true}}, 0, 0},
+		{"split response", [][]byte{response[:1], response[1:9], response[9:]},
+			[]expected{{readResponse2, false}}, 0, 0},
+		{"coalesced request and response", [][]byte{concat(request, response)},
+			[]expected{{readRequest2, true}, {readResponse2, false}}, 0, 0},
+		{"garbage before a frame", [][]byte{concat([]byte("noise"), request)}, []expected{{readRequest2, true}}, 5, 0},
+		{"bad LRC", [][]byte{concat(badLRC, request)}, []expected{{readRequest2, true}}, len(badLRC), 1},
+		{"not hexadecimal", [][]byte{concat(notHex, request)}, []expected{{readRequest2, true}}, len(notHex), 0},
+		{"truncated frame", [][]byte{concat(request[:7], response)}, []expected{{readResponse2, false}}, 7, 0},
+		{"incomplete frame flushed", [][]byte{concat(request, response[:6])}, []expected{{readRequest2, true}}, 6, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := framers[FRAMING_ASCII]()
+			var frames []frame
+			for _, chunk := range test.chunks {
+				frames = append(frames, f.feed(chunk)...)
+			}
+			frames = append(frames, f.flush()...)
+			checkFrames(t, frames, test.frames, true)
+			if dropped := f.dropped(); dropped != test.dropped {
+				t.Errorf("dropped %d bytes, want %d", dropped, test.dropped)
+			}
+			if corrupt := f.corrupt(); corrupt != test.corrupt {
+				t.Errorf("%d corrupt frames, want %d", corrupt, test.corrupt)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain"
+)
+
+// A function 6 (write single register) or 16 (write multiple registers) request
+type writeRequest struct {
+	slave    byte
+	function byte
+	start    uint16
+	values   []uint16
+}
+
+func parseWriteRequest(buf []byte) writeRequest {
+	r := writeRequest{
+		slave:    buf[0],
+		function: buf[1],
+		start:    binary.BigEndian.Uint16(buf[2:4]),
+	}
+	if r.function == MODBUS_WRITE_SINGLE {
+		r.values = []uint16{binary.BigEndian.Uint16(buf[4:6])}
+		return r
+	}
+	// Start address, quantity and payload size precede the values
+	for i := 7; i+1 < 7+int(buf[6]); i += 2 {
+		r.values = append(r.values, binary.BigEndian.Uint16(buf[i:i+2]))
+	}
+	return r
+}
+
+// Returns a function 6 write single register frame, the request and its acknowledgement are identical
+func WriteSingle(slave byte, address uint16, value uint16) []byte {
+	buf := []byte{slave, MODBUS_WRITE_SINGLE, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(buf[2:4], address)
+	binary.BigEndian.PutUint16(buf[4:6], value)
+	return setChecksum(buf)
+}
+
+// Returns a function 16 write multiple registers request frame
+func WriteMultiple(slave byte, start uint16, values []uint16) []byte {
+	buf := []byte{slave, MODBUS_WRITE_MULTIPLE, 0, 0, 0, 0, byte(len(values) * 2)}
+	binary.BigEndian.PutUint16(buf[2:4], start)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(values)))
+	for _, value := range values {
+		buf = binary.BigEndian.AppendUint16(buf, value)
+	}
+	return setChecksum(append(buf, 0, 0))
+}
+
+// Returns the acknowledgement of a function 16 write multiple registers request
+func WriteMultipleResponse(slave byte, start uint16, quantity uint16) []byte {
+	buf := []byte{slave, MODBUS_WRITE_MULTIPLE, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(buf[2:4], start)
+	binary.BigEndian.PutUint16(buf[4:6], quantity)
+	return setChecksum(buf)
+}
+
+// The Remote Touch Controller changes settings and modes with register writes. A write is audited when the slave
+// acknowledges it, with the value the register had in the last read response when the register has been read.
+// Unacknowledged writes are not audited: those rejected with an exception, and those left without response when
+// another write takes their place or the bus falls silent.
+type audit struct {
+	registerMap *RegisterMap
+	// Writes waiting for the acknowledgement, by MBAP transaction id (always 0 with sequential framings)
+	pending map[uint16]writeRequest
+	// Last known register values by slave and register address
+	registers map[uint32]uint16
+}
+
+// Remembers the register values of a read response
+func (a *audit) read(r readRequest, values []uint16) {
+	if a.registers == nil {
+		a.registers = make(map[uint32]uint16)
+	}
+	for i, value := range values {
+		a.registers[registerKey(r.slave, r.start+uint16(i))] = value
+	}
+}
+
+// Handles a write request or response, returns the writes acknowledged by the response
+func (a *audit) frame(f frame, now time.Time) []domain.RegisterWrite {
+	if a.pending == nil {
+		a.pending = make(map[uint16]writeRequest)
+	}
+	buf := f.data
+	pending, found := a.pending[f.transaction]
+	if buf[1] == MODBUS_WRITE_SINGLE {
+		// The response repeats the request
+		w := parseWriteRequest(buf)
+		if found && pending.slave == w.slave && pending.start == w.start && pending.values[0] == w.values[0] {
+			delete(a.pending, f.transaction)
+			return a.acknowledged(pending, now)
+		}
+		a.request(f.transaction, w)
+		return nil
+	}
+	if f.request {
+		a.request(f.transaction, parseWriteRequest(buf))
+		return nil
+	}
+	start := binary.BigEndian.Uint16(buf[2:4])
+	quantity := binary.BigEndian.Uint16(buf[4:6])
+	if found && pending.slave == buf[0] && pending.function == buf[1] && pending.start == start &&
+		len(pending.values) == int(quantity) {
+		delete(a.pending, f.transaction)
+		return a.acknowledged(pending, now)
+	}
+	if base.RawLog {
+		fmt.Printf("unpaired write response slave=%d address=%04x quantity=%d\n", buf[0], start, quantity)
+	}
+	return nil
+}
+
+// Handles an exception response to a write, the write has been rejected by the slave
+func (a *audit) rejected(f frame) {
+	if w, ok := a.pending[f.transaction]; ok && w.slave == f.data[0] && w.function == f.data[1]&^MODBUS_EXCEPTION {
+		delete(a.pending, f.transaction)
+		if base.RawLog {
+			fmt.Printf("write rejected slave=%d address=%04x quantity=%d exception=%d\n", w.slave, w.start,
+				len(w.values), f.data[2])
+		}
+	}
+}
+
+// A silence on the bus ends any write in progress
+func (a *audit) silence() {
+	for transaction, w := range a.pending {
+		a.unacknowledged(w)
+		delete(a.pending, transaction)
+	}
+}
+
+func (a *audit) request(transaction uint16, w writeRequest) {
+	if previous, ok := a.pending[transaction]; ok {
+		a.unacknowledged(previous)
+	}
+	a.pending[transaction] = w
+}
+
+func (a *audit) acknowledged(w writeRequest, now time.Time) []domain.RegisterWrite {
+	if a.registers == nil {
+		a.registers = make(map[uint32]uint16)
+	}
+	var writes []domain.RegisterWrite
+	for i, value := range w.values {
+		address := w.start + uint16(i)
+		write := domain.RegisterWrite{
+			Timestamp: now,
+			Slave:     int(w.slave),
+			Function:  int(w.function),
+			Register:  fmt.Sprintf("0x%04x", address),
+			Targets:   a.registerMap.targets(address),
+			NewValue:  int(value),
+		}
+		key := registerKey(w.slave, address)
+		if old, ok := a.registers[key]; ok {
+			oldValue := int(old)
+			write.OldValue = &oldValue
+		}
+		a.registers[key] = value
+		writes = append(writes, write)
+	}
+	return writes
+}
+
+func (a *audit) unacknowledged(w writeRequest) {
+	if base.RawLog {
+		fmt.Printf("no response to write slave=%d address=%04x quantity=%d\n", w.slave, w.start, len(w.values))
+	}
+}
+
+func registerKey(slave byte, address uint16) uint32 {
+	return uint32(slave)<<16 | uint32(address)
+}
@@ -0,0 +1,158 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain"
+)
+
+// A session of the site that keeps the audited writes
+func auditSession(t *testing.T, framing string) (*session, *[]domain.RegisterWrite) {
+	registerMap, err := DefaultRegisterMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := &base.Site{Name: "test", ModbusFraming: framing, ModbusAddrs: []int{1, 2}}
+	writes := &[]domain.RegisterWrite{}
+	s := newSession(site, registerMap, log.New(io.Discard, "", 0), func(e Event) {
+		if e.Kind == KIND_WRITE {
+			*writes = append(*writes, *e.Write)
+		}
+	})
+	return s, writes
+}
+
+func checkWrite(t *testing.T, write domain.RegisterWrite, slave int, function byte, register string, old *int,
+	value int) {
+	t.Helper()
+	if write.Slave != slave || write.Function != int(function) || write.Register != register ||
+		write.NewValue != value {
+		t.Errorf("write %+v, want slave %d function %d register %s value %d", write, slave, function, register,
+			value)
+	}
+	switch {
+	case old == nil && write.OldValue != nil:
+		t.Errorf("write of %s with old value %d, want none", register, *write.OldValue)
+	case old != nil && (write.OldValue == nil || *write.OldValue != *old):
+		t.Errorf("write of %s with old value %v, want %d", register, write.OldValue, *old)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	s, writes := auditSession(t, FRAMING_RTU)
+	block := s.registerMap.Blocks[0]
+	start := uint16(block.Address)
+	address := start + uint16(block.Fields[0].Register)
+	register := func(address uint16) string {
+		return fmt.Sprintf("0x%04x", address)
+	}
+	now := time.Unix(1792321412, 0)
+	bus := func(frames ...[]byte) {
+		for _, f := range frames {
+			now = now.Add(50 * time.Millisecond)
+			s.feed(f, now)
+		}
+	}
+	// The old values come from the last read response of the register
+	values := make([]uint16, block.Registers)
+	for i := range values {
+		values[i] = uint16(100 + i)
+	}
+	bus(ReadRequest(1, start, block.Registers), ReadResponse(1, values))
+
+	bus(WriteSingle(1, address, 7), WriteSingle(1, address, 7))
+	if len(*writes) != 1 {
+		t.Fatalf("%d writes audited, want 1", len(*writes))
+	}
+	old := int(values[block.Fields[0].Register])
+	checkWrite(t, (*writes)[0], 1, MODBUS_WRITE_SINGLE, register(address), &old, 7)
+	if targets := (*writes)[0].Targets; len(targets) == 0 || targets[0] != block.Fields[0].Target {
+		t.Errorf("targets %v, want %s first", targets, block.Fields[0].Target)
+	}
+
+	// Each register of a multiple write is audited, the register written before has its new value as old value
+	bus(WriteMultiple(1, address, []uint16{8, 9}), WriteMultipleResponse(1, address, 2))
+	if len(*writes) != 3 {
+		t.Fatalf("%d writes audited, want 3", len(*writes))
+	}
+	seven := 7
+	checkWrite(t, (*writes)[1], 1, MODBUS_WRITE_MULTIPLE, register(address), &seven, 8)
+	old = int(values[block.Fields[0].Register+1])
+	checkWrite(t, (*writes)[2], 1, MODBUS_WRITE_MULTIPLE, register(address+1), &old, 9)
+
+	// A register never read has no old value
+	bus(WriteSingle(2, 0x7000, 1), WriteSingle(2, 0x7000, 1))
+	if len(*writes) != 4 {
+		t.Fatalf("%d writes audited, want 4", len(*writes))
+	}
+	checkWrite(t, (*writes)[3], 2, MODBUS_WRITE_SINGLE, "0x7000", nil, 1)
+}
+
+// Only the writes acknowledged by the slave are audited
+func TestAuditUnacknowledged(t *testing.T) {
+	s, writes := auditSession(t, FRAMING_RTU)
+	now := time.Unix(1792321412, 0)
+	// Rejected with an exception
+	s.feed(WriteSingle(1, 0x1000, 1), now)
+	s.feed(ExceptionResponse(1, MODBUS_WRITE_SINGLE, 2), now)
+	// Without response before the next write, whose acknowledgement does not match the first one
+	s.feed(WriteMultiple(1, 0x1000, []uint16{2, 3}), now)
+	s.feed(WriteSingle(1, 0x1001, 4), now)
+	s.feed(WriteMultipleResponse(1, 0x1000, 2), now)
+	// Without response before a silence on the bus
+	s.feed(WriteMultiple(1, 0x1002, []uint16{5}), now)
+	s.silence(now.Add(READ_TIMEOUT))
+	s.feed(WriteMultipleResponse(1, 0x1002, 1), now.Add(READ_TIMEOUT))
+	if len(*writes) != 0 {
+		t.Errorf("unacknowledged writes audited: %+v", *writes)
+	}
+}
+
+// With MBAP framing several writes may be in flight, each acknowledgement matches its request by transaction id
+func TestAuditTransactions(t *testing.T) {
+	s, writes := auditSession(t, FRAMING_MBAP)
+	now := time.Unix(1792321412, 0)
+	for _, f := range [][]byte{
+		MBAP(1, WriteSingle(1, 0x1000, 10)),
+		MBAP(2, WriteSingle(2, 0x1000, 20)),
+		MBAP(2, WriteSingle(2, 0x1000, 20)),
+		// Not the value of transaction 1
+		MBAP(1, WriteSingle(1, 0x1000, 11)),
+	} {
+		s.feed(f, now)
+	}
+	if len(*writes) != 1 {
+		t.Fatalf("%d writes audited, want 1", len(*writes))
+	}
+	checkWrite(t, (*writes)[0], 2, MODBUS_WRITE_SINGLE, "0x1000", nil, 20)
+}
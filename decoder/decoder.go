@@ -0,0 +1,311 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"heatpump/base"
+)
+
+// Decoder decodes the Modbus byte stream of a site into heatpump snapshots and events, for the services embedding the
+// decoder. It does not publish, write files or log the telemetry itself: the events are handed to the handlers
+// given as options. A Decoder keeps the decoding state of one stream and is not safe for concurrent use.
+//
+//	d, err := decoder.New(decoder.WithSite(site), decoder.WithHandler(func(e decoder.Event) {
+//		if e.Kind == decoder.KIND_TELEMETRY {
+//			fmt.Println(e.Vitocal.Temperatures.WaterOut)
+//		}
+//	}))
+//	...
+//	err = d.Run(ctx, conn)
+type Decoder struct {
+	site        *base.Site
+	logger      *log.Logger
+	registerMap *RegisterMap
+	handlers    []func(Event)
+	throttle    bool
+	running     time.Duration
+	standby     time.Duration
+	raw         bool
+	// Zero unless polling
+	pollInterval time.Duration
+	pollHoldoff  time.Duration
+	counters     *Counters
+
+	session *session
+	// Queue of the publisher stage while Run is decoding
+	events chan Event
+}
+
+type Option func(*Decoder)
+
+// The site sets the framing, the slave addresses and the topics of the events, the site configured by the environment
+// variables by default
+func WithSite(site *base.Site) Option {
+	return func(d *Decoder) {
+		d.site = site
+	}
+}
+
+// Logger of the bus state and of the unrecognised frames, the site logger by default
+func WithLogger(logger *log.Logger) Option {
+	return func(d *Decoder) {
+		d.logger = logger
+	}
+}
+
+// Register map of the heatpump, the one of MODEL or REGISTER_MAP by default
+func WithRegisterMap(registerMap *RegisterMap) Option {
+	return func(d *Decoder) {
+		d.registerMap = registerMap
+	}
+}
+
+// Adds a handler of the decoded events, called in the order the events are decoded, by the publishing goroutine of
+// Run or by Feed and Silence
+func WithHandler(handler func(Event)) Option {
+	return func(d *Decoder) {
+		d.handlers = append(d.handlers, handler)
+	}
+}
+
+// Sends the decoded events to a channel, publishing waits while the channel is full
+func WithEvents(events chan<- Event) Option {
+	return WithHandler(func(e Event) {
+		events <- e
+	})
+}
+
+// Telemetry throttling when the heatpump is running or on stand by, RUNNING_THROTTLE_SECONDS and
+// STANDBY_THROTTLE_SECONDS by default. Snapshot events are not throttled.
+func WithThrottle(running time.Duration, standby time.Duration) Option {
+	return func(d *Decoder) {
+		d.throttle = true
+		d.running = running
+		d.standby = standby
+	}
+}
+
+// Adds the raw register values to the snapshots, RAW_REGISTERS by default
+func WithRawRegisters(raw bool) Option {
+	return func(d *Decoder) {
+		d.raw = raw
+	}
+}
+
+// Reads the register map blocks as MODBUS master, the stream given to Run must then be an io.Writer such as a
+// net.Conn
+func WithPolling(interval time.Duration, holdoff time.Duration) Option {
+	return func(d *Decoder) {
+		d.pollInterval = interval
+		d.pollHoldoff = holdoff
+	}
+}
+
+// Counts the frames decoded into counters shared with other decoders, e.g. those of the previous connections of the
+// site
+func WithCounters(counters *Counters) Option {
+	return func(d *Decoder) {
+		d.counters = counters
+	}
+}
+
+func New(options ...Option) (*Decoder, error) {
+	d := &Decoder{
+		site: base.DefaultSite,
+		raw:  base.RawRegisters,
+	}
+	for _, option := range options {
+		option(d)
+	}
+	if d.registerMap == nil {
+		var err error
+		if d.registerMap, err = DefaultRegisterMap(); err != nil {
+			return nil, err
+		}
+	}
+	if err := CheckSite(d.site); err != nil {
+		return nil, err
+	}
+	if d.logger == nil {
+		d.logger = d.site.Logger()
+	}
+	d.session = newSession(d.site, d.registerMap, d.logger, d.emit)
+	d.session.raw = d.raw
+	if d.counters != nil {
+		d.session.counters = d.counters
+	}
+	if d.throttle {
+		d.session.runningThrottle = d.running.Seconds()
+		d.session.standbyThrottle = d.standby.Seconds()
+	}
+	return d, nil
+}
+
+// Reports an error when the stream of the site cannot be decoded: unknown framing or no slave address
+func CheckSite(site *base.Site) error {
+	if _, ok := framers[site.ModbusFraming]; !ok {
+		return fmt.Errorf("unknown MODBUS framing %q, available framings: %s", site.ModbusFraming,
+			strings.Join(Framings(), ", "))
+	}
+	if len(site.ModbusAddrs) == 0 {
+		return fmt.Errorf("no slave address")
+	}
+	return nil
+}
+
+// Events are queued for the publisher while Run is decoding, handled at once otherwise
+func (d *Decoder) emit(e Event) {
+	if d.events != nil {
+		d.events <- e
+		return
+	}
+	for _, handler := range d.handlers {
+		handler(e)
+	}
+}
+
+// Decodes data received at time now, for streams that are not read by Run, e.g. recordings
+func (d *Decoder) Feed(data []byte, now time.Time) {
+	d.session.feed(data, now)
+}
+
+// Handles a silence on the bus: nothing has been received for READ_TIMEOUT, the heatpumps are powered off
+func (d *Decoder) Silence(now time.Time) {
+	d.session.silence(now)
+}
+
+// Decodes the stream until it ends, fails or the context is cancelled, and returns io.EOF at the end of the stream.
+// The stream is read, framed, decoded and published by separate goroutines, see PIPELINE_BUFFER, Run returns once
+// the events decoded so far have been handed to the handlers. A reader without read deadlines, e.g. a pipe, is only
+// interrupted by the cancellation when it is closed.
+func (d *Decoder) Run(ctx context.Context, r io.Reader) error {
+	s := d.session
+	if d.pollInterval > 0 {
+		w, ok := r.(io.Writer)
+		if !ok {
+			return errors.New("polling needs a writable stream")
+		}
+		var slaves []byte
+		for _, device := range s.devices {
+			slaves = append(slaves, device.slave)
+		}
+		s.poll = newPoller(d.logger, w, d.registerMap, slaves, d.pollInterval, d.pollHoldoff, time.Now())
+		d.logger.Printf("MODBUS polling slaves %v every %s\n", d.site.ModbusAddrs, d.pollInterval)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var stages sync.WaitGroup
+	chunks := make(chan chunk, PIPELINE_BUFFER)
+	batches := make(chan batch, PIPELINE_BUFFER)
+	d.events = make(chan Event, PUBLISH_BUFFER)
+	if _, ok := r.(interface{ SetReadDeadline(t time.Time) error }); ok {
+		stages.Add(1)
+		go func() {
+			defer stages.Done()
+			read(ctx, r, chunks)
+		}()
+	} else {
+		// Left behind if the read in progress never returns
+		go read(ctx, r, chunks)
+	}
+	stages.Add(2)
+	go func() {
+		defer stages.Done()
+		frames(ctx, s.stream, chunks, batches)
+	}()
+	go func() {
+		defer stages.Done()
+		d.publish(d.events)
+	}()
+
+	err := d.decode(ctx, batches)
+	cancel()
+	close(d.events)
+	stages.Wait()
+	d.events = nil
+	return err
+}
+
+// Decoder stage: decodes the batches of frames and lets the poller send its requests
+func (d *Decoder) decode(ctx context.Context, batches <-chan batch) error {
+	s := d.session
+	var wake *time.Timer
+	var wakeC <-chan time.Time
+	if s.poll != nil {
+		wake = time.NewTimer(time.Until(s.poll.wake()))
+		defer wake.Stop()
+		wakeC = wake.C
+	}
+	for {
+		select {
+		case b, ok := <-batches:
+			if !ok {
+				// The framer stops when the context is cancelled
+				return ctx.Err()
+			}
+			if b.switched {
+				s.switched()
+			}
+			if b.silence {
+				// If we have a connection, but there is no data stream then we assume that the heatpump is not powered
+				s.quiet(b.frames, b.dropped, b.corrupt, b.time)
+			} else if b.data {
+				s.received(b.frames, b.dropped, b.corrupt, b.time)
+			}
+			if b.err != nil {
+				if b.err != io.EOF {
+					d.logger.Println("error reading MODBUS stream", b.err)
+				}
+				return b.err
+			}
+		case <-wakeC:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := s.tick(time.Now()); err != nil {
+			d.logger.Println("error writing MODBUS stream", err)
+			return err
+		}
+		if wake != nil {
+			if !wake.Stop() {
+				select {
+				case <-wake.C:
+				default:
+				}
+			}
+			wake.Reset(time.Until(s.poll.wake()))
+		}
+	}
+}
@@ -0,0 +1,86 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain"
+)
+
+// A heatpump on the bus, identified by its slave address, with its own decoding state, topic and throttling. With a
+// single slave address the topic is that of the site, with several heatpumps on the bus the slave address is appended
+// to the topic, e.g. climatico/vitocal/2, and the payload carries the slave address.
+type device struct {
+	slave byte
+	topic string
+
+	lastTime time.Time
+	// Time of the last response from the slave
+	lastResponse time.Time
+	// OFF, ON or 0xFF until the first response or silence
+	powered   uint8
+	template  uint64
+	summaries []string
+	rawValues []string
+	registers [][]uint16
+	vitocal   domain.Vitocal
+}
+
+func newDevice(site *base.Site, blocks int, slave byte, several bool) *device {
+	d := &device{
+		slave:     slave,
+		topic:     site.MqttTopic,
+		powered:   0xFF,
+		summaries: make([]string, blocks),
+		rawValues: make([]string, blocks),
+		registers: make([][]uint16, blocks),
+	}
+	if several {
+		d.topic = fmt.Sprintf("%s/%d", site.MqttTopic, slave)
+		d.vitocal.Slave = int(slave)
+	}
+	return d
+}
+
+// Returns the devices of the slave addresses of the site
+func newDevices(site *base.Site, blocks int) []*device {
+	var devices []*device
+	for _, slave := range site.ModbusAddrs {
+		devices = append(devices, newDevice(site, blocks, byte(slave), len(site.ModbusAddrs) > 1))
+	}
+	return devices
+}
+
+// Prefixes the log lines of the device when several heatpumps share the bus
+func (d *device) logPrefix() string {
+	if d.vitocal.Slave == 0 {
+		return ""
+	}
+	return fmt.Sprintf("slave %d: ", d.slave)
+}
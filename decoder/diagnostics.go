@@ -0,0 +1,143 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain/vitocal"
+)
+
+// Statistics of the valid read responses that the register map does not decode: blocks of other firmware versions,
+// other slaves, input registers, and responses that cannot be paired with their request. A new kind of frame is
+// logged when first seen, the statistics are logged and published when a new kind appears and at most every
+// DIAGNOSTICS_INTERVAL_SECONDS while the counts change.
+type diagnostics struct {
+	log    *log.Logger
+	frames map[unrecognisedKey]*vitocal.UnrecognisedFrame
+	// A new kind of frame has been seen since the last publication
+	added bool
+	// The counts have changed since the last publication
+	changed   bool
+	published time.Time
+}
+
+type unrecognisedKey struct {
+	readRequest
+	paired bool
+}
+
+func (d *diagnostics) unrecognised(r readRequest, paired bool, values []uint16, now time.Time) {
+	if d.frames == nil {
+		d.frames = make(map[unrecognisedKey]*vitocal.UnrecognisedFrame)
+	}
+	key := unrecognisedKey{readRequest: r, paired: paired}
+	f, ok := d.frames[key]
+	if !ok {
+		f = &vitocal.UnrecognisedFrame{
+			Slave:     int(r.slave),
+			Function:  int(r.function),
+			Registers: int(r.quantity),
+			First:     now,
+		}
+		if paired {
+			address := fmt.Sprintf("0x%04x", r.start)
+			f.Address = &address
+		}
+		d.frames[key] = f
+		d.added = true
+		d.log.Printf("MODBUS unrecognised frame %s\n", describeUnrecognised(f))
+	}
+	f.Count++
+	f.Last = now
+	if base.DiagnosticsRaw {
+		f.Values = append(f.Values[:0], values...)
+	}
+	d.changed = true
+}
+
+// Reports whether the statistics are due for publication
+func (d *diagnostics) due(now time.Time) bool {
+	if d.added || d.changed && now.Sub(d.published) >= time.Duration(base.DiagnosticsIntervalSeconds)*time.Second {
+		d.added = false
+		d.changed = false
+		d.published = now
+		return true
+	}
+	return false
+}
+
+// Returns a copy of the statistics, ordered by slave, function, address and number of registers
+func (d *diagnostics) snapshot(now time.Time) vitocal.Diagnostics {
+	snapshot := vitocal.Diagnostics{Timestamp: now, UnrecognisedFrames: []vitocal.UnrecognisedFrame{}}
+	var keys []unrecognisedKey
+	for key := range d.frames {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.slave != b.slave {
+			return a.slave < b.slave
+		}
+		if a.function != b.function {
+			return a.function < b.function
+		}
+		if a.paired != b.paired {
+			return !a.paired
+		}
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		return a.quantity < b.quantity
+	})
+	for _, key := range keys {
+		f := *d.frames[key]
+		f.Values = append([]uint16(nil), f.Values...)
+		snapshot.UnrecognisedFrames = append(snapshot.UnrecognisedFrames, f)
+	}
+	return snapshot
+}
+
+func (d *diagnostics) String() string {
+	var frames []string
+	for _, f := range d.snapshot(time.Time{}).UnrecognisedFrames {
+		frames = append(frames, fmt.Sprintf("%s count=%d", describeUnrecognised(&f), f.Count))
+	}
+	return strings.Join(frames, ", ")
+}
+
+func describeUnrecognised(f *vitocal.UnrecognisedFrame) string {
+	address := "unpaired"
+	if f.Address != nil {
+		address = *f.Address
+	}
+	return fmt.Sprintf("slave=%d function=%d address=%s registers=%d", f.Slave, f.Function, address, f.Registers)
+}
@@ -0,0 +1,130 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain/vitocal"
+)
+
+// Each kind of unrecognised frame is published as soon as it is first seen, further counts at most every
+// DIAGNOSTICS_INTERVAL_SECONDS
+func TestDiagnostics(t *testing.T) {
+	interval, raw := base.DiagnosticsIntervalSeconds, base.DiagnosticsRaw
+	base.DiagnosticsIntervalSeconds, base.DiagnosticsRaw = 60, true
+	defer func() {
+		base.DiagnosticsIntervalSeconds, base.DiagnosticsRaw = interval, raw
+	}()
+	registerMap, err := DefaultRegisterMap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := &base.Site{Name: "test", ModbusFraming: FRAMING_RTU, ModbusAddrs: []int{1},
+		DiagnosticsTopic: "heatpump/diagnostics"}
+	var published []vitocal.Diagnostics
+	s := newSession(site, registerMap, log.New(io.Discard, "", 0), func(e Event) {
+		if e.Kind == KIND_DIAGNOSTICS {
+			if e.Topic != site.DiagnosticsTopic || len(e.Payload) == 0 {
+				t.Errorf("diagnostics published on %q with payload %s", e.Topic, e.Payload)
+			}
+			published = append(published, *e.Diagnostics)
+		}
+	})
+	start := time.Unix(1792321412, 0)
+	now := start
+	bus := func(frames ...[]byte) {
+		for _, f := range frames {
+			now = now.Add(50 * time.Millisecond)
+			s.feed(f, now)
+		}
+	}
+	check := func(step string, want ...string) {
+		t.Helper()
+		if len(want) == 0 {
+			if len(published) != 0 {
+				t.Errorf("%s: %d diagnostics published, want none", step, len(published))
+			}
+			return
+		}
+		if len(published) != 1 {
+			t.Fatalf("%s: %d diagnostics published, want 1", step, len(published))
+		}
+		var frames []string
+		for _, f := range published[0].UnrecognisedFrames {
+			frames = append(frames, fmt.Sprintf("%s count=%d", describeUnrecognised(&f), f.Count))
+		}
+		if fmt.Sprint(frames) != fmt.Sprint(want) {
+			t.Errorf("%s: unrecognised frames %v, want %v", step, frames, want)
+		}
+		if !published[0].Timestamp.Equal(now) {
+			t.Errorf("%s: published at %s, want %s", step, published[0].Timestamp, now)
+		}
+		published = nil
+	}
+
+	// A block the register map does not decode
+	bus(ReadRequest(1, 0x0200, 2), ReadResponse(1, []uint16{1, 2}))
+	first := now
+	check("unmapped block", "slave=1 function=3 address=0x0200 registers=2 count=1")
+	bus(ReadRequest(1, 0x0200, 2), ReadResponse(1, []uint16{1, 3}))
+	check("same block")
+
+	// Input registers, a response without its request and a known block of a slave not decoded are new kinds
+	bus(rtu(0x01, 0x04, 0x02, 0x00, 0x00, 0x02), rtu(0x01, 0x04, 0x04, 0x00, 0x05, 0x00, 0x06))
+	check("input registers", "slave=1 function=3 address=0x0200 registers=2 count=2",
+		"slave=1 function=4 address=0x0200 registers=2 count=1")
+	bus(ReadResponse(1, []uint16{9}))
+	check("unpaired", "slave=1 function=3 address=unpaired registers=1 count=1",
+		"slave=1 function=3 address=0x0200 registers=2 count=2",
+		"slave=1 function=4 address=0x0200 registers=2 count=1")
+	block := registerMap.Blocks[0]
+	bus(ReadRequest(3, uint16(block.Address), block.Registers), ReadResponse(3, make([]uint16, block.Registers)))
+	known := fmt.Sprintf("slave=3 function=3 address=0x%04x registers=%d count=1", block.Address, block.Registers)
+	check("other slave", "slave=1 function=3 address=unpaired registers=1 count=1",
+		"slave=1 function=3 address=0x0200 registers=2 count=2",
+		"slave=1 function=4 address=0x0200 registers=2 count=1", known)
+
+	// The counts are published again once the interval has elapsed since the last publication
+	bus(ReadRequest(1, 0x0200, 2), ReadResponse(1, []uint16{1, 4}))
+	check("within the interval")
+	now = now.Add(time.Minute)
+	bus(ReadRequest(1, 0x0200, 2))
+	check("after the interval", "slave=1 function=3 address=unpaired registers=1 count=1",
+		"slave=1 function=3 address=0x0200 registers=2 count=3",
+		"slave=1 function=4 address=0x0200 registers=2 count=1", known)
+	bus(ReadResponse(1, []uint16{1, 5}))
+	check("after the publication")
+	f := s.diagnostics.snapshot(now).UnrecognisedFrames[1]
+	if f.Count != 4 || !f.First.Equal(first) || !f.Last.Equal(now) || fmt.Sprint(f.Values) != "[1 5]" {
+		t.Errorf("block 0x0200 %+v, want 4 from %s to %s with values [1 5]", f, first, now)
+	}
+}
@@ -0,0 +1,281 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"time"
+
+	"heatpump/domain"
+)
+
+const (
+	// A register change within this time after an event is correlated with the event
+	DISCOVERY_EVENT_WINDOW = time.Minute
+	// Distinct values remembered per register, enough to tell a bitfield from a measurement
+	DISCOVERY_MAX_VALUES int = 16
+	// Unused registers always hold this value
+	UNUSED_REGISTER uint16 = 0x7ffe
+
+	REGISTER_UNUSED      string = "unused"
+	REGISTER_CONSTANT    string = "constant"
+	REGISTER_TEMPERATURE string = "temperature"
+	REGISTER_COUNTER     string = "counter"
+	REGISTER_BITFIELD    string = "bitfield"
+	REGISTER_ANALOG      string = "analog"
+	REGISTER_UNKNOWN     string = "unknown"
+
+	EVENT_COMPRESSOR_START string = "compressor_start"
+	EVENT_COMPRESSOR_STOP  string = "compressor_stop"
+	EVENT_DEFROST_START    string = "defrost_start"
+	EVENT_DEFROST_END      string = "defrost_end"
+	EVENT_PUMP_ON          string = "pump_on"
+	EVENT_PUMP_OFF         string = "pump_off"
+)
+
+// Discovery helps reverse engineering the undocumented registers: it tracks every register of every block read on
+// the bus, its range and changes, and correlates the changes with the events decoded from the known registers.
+type Discovery struct {
+	start, end time.Time
+	responses  int
+	blocks     map[readRequest]*discoveredBlock
+	events     map[string]*discoveredEvent
+	// Last decoded state of each slave
+	states map[byte]*discoveredState
+	// Register map of the known blocks, set by DiscoverRecording
+	registerMap *RegisterMap
+}
+
+// Nil until the first decode
+type discoveredState struct {
+	compressor, defrost, pump *bool
+}
+
+type discoveredBlock struct {
+	request   readRequest
+	reads     int
+	registers []*discoveredRegister
+}
+
+type discoveredRegister struct {
+	first, last, min, max int16
+	or, and               uint16
+	values                map[uint16]bool
+	changes               int
+	lastChange            time.Time
+	increasing            bool
+	maxStep               int
+	// Every change flipped a single bit
+	singleBit bool
+	// Occurrences of each event followed by a change, and the occurrence last credited
+	hits     map[string]int
+	credited map[string]int
+}
+
+type discoveredEvent struct {
+	occurrences int
+	last        time.Time
+}
+
+func NewDiscovery() *Discovery {
+	return &Discovery{
+		blocks: make(map[readRequest]*discoveredBlock),
+		events: make(map[string]*discoveredEvent),
+		states: make(map[byte]*discoveredState),
+	}
+}
+
+// Records the register values of a read response
+func (d *Discovery) read(r readRequest, values []uint16, now time.Time) {
+	if d.start.IsZero() {
+		d.start = now
+	}
+	d.end = now
+	d.responses++
+	block, ok := d.blocks[r]
+	if !ok {
+		block = &discoveredBlock{request: r, registers: make([]*discoveredRegister, len(values))}
+		d.blocks[r] = block
+	}
+	block.reads++
+	for i, value := range values {
+		if block.registers[i] == nil {
+			block.registers[i] = newDiscoveredRegister(value)
+			continue
+		}
+		register := block.registers[i]
+		if value != uint16(register.last) {
+			register.change(value, now, d.events)
+		}
+	}
+}
+
+func newDiscoveredRegister(value uint16) *discoveredRegister {
+	v := int16(value)
+	return &discoveredRegister{
+		first: v, last: v, min: v, max: v,
+		or: value, and: value,
+		values:     map[uint16]bool{value: true},
+		increasing: true,
+		singleBit:  true,
+		hits:       make(map[string]int),
+		credited:   make(map[string]int),
+	}
+}
+
+func (r *discoveredRegister) change(value uint16, now time.Time, events map[string]*discoveredEvent) {
+	v := int16(value)
+	step := int(v) - int(r.last)
+	if step < 0 {
+		r.increasing = false
+		step = -step
+	}
+	if step > r.maxStep {
+		r.maxStep = step
+	}
+	if v < r.min {
+		r.min = v
+	}
+	if v > r.max {
+		r.max = v
+	}
+	if bits.OnesCount16(uint16(r.last)^value) != 1 {
+		r.singleBit = false
+	}
+	r.or |= value
+	r.and &= value
+	if len(r.values) <= DISCOVERY_MAX_VALUES {
+		r.values[value] = true
+	}
+	r.last = v
+	r.changes++
+	r.lastChange = now
+	for name, event := range events {
+		if now.Sub(event.last) <= DISCOVERY_EVENT_WINDOW && r.credited[name] != event.occurrences {
+			r.hits[name]++
+			r.credited[name] = event.occurrences
+		}
+	}
+}
+
+// Detects the events in the decoded state of a slave
+func (d *Discovery) state(slave byte, vitocal *domain.Vitocal, now time.Time) {
+	state, ok := d.states[slave]
+	if !ok {
+		state = &discoveredState{}
+		d.states[slave] = state
+	}
+	d.transition(&state.compressor, vitocal.CompressorStatus != domain.OFF, EVENT_COMPRESSOR_START, EVENT_COMPRESSOR_STOP,
+		now)
+	d.transition(&state.defrost, vitocal.Defrost != domain.DEFROST_INACTIVE, EVENT_DEFROST_START, EVENT_DEFROST_END, now)
+	d.transition(&state.pump, vitocal.PumpStatus == domain.ON, EVENT_PUMP_ON, EVENT_PUMP_OFF, now)
+}
+
+func (d *Discovery) transition(state **bool, on bool, start string, end string, now time.Time) {
+	if *state != nil && **state != on {
+		name := end
+		if on {
+			name = start
+		}
+		event, ok := d.events[name]
+		if !ok {
+			event = &discoveredEvent{}
+			d.events[name] = event
+		}
+		event.occurrences++
+		event.last = now
+	}
+	*state = &on
+}
+
+// Classifies a register from the values observed
+func (r *discoveredRegister) class() string {
+	switch {
+	case r.changes == 0 && uint16(r.first) == UNUSED_REGISTER:
+		return REGISTER_UNUSED
+	case r.changes == 0:
+		return REGISTER_CONSTANT
+	case r.increasing && r.changes >= 2 && r.maxStep <= 16:
+		// Only small increments, e.g. operating hours
+		return REGISTER_COUNTER
+	case len(r.values) <= DISCOVERY_MAX_VALUES && bits.OnesCount16(r.or^r.and) <= 8 &&
+		(r.singleBit || r.maxStep >= 0x100):
+		// Few values differing by a few bits, flipped one at a time or far apart
+		return REGISTER_BITFIELD
+	case r.maxStep <= 50 && r.min >= -400 && r.max <= 1500:
+		// Smooth changes between -40.0 and 150.0 in tenths of a degree
+		return REGISTER_TEMPERATURE
+	case r.maxStep <= 100:
+		return REGISTER_ANALOG
+	}
+	return REGISTER_UNKNOWN
+}
+
+// Returns the events the register changes are correlated with: most occurrences of the event are followed by
+// a change, while the register changes seldom enough that this is unlikely to be chance
+func (r *discoveredRegister) correlated(events map[string]*discoveredEvent, duration time.Duration) map[string]string {
+	if r.changes == 0 || duration <= 0 {
+		return nil
+	}
+	chance := float64(r.changes) * float64(DISCOVERY_EVENT_WINDOW) / float64(duration)
+	if chance >= 0.5 {
+		return nil
+	}
+	var correlated map[string]string
+	for name, event := range events {
+		if float64(r.hits[name]) >= 0.8*float64(event.occurrences) {
+			if correlated == nil {
+				correlated = make(map[string]string)
+			}
+			correlated[name] = fmt.Sprintf("%d/%d", r.hits[name], event.occurrences)
+		}
+	}
+	return correlated
+}
+
+// Sorted by slave and start address
+func (d *Discovery) sortedBlocks() []*discoveredBlock {
+	var blocks []*discoveredBlock
+	for _, block := range d.blocks {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		a, b := blocks[i].request, blocks[j].request
+		if a.slave != b.slave {
+			return a.slave < b.slave
+		}
+		if a.function != b.function {
+			return a.function < b.function
+		}
+		if a.start != b.start {
+			return a.start < b.start
+		}
+		return a.quantity < b.quantity
+	})
+	return blocks
+}
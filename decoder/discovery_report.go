@@ -0,0 +1,195 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+type DiscoveryReport struct {
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	Responses int               `json:"responses"`
+	Events    map[string]int    `json:"events"`
+	Blocks    []DiscoveredBlock `json:"blocks"`
+}
+
+type DiscoveredBlock struct {
+	Slave     int                  `json:"slave"`
+	Function  int                  `json:"function"`
+	Address   string               `json:"address"`
+	Registers int                  `json:"registers"`
+	Name      string               `json:"name,omitempty"`
+	Reads     int                  `json:"reads"`
+	Values    []DiscoveredRegister `json:"values"`
+}
+
+// Values are shown as signed 16 bit integers, as most registers hold signed measurements, except for bitfields where
+// Min and Max hold the bits always set and the bits ever set
+type DiscoveredRegister struct {
+	Index      int               `json:"index"`
+	Register   string            `json:"register"`
+	Targets    []string          `json:"targets,omitempty"`
+	Class      string            `json:"class"`
+	First      int               `json:"first"`
+	Last       int               `json:"last"`
+	Min        int               `json:"min"`
+	Max        int               `json:"max"`
+	Changes    int               `json:"changes"`
+	LastChange *time.Time        `json:"last_change,omitempty"`
+	Events     map[string]string `json:"events,omitempty"`
+}
+
+// Returns the register map fields decoded from the register at address
+func (d *Discovery) targets(address uint16) []string {
+	if d.registerMap == nil {
+		return nil
+	}
+	return d.registerMap.targets(address)
+}
+
+func (d *Discovery) Report() *DiscoveryReport {
+	report := &DiscoveryReport{
+		Start:     d.start,
+		End:       d.end,
+		Responses: d.responses,
+		Events:    make(map[string]int),
+	}
+	for name, event := range d.events {
+		report.Events[name] = event.occurrences
+	}
+	for _, block := range d.sortedBlocks() {
+		r := block.request
+		b := DiscoveredBlock{
+			Slave:     int(r.slave),
+			Function:  int(r.function),
+			Address:   fmt.Sprintf("0x%04x", r.start),
+			Registers: int(r.quantity),
+			Reads:     block.reads,
+		}
+		if d.registerMap != nil {
+			if _, known := d.registerMap.block(r); known != nil {
+				b.Name = known.Name
+			}
+		}
+		for i, register := range block.registers {
+			address := r.start + uint16(i)
+			value := DiscoveredRegister{
+				Index:    i,
+				Register: fmt.Sprintf("0x%04x", address),
+				Targets:  d.targets(address),
+				Class:    register.class(),
+				First:    int(register.first),
+				Last:     int(register.last),
+				Min:      int(register.min),
+				Max:      int(register.max),
+				Changes:  register.changes,
+				Events:   register.correlated(d.events, d.end.Sub(d.start)),
+			}
+			if value.Class == REGISTER_BITFIELD {
+				value.Min, value.Max = int(register.and), int(register.or)
+			}
+			if register.changes > 0 {
+				lastChange := register.lastChange
+				value.LastChange = &lastChange
+			}
+			b.Values = append(b.Values, value)
+		}
+		report.Blocks = append(report.Blocks, b)
+	}
+	return report
+}
+
+// Writes the report as Markdown tables, in the style of RECORDS.md
+func (r *DiscoveryReport) Markdown(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Register discovery\n\n")
+	fmt.Fprintf(&b, "Observed from %s to %s, %d responses\n\n", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339),
+		r.Responses)
+	if len(r.Events) > 0 {
+		var events []string
+		for name, count := range r.Events {
+			events = append(events, fmt.Sprintf("%s %d", name, count))
+		}
+		sort.Strings(events)
+		fmt.Fprintf(&b, "Events: %s\n\n", strings.Join(events, ", "))
+	}
+	for _, block := range r.Blocks {
+		name := strings.ToUpper(block.Name)
+		if len(name) == 0 {
+			name = "UNKNOWN"
+		}
+		fmt.Fprintf(&b, "#### %s\n", name)
+		fmt.Fprintf(&b, "Slave %d - Function %d - Address %s - Registers %d - Reads %d\n\n", block.Slave,
+			block.Function, block.Address, block.Registers, block.Reads)
+		fmt.Fprintf(&b, "| Index | Register | Known | Class | Last | Min | Max | Changes | Last change | Events |\n")
+		fmt.Fprintf(&b, "|------:|----------|-------|-------|-----:|----:|----:|--------:|-------------|--------|\n")
+		for _, v := range block.Values {
+			class := v.Class
+			if len(v.Targets) == 0 && class != REGISTER_UNUSED && class != REGISTER_CONSTANT {
+				// Changing registers that are not in the register map are the interesting ones
+				class = "**" + class + "**"
+			}
+			lastChange := ""
+			if v.LastChange != nil {
+				lastChange = v.LastChange.Format("2006-01-02 15:04:05")
+			}
+			var events []string
+			for name, hits := range v.Events {
+				events = append(events, name+" "+hits)
+			}
+			sort.Strings(events)
+			fmt.Fprintf(&b, "| %d | %s | %s | %s | %s | %s | %s | %d | %s | %s |\n", v.Index, v.Register,
+				strings.Join(v.Targets, ", "), class, formatRegister(v.Last, v.Class), formatRegister(v.Min, v.Class),
+				formatRegister(v.Max, v.Class), v.Changes, lastChange, strings.Join(events, ", "))
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	fmt.Fprintf(&b, "- Class: %s = always %04x, %s = never changed, %s = C * 10, %s = only small increments, "+
+		"%s = few values differing by a few bits, %s = smooth changes out of the temperature range\n",
+		REGISTER_UNUSED, UNUSED_REGISTER, REGISTER_CONSTANT, REGISTER_TEMPERATURE, REGISTER_COUNTER, REGISTER_BITFIELD,
+		REGISTER_ANALOG)
+	fmt.Fprintf(&b, "- Min and Max of bitfields: bits always set and bits ever set\n")
+	fmt.Fprintf(&b, "- Bold: changing registers not decoded by the register map\n")
+	fmt.Fprintf(&b, "- Events: occurrences of the event followed by a change of the register within %s\n",
+		DISCOVERY_EVENT_WINDOW)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func formatRegister(value int, class string) string {
+	switch class {
+	case REGISTER_TEMPERATURE:
+		return fmt.Sprintf("%.1f", float64(value)/10)
+	case REGISTER_BITFIELD, REGISTER_UNUSED:
+		return fmt.Sprintf("%04x", uint16(value))
+	}
+	return fmt.Sprintf("%d", value)
+}
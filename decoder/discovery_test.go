@@ -0,0 +1,175 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"heatpump/base"
+	"heatpump/decoder"
+)
+
+// A recording of the frames of a scenario, each frame captured at its simulated time since start
+type scenarioRecording struct {
+	start  time.Time
+	frames []busFrame
+}
+
+func (r *scenarioRecording) Next() (time.Time, []byte, error) {
+	if len(r.frames) == 0 {
+		return time.Time{}, nil, io.EOF
+	}
+	f := r.frames[0]
+	r.frames = r.frames[1:]
+	return r.start.Add(f.elapsed), f.data, nil
+}
+
+// The controller also reads an undocumented block at 0x0200: a register that counts the compressor starts, changed
+// within a minute of each start, a temperature that changes long after any event, a constant and an unused register
+func TestDiscovery(t *testing.T) {
+	site := base.DefaultSite
+	base.DefaultSite = &base.Site{Name: "test", ModbusFraming: decoder.FRAMING_RTU, ModbusAddrs: []int{1}}
+	defer func() {
+		base.DefaultSite = site
+	}()
+	temperatures := []uint16{250, 262, 240, 255}
+	block := func(starts int, temperature uint16) []uint16 {
+		return []uint16{100, uint16(starts), temperature, 0x7ffe}
+	}
+	var script strings.Builder
+	read := func(values []uint16) {
+		fmt.Fprintf(&script, "read 0x0200=%d,%d,%d,%d\n", values[0], values[1], values[2], values[3])
+	}
+	fmt.Fprintf(&script, "set status=on water_out=40\nrun 10m\n")
+	read(block(0, temperatures[0]))
+	for i := 1; i <= 3; i++ {
+		fmt.Fprintf(&script, "set compressor=running\nrun 30s\n")
+		read(block(i, temperatures[i-1]))
+		fmt.Fprintf(&script, "run 20m\nset compressor=off\nrun 20m\n")
+		read(block(i, temperatures[i]))
+	}
+	frames := scenarioFrames(t, script.String(), 10*time.Second, []byte{1})
+	start := time.Unix(1792321412, 0)
+	// Capture time of the last response holding the values
+	responded := func(values []uint16) time.Time {
+		response := decoder.ReadResponse(1, values)
+		for i := len(frames) - 1; i >= 0; i-- {
+			if bytes.Equal(frames[i].data, response) {
+				return start.Add(frames[i].elapsed)
+			}
+		}
+		t.Fatalf("no response %v", values)
+		return time.Time{}
+	}
+
+	discovery := decoder.NewDiscovery()
+	if err := decoder.DiscoverRecording(&scenarioRecording{start: start, frames: frames}, discovery); err != nil {
+		t.Fatal(err)
+	}
+	report := discovery.Report()
+	if !report.Start.Equal(start.Add(frames[1].elapsed)) || !report.End.Equal(start.Add(frames[len(frames)-1].elapsed)) {
+		t.Errorf("observed from %s to %s, want the first and the last response", report.Start, report.End)
+	}
+	if report.Events[decoder.EVENT_COMPRESSOR_START] != 3 || report.Events[decoder.EVENT_COMPRESSOR_STOP] != 3 {
+		t.Errorf("events %v, want 3 compressor starts and stops", report.Events)
+	}
+	var unknown *decoder.DiscoveredBlock
+	for i, b := range report.Blocks {
+		switch {
+		case b.Address == "0x0200":
+			unknown = &report.Blocks[i]
+		case len(b.Name) == 0:
+			t.Errorf("block %s not named after the register map", b.Address)
+		}
+	}
+	if unknown == nil {
+		t.Fatalf("block 0x0200 not discovered, blocks %+v", report.Blocks)
+	}
+	if unknown.Name != "" || unknown.Slave != 1 || unknown.Function != 3 || unknown.Registers != 4 ||
+		unknown.Reads != 7 {
+		t.Errorf("block %+v, want unnamed, slave 1, function 3, 4 registers, 7 reads", *unknown)
+	}
+
+	starts := responded(block(3, temperatures[2]))
+	last := responded(block(3, temperatures[3]))
+	for _, test := range []struct {
+		register              string
+		class                 string
+		first, last, min, max int
+		changes               int
+		lastChange            *time.Time
+		events                map[string]string
+	}{
+		{"0x0200", decoder.REGISTER_CONSTANT, 100, 100, 100, 100, 0, nil, nil},
+		{"0x0201", decoder.REGISTER_COUNTER, 0, 3, 0, 3, 3, &starts, map[string]string{
+			decoder.EVENT_COMPRESSOR_START: "3/3"}},
+		{"0x0202", decoder.REGISTER_TEMPERATURE, 250, 255, 240, 262, 3, &last, nil},
+		{"0x0203", decoder.REGISTER_UNUSED, 0x7ffe, 0x7ffe, 0x7ffe, 0x7ffe, 0, nil, nil},
+	} {
+		var v *decoder.DiscoveredRegister
+		for i := range unknown.Values {
+			if unknown.Values[i].Register == test.register {
+				v = &unknown.Values[i]
+			}
+		}
+		if v == nil {
+			t.Errorf("register %s not reported", test.register)
+			continue
+		}
+		if v.Class != test.class || v.First != test.first || v.Last != test.last || v.Min != test.min ||
+			v.Max != test.max || v.Changes != test.changes || len(v.Targets) != 0 {
+			t.Errorf("register %+v, want class %s first %d last %d min %d max %d changes %d", *v, test.class,
+				test.first, test.last, test.min, test.max, test.changes)
+		}
+		switch {
+		case test.lastChange == nil && v.LastChange != nil:
+			t.Errorf("register %s last changed at %s, want never", test.register, v.LastChange)
+		case test.lastChange != nil && (v.LastChange == nil || !v.LastChange.Equal(*test.lastChange)):
+			t.Errorf("register %s last changed at %v, want %s", test.register, v.LastChange, test.lastChange)
+		}
+		if fmt.Sprint(v.Events) != fmt.Sprint(test.events) {
+			t.Errorf("register %s correlated with %v, want %v", test.register, v.Events, test.events)
+		}
+	}
+
+	var markdown strings.Builder
+	if err := report.Markdown(&markdown); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"#### UNKNOWN\nSlave 1 - Function 3 - Address 0x0200 - Registers 4 - Reads 7",
+		"| 1 | 0x0201 |  | **counter** | 3 | 0 | 3 | 3 | ", "| compressor_start 3/3 |\n",
+		"| 2 | 0x0202 |  | **temperature** | 25.5 | 24.0 | 26.2 | 3 | ",
+		"| 3 | 0x0203 |  | unused | 7ffe | 7ffe | 7ffe | 0 |  |  |\n"} {
+		if !strings.Contains(markdown.String(), want) {
+			t.Errorf("markdown without %q:\n%s", want, markdown.String())
+		}
+	}
+}
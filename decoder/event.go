@@ -0,0 +1,77 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"time"
+
+	"heatpump/domain"
+	"heatpump/domain/vitocal"
+)
+
+const (
+	// Snapshot that passed the throttling, to be published
+	KIND_TELEMETRY string = "telemetry"
+	// Every complete snapshot of a heatpump, before throttling
+	KIND_SNAPSHOT string = "snapshot"
+	// A heatpump started or stopped answering
+	KIND_POWER string = "power"
+	// Register write acknowledged by a heatpump
+	KIND_WRITE string = "write"
+	// Bus health state changed
+	KIND_BUS string = "bus"
+	// Statistics of the unrecognised frames are due
+	KIND_DIAGNOSTICS string = "diagnostics"
+	// Connection state of the site, not decoded but handed to the sinks of the site by the service
+	KIND_STATUS string = "status"
+)
+
+// An event decoded from the Modbus stream. The decoder does not publish anything itself, events are handed to the
+// handlers of the Decoder, which publish them to MQTT, reflect them in the state files or log them. The values are
+// copies that the decoder does not modify afterwards, handlers may keep them.
+type Event struct {
+	Kind string
+	Time time.Time
+	// Slave address of the heatpump, zero for the events of the whole bus
+	Slave int
+	// MQTT topic of the event in the site, empty for snapshot and power events
+	Topic string
+	// JSON encoding of the value, nil for snapshot and power events
+	Payload []byte
+
+	// Telemetry and snapshot events
+	Vitocal *domain.Vitocal
+	// Telemetry events: summary of the snapshot for the log
+	Summary string
+	// Power events
+	Powered bool
+	// Write events
+	Write *domain.RegisterWrite
+	// Bus events
+	Bus *vitocal.Bus
+	// Diagnostics events
+	Diagnostics *vitocal.Diagnostics
+}
@@ -0,0 +1,326 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"heatpump/base"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Wait between connection attempts of a failover source
+	FAILOVER_RETRY_INTERVAL = 10 * time.Second
+	// Partial frames of a failover source are flushed when it has been quiet for this time
+	FAILOVER_READ_TIMEOUT = time.Second
+
+	SOURCE_PRIMARY   int = 0
+	SOURCE_SECONDARY int = 1
+)
+
+// Opens an input source
+type Dialer func() (Conn, error)
+
+// Failover reads the same bus through a primary and a secondary source, e.g. a MODBUS TCP gateway and a RS-485
+// dongle, and hands the stream of one of them to the decoder. Both sources are read all the time and their frames
+// verified, the stream of the other source is discarded so that every frame is decoded once. The decoder is switched
+// to the secondary source when the primary has not delivered a valid frame for FAILOVER_SECONDS while the secondary
+// has, and back to the primary once it has been delivering valid frames again for FAILBACK_SECONDS. Sources are
+// reconnected on their own, Read ends only when the failover is closed. A switch restarts the stream at an arbitrary
+// byte of the other source, Run then discards the partial frame of the previous source and the requests waiting for
+// their responses.
+type Failover struct {
+	log      *log.Logger
+	framing  string
+	failover time.Duration
+	failback time.Duration
+	start    time.Time
+	sources  [2]*failoverSource
+	chunks   chan failoverChunk
+	done     chan struct{}
+	close    sync.Once
+
+	// The active source is chosen by the reader goroutine and written to by the decoder goroutine
+	mutex  sync.Mutex
+	active int
+	// Number of switches between the sources
+	switched uint64
+
+	// Used by the reader goroutine only
+	pending  []byte
+	deadline time.Time
+}
+
+type failoverSource struct {
+	name  string
+	dial  Dialer
+	mutex sync.Mutex
+	// Nil while disconnected
+	conn Conn
+	// Last valid frame and start of the current run of valid frames
+	lastValid  time.Time
+	validSince time.Time
+}
+
+// Valid frames of a source seen by the decoder goroutine
+type failoverState struct {
+	name                  string
+	lastValid, validSince time.Time
+}
+
+type failoverChunk struct {
+	source int
+	data   []byte
+}
+
+// Reads the site through its primary and secondary sources, opened by the dialers
+func NewFailover(site *base.Site, primary Dialer, secondary Dialer) *Failover {
+	f := &Failover{
+		log:      site.Logger(),
+		framing:  site.ModbusFraming,
+		failover: time.Duration(base.FailoverSeconds) * time.Second,
+		failback: time.Duration(base.FailbackSeconds) * time.Second,
+		start:    time.Now(),
+		sources: [2]*failoverSource{
+			{name: site.Source(), dial: primary},
+			{name: site.SecondarySource(), dial: secondary},
+		},
+		chunks: make(chan failoverChunk, 16),
+		done:   make(chan struct{}),
+		active: SOURCE_PRIMARY,
+	}
+	for i := range f.sources {
+		go f.run(i)
+	}
+	f.log.Printf("MODBUS failover: primary %s, secondary %s\n", f.sources[SOURCE_PRIMARY].name,
+		f.sources[SOURCE_SECONDARY].name)
+	return f
+}
+
+// Returns the stream of the active source
+func (f *Failover) Read(buf []byte) (int, error) {
+	if len(f.pending) > 0 {
+		size := copy(buf, f.pending)
+		f.pending = f.pending[size:]
+		return size, nil
+	}
+	var timeout <-chan time.Time
+	if !f.deadline.IsZero() {
+		timer := time.NewTimer(time.Until(f.deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case chunk := <-f.chunks:
+			f.choose(time.Now())
+			if chunk.source != f.source() {
+				continue
+			}
+			size := copy(buf, chunk.data)
+			f.pending = chunk.data[size:]
+			return size, nil
+		case <-timeout:
+			f.choose(time.Now())
+			return 0, os.ErrDeadlineExceeded
+		case <-f.done:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+// Requests are sent through the active source. A request is lost while the active source is disconnected, as if
+// the bus had dropped it.
+func (f *Failover) Write(data []byte) (int, error) {
+	source := f.sources[f.source()]
+	source.mutex.Lock()
+	conn := source.conn
+	source.mutex.Unlock()
+	if conn == nil {
+		return len(data), nil
+	}
+	return conn.Write(data)
+}
+
+func (f *Failover) SetReadDeadline(t time.Time) error {
+	f.deadline = t
+	return nil
+}
+
+func (f *Failover) Close() error {
+	f.close.Do(func() {
+		close(f.done)
+		for _, source := range f.sources {
+			source.mutex.Lock()
+			if source.conn != nil {
+				source.conn.Close()
+			}
+			source.mutex.Unlock()
+		}
+	})
+	return nil
+}
+
+// Returns the active source
+func (f *Failover) source() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.active
+}
+
+// Returns the number of switches between the sources, the stream read restarts with each of them
+func (f *Failover) switches() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.switched
+}
+
+func (f *Failover) activate(index int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.active = index
+	f.switched++
+}
+
+// Switches the decoder to the source delivering valid frames
+func (f *Failover) choose(now time.Time) {
+	primary := f.sources[SOURCE_PRIMARY].state(f.start)
+	secondary := f.sources[SOURCE_SECONDARY].state(f.start)
+	switch f.source() {
+	case SOURCE_PRIMARY:
+		if now.Sub(primary.lastValid) >= f.failover && now.Sub(secondary.lastValid) < f.failover {
+			f.activate(SOURCE_SECONDARY)
+			f.log.Printf("MODBUS failover: no valid frames from %s since %s, switched to %s\n", primary.name,
+				primary.lastValid.Format(time.RFC3339), secondary.name)
+		}
+	case SOURCE_SECONDARY:
+		if now.Sub(primary.lastValid) < f.failover && now.Sub(primary.validSince) >= f.failback {
+			f.activate(SOURCE_PRIMARY)
+			f.log.Printf("MODBUS failover: %s recovered since %s, switched back from %s\n", primary.name,
+				primary.validSince.Format(time.RFC3339), secondary.name)
+		}
+	}
+}
+
+// Returns a copy of the source state, a source that has not delivered any valid frame counts as valid at start
+func (s *failoverSource) state(start time.Time) failoverState {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state := failoverState{name: s.name, lastValid: s.lastValid, validSince: s.validSince}
+	if state.lastValid.IsZero() {
+		state.lastValid = start
+	}
+	return state
+}
+
+// Connects the source and reads it until the failover is closed
+func (f *Failover) run(index int) {
+	source := f.sources[index]
+	for {
+		conn, err := source.dial()
+		if err == nil {
+			if !f.connected(source, conn) {
+				return
+			}
+			f.log.Printf("MODBUS failover: connected to %s\n", source.name)
+			err = f.read(index, conn)
+			source.mutex.Lock()
+			source.conn = nil
+			source.mutex.Unlock()
+			conn.Close()
+		}
+		select {
+		case <-f.done:
+			return
+		default:
+		}
+		f.log.Printf("MODBUS failover: error: '%s' reading %s\n", err, source.name)
+		select {
+		case <-f.done:
+			return
+		case <-time.After(FAILOVER_RETRY_INTERVAL):
+		}
+	}
+}
+
+// Keeps the connection to be closed by Close, reports false when the failover is already closed
+func (f *Failover) connected(source *failoverSource, conn Conn) bool {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	select {
+	case <-f.done:
+		conn.Close()
+		return false
+	default:
+	}
+	source.conn = conn
+	return true
+}
+
+// Verifies the frames of the source stream and forwards the stream to the decoder
+func (f *Failover) read(index int, conn Conn) error {
+	source := f.sources[index]
+	stream := framers[f.framing]()
+	for {
+		buf := make([]byte, 256)
+		conn.SetReadDeadline(time.Now().Add(FAILOVER_READ_TIMEOUT))
+		size, err := conn.Read(buf)
+		if err != nil && !os.IsTimeout(err) {
+			return err
+		}
+		var frames []frame
+		if size > 0 {
+			frames = stream.feed(buf[:size])
+		} else {
+			frames = stream.flush()
+		}
+		stream.dropped()
+		stream.corrupt()
+		if len(frames) > 0 {
+			source.valid(time.Now(), f.failover)
+		}
+		if size > 0 {
+			select {
+			case f.chunks <- failoverChunk{source: index, data: buf[:size]}:
+			case <-f.done:
+				return net.ErrClosed
+			}
+		}
+	}
+}
+
+// A gap longer than the failover time starts a new run of valid frames
+func (s *failoverSource) valid(now time.Time, failover time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.lastValid) >= failover {
+		s.validSince = now
+	}
+	s.lastValid = now
+}
@@ -0,0 +1,157 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"heatpump/base"
+	"heatpump/decoder"
+	"heatpump/simulator"
+)
+
+// A frame sent on the bus at elapsed since the start of the scenario
+type busFrame struct {
+	elapsed time.Duration
+	data    []byte
+}
+
+// Frames of a scenario as the Remote Touch Controller and the heatpump send them, a cycle every period
+func scenarioFrames(t testing.TB, script string, period time.Duration, slaves []byte) []busFrame {
+	scenario, err := simulator.Parse("test", []byte(script))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []busFrame
+	scenario.Generate(period, slaves, func(elapsed time.Duration, frame []byte, request bool) error {
+		frames = append(frames, busFrame{elapsed: elapsed, data: frame})
+		return nil
+	})
+	return frames
+}
+
+// The gateway end of a source: whatever the failover writes is read and discarded
+func gateway() (decoder.Conn, net.Conn) {
+	conn, peer := net.Pipe()
+	go io.Copy(io.Discard, peer)
+	return conn, peer
+}
+
+// The primary source stops in the middle of a cycle, the secondary delivers the same bus split at other boundaries.
+// The decoder goes on with the secondary once it has switched, while requests are written through the failover.
+func TestFailoverSwitch(t *testing.T) {
+	failover, failback := base.FailoverSeconds, base.FailbackSeconds
+	base.FailoverSeconds, base.FailbackSeconds = 1, 60
+	defer func() {
+		base.FailoverSeconds, base.FailbackSeconds = failover, failback
+	}()
+	// 8 frames per cycle, the primary stops after the first request of the 11th cycle
+	frames := scenarioFrames(t, "set status=on water_out=40\nrun 10s\nset water_out=45\nrun 1h", time.Second,
+		[]byte{1})
+	const primaryFrames = 10*8 + 1
+
+	primary, primaryPeer := gateway()
+	secondary, secondaryPeer := gateway()
+	site := &base.Site{Name: "test", ModbusTcp: "primary", SecondaryTcp: "secondary", ModbusFraming: decoder.FRAMING_RTU,
+		ModbusAddrs: []int{1}}
+	f := decoder.NewFailover(site, func() (decoder.Conn, error) {
+		return primary, nil
+	}, func() (decoder.Conn, error) {
+		return secondary, nil
+	})
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var bus sync.WaitGroup
+	bus.Add(2)
+	go func() {
+		defer bus.Done()
+		for i, bus := range frames {
+			frame := bus.data
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			if i < primaryFrames {
+				primaryPeer.Write(frame)
+			}
+			for len(frame) > 0 {
+				size := 3
+				if size > len(frame) {
+					size = len(frame)
+				}
+				secondaryPeer.Write(frame[:size])
+				frame = frame[size:]
+			}
+		}
+	}()
+	// Requests sent through the active source, as when polling
+	go func() {
+		defer bus.Done()
+		for ctx.Err() == nil {
+			f.Write(frames[0].data)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var before, after int
+	d, err := decoder.New(decoder.WithSite(site), decoder.WithLogger(log.New(io.Discard, "", 0)),
+		decoder.WithHandler(func(e decoder.Event) {
+			if e.Kind != decoder.KIND_SNAPSHOT {
+				return
+			}
+			switch e.Vitocal.Temperatures.WaterOut {
+			case "40.0":
+				before++
+			case "45.0":
+				after++
+				if after == 5 {
+					cancel()
+				}
+			default:
+				t.Errorf("snapshot with water_out %s", e.Vitocal.Temperatures.WaterOut)
+			}
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Run(ctx, f)
+	cancel()
+	primaryPeer.Close()
+	secondaryPeer.Close()
+	bus.Wait()
+	if before != 10 || after < 5 {
+		t.Errorf("%d snapshots from the primary, %d from the secondary, want 10 and 5", before, after)
+	}
+}
@@ -0,0 +1,287 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import "sort"
+
+const (
+	MODBUS_MIN_FRAME   int  = 5
+	MODBUS_MAX_ADDRESS byte = 247
+
+	// Read request (holding or input registers): address, function, start address (2 bytes), quantity (2 bytes),
+	// checksum (2 bytes)
+	MODBUS_READ_REQUEST_SIZE int = 8
+	// Write single register request and response: address, function, register address (2 bytes), value (2 bytes),
+	// checksum (2 bytes). Write multiple registers response: address, function, start address (2 bytes),
+	// quantity (2 bytes), checksum (2 bytes)
+	MODBUS_WRITE_SIZE int = 8
+	// Exception response: address, function with the exception bit set, exception code, checksum (2 bytes)
+	MODBUS_EXCEPTION_SIZE int = 5
+
+	// Framing of the Modbus stream, selected by MODBUS_FRAMING
+	FRAMING_RTU   string = "rtu"
+	FRAMING_MBAP  string = "mbap"
+	FRAMING_ASCII string = "ascii"
+)
+
+// A complete and verified Modbus frame. Whatever the framing, data starts with the slave address followed by the
+// function code and its payload, as in an RTU frame.
+type frame struct {
+	data    []byte
+	request bool
+	// MBAP transaction identifier, zero in RTU frames
+	transaction uint16
+}
+
+// Splits a Modbus byte stream into frames
+type framer interface {
+	// Appends data to the stream and returns the complete frames found so far
+	feed(data []byte) []frame
+	// Returns the frames still in the stream after a silence on the bus and discards the remaining bytes
+	flush() []frame
+	// Returns the number of bytes discarded since the last call
+	dropped() int
+	// Returns the number of frames discarded since the last call because their checksum failed: address, function and
+	// length matched a frame, but not the CRC or LRC
+	corrupt() int
+	// Reports whether responses are paired with requests by transaction identifier
+	transactions() bool
+	// Returns an RTU frame in the framing of the stream
+	encode(rtu []byte, transaction uint16) []byte
+}
+
+// Framers by MODBUS_FRAMING name
+var framers = map[string]func() framer{
+	FRAMING_RTU:   func() framer { return &rtuFramer{} },
+	FRAMING_MBAP:  func() framer { return &mbapFramer{} },
+	FRAMING_ASCII: func() framer { return &asciiFramer{} },
+}
+
+// Returns the names of the supported framings
+func Framings() []string {
+	var names []string
+	for name := range framers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The gateway forwards the bus traffic as a raw byte stream: a TCP segment may carry part of a frame or several
+// frames. The framer accumulates the stream and extracts complete frames, resynchronising on address, function,
+// length and checksum whenever it finds bytes that do not belong to a valid frame.
+type rtuFramer struct {
+	buf       []byte
+	discarded int
+	crcErrors int
+	// Bytes are being discarded to find the next frame, the frames seemingly found inside the bytes of a corrupt
+	// frame are not counted as CRC errors
+	resyncing bool
+}
+
+// Incomplete frames are kept until more data arrives
+func (f *rtuFramer) feed(data []byte) []frame {
+	f.buf = append(f.buf, data...)
+	return f.scan(false)
+}
+
+// A partial frame cannot be completed once the sender has gone quiet
+func (f *rtuFramer) flush() []frame {
+	frames := f.scan(true)
+	f.discarded += len(f.buf)
+	f.buf = f.buf[:0]
+	f.resyncing = false
+	return frames
+}
+
+func (f *rtuFramer) dropped() int {
+	discarded := f.discarded
+	f.discarded = 0
+	return discarded
+}
+
+func (f *rtuFramer) corrupt() int {
+	crcErrors := f.crcErrors
+	f.crcErrors = 0
+	return crcErrors
+}
+
+// Modbus RTU has no transaction identifier
+func (f *rtuFramer) transactions() bool {
+	return false
+}
+
+func (f *rtuFramer) encode(rtu []byte, transaction uint16) []byte {
+	return rtu
+}
+
+func (f *rtuFramer) scan(final bool) []frame {
+	var frames []frame
+	for len(f.buf) >= MODBUS_MIN_FRAME {
+		size, request, more, corrupt := match(f.buf)
+		if size > 0 {
+			data := make([]byte, size)
+			copy(data, f.buf[:size])
+			frames = append(frames, frame{data: data, request: request})
+			f.buf = f.buf[size:]
+			f.resyncing = false
+			continue
+		}
+		if more && !final {
+			break
+		}
+		if corrupt && !more && !f.resyncing {
+			f.crcErrors++
+		}
+		// Not the start of a frame, slide by one byte and try again
+		f.buf = f.buf[1:]
+		f.discarded++
+		f.resyncing = true
+	}
+	// Release the consumed part of the underlying array
+	f.buf = append([]byte(nil), f.buf...)
+	return frames
+}
+
+// Checks whether buf starts with a valid frame and returns its size and whether it is a request.
+// When no frame is found, more reports whether one might still be completed by further data, and corrupt whether
+// the address, function and length of a frame matched but its checksum failed.
+func match(buf []byte) (size int, request bool, more bool, corrupt bool) {
+	if buf[0] == 0 || buf[0] > MODBUS_MAX_ADDRESS {
+		return 0, false, false, false
+	}
+	if buf[1]&MODBUS_EXCEPTION != 0 {
+		if !decoded(buf[1] &^ MODBUS_EXCEPTION) {
+			return 0, false, false, false
+		}
+		valid, short := sized(buf, MODBUS_EXCEPTION_SIZE)
+		if valid {
+			return MODBUS_EXCEPTION_SIZE, false, false, false
+		}
+		return 0, false, short, !short
+	}
+	switch buf[1] {
+	case MODBUS_READ, MODBUS_READ_INPUT:
+		// A read request is always 8 bytes. Its third byte is the start address high byte, which might be taken for
+		// a response payload size, therefore the request is checked first. A response payload size is always even.
+		valid, short := sized(buf, MODBUS_READ_REQUEST_SIZE)
+		if valid {
+			return MODBUS_READ_REQUEST_SIZE, true, false, false
+		}
+		more, corrupt = short, !short
+		if buf[2] > 0 && buf[2]%2 == 0 {
+			responseSize := int(buf[2]) + 5
+			valid, short = sized(buf, responseSize)
+			if valid {
+				return responseSize, false, false, false
+			}
+			more, corrupt = more || short, corrupt || !short
+		}
+	case MODBUS_WRITE_SINGLE:
+		// Request and response are identical, the session tells them apart
+		valid, short := sized(buf, MODBUS_WRITE_SIZE)
+		if valid {
+			return MODBUS_WRITE_SIZE, true, false, false
+		}
+		more, corrupt = short, !short
+	case MODBUS_WRITE_MULTIPLE:
+		// The response holds start address and quantity, the request adds the payload size and the values
+		valid, short := sized(buf, MODBUS_WRITE_SIZE)
+		if valid {
+			return MODBUS_WRITE_SIZE, false, false, false
+		}
+		more, corrupt = short, !short
+		// The payload size is the seventh byte
+		if len(buf) < 7 {
+			return 0, false, true, false
+		}
+		if buf[6] > 0 && buf[6]%2 == 0 {
+			requestSize := int(buf[6]) + 9
+			valid, short = sized(buf, requestSize)
+			if valid {
+				return requestSize, true, false, false
+			}
+			more, corrupt = more || short, corrupt || !short
+		}
+	}
+	return 0, false, more, corrupt
+}
+
+// Checks whether data, a frame without checksum, is a request or a response of the decoded functions
+func classify(data []byte) (request bool, ok bool) {
+	if len(data) < 2 {
+		return false, false
+	}
+	if data[1]&MODBUS_EXCEPTION != 0 {
+		return false, len(data) == MODBUS_EXCEPTION_SIZE-2 && decoded(data[1]&^MODBUS_EXCEPTION)
+	}
+	switch data[1] {
+	case MODBUS_READ, MODBUS_READ_INPUT:
+		if len(data) == MODBUS_READ_REQUEST_SIZE-2 {
+			return true, true
+		}
+		if len(data) >= 3 && data[2] > 0 && data[2]%2 == 0 && int(data[2]) == len(data)-3 {
+			return false, true
+		}
+	case MODBUS_WRITE_SINGLE:
+		if len(data) == MODBUS_WRITE_SIZE-2 {
+			return true, true
+		}
+	case MODBUS_WRITE_MULTIPLE:
+		if len(data) == MODBUS_WRITE_SIZE-2 {
+			return false, true
+		}
+		if len(data) >= 7 && data[6] > 0 && data[6]%2 == 0 && int(data[6]) == len(data)-7 {
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// Reports whether the function is one of the decoded functions
+func decoded(function byte) bool {
+	return reading(function) || function == MODBUS_WRITE_SINGLE || function == MODBUS_WRITE_MULTIPLE
+}
+
+// Reports whether the function reads registers. Only holding registers are decoded by the register map, input
+// registers are framed so that the reads of other masters or firmware versions can be told apart from noise.
+func reading(function byte) bool {
+	return function == MODBUS_READ || function == MODBUS_READ_INPUT
+}
+
+// Checks the checksum of the frame of the given size at the start of buf, short reports that buf is not long enough
+func sized(buf []byte, size int) (valid bool, short bool) {
+	if len(buf) < size {
+		return false, true
+	}
+	return validChecksum(buf[:size]), false
+}
+
+func validChecksum(buf []byte) bool {
+	size := len(buf)
+	checksum := crc16(buf, size)
+	return checksum[0] == buf[size-2] && checksum[1] == buf[size-1]
+}
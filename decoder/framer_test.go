@@ -0,0 +1,168 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// Returns an RTU frame: the bytes followed by their crc16
+func rtu(data ...byte) []byte {
+	buf := append(append([]byte(nil), data...), 0, 0)
+	checksum := crc16(buf, len(buf))
+	buf[len(buf)-2] = checksum[0]
+	buf[len(buf)-1] = checksum[1]
+	return buf
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+var (
+	// Read 10 holding registers of slave 1 from 0, the classic Modbus example
+	readRequest10 = rtu(0x01, 0x03, 0x00, 0x00, 0x00, 0x0a)
+	// Response with 2 registers
+	readResponse2 = rtu(0x01, 0x03, 0x04, 0x00, 0x12, 0x01, 0x34)
+	readRequest2  = rtu(0x01, 0x03, 0x00, 0x00, 0x00, 0x02)
+	writeSingle   = rtu(0x01, 0x06, 0x1c, 0x2e, 0x00, 0x01)
+	exception     = rtu(0x01, 0x83, 0x02)
+)
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		data []byte
+		crc  [2]byte
+	}{
+		{[]byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a, 0, 0}, [2]byte{0xc5, 0xcd}},
+		{[]byte{0x11, 0x03, 0x00, 0x6b, 0x00, 0x03, 0, 0}, [2]byte{0x76, 0x87}},
+	}
+	for _, test := range tests {
+		if crc := crc16(test.data, len(test.data)); crc != test.crc {
+			t.Errorf("crc16(% x) = % x, want % x", test.data[:len(test.data)-2], crc, test.crc)
+		}
+	}
+}
+
+// Frames expected from a stream
+type expected struct {
+	data    []byte
+	request bool
+}
+
+func TestRTUFramer(t *testing.T) {
+	garbage := []byte{0x00, 0xff, 0x42}
+	corrupt := append([]byte(nil), readResponse2...)
+	corrupt[4] ^= 0xff
+	tests := []struct {
+		name    string
+		chunks  [][]byte
+		frames  []expected
+		dropped int
+		// Frames failing their checksum
+		corrupt int
+	}{
+		{"request", [][]byte{readRequest10}, []expected{{readRequest10, true}}, 0, 0},
+		{"split response", [][]byte{readResponse2[:3], readResponse2[3:5], readResponse2[5:]},
+			[]expected{{readResponse2, false}}, 0, 0},
+		{"coalesced request and response", [][]byte{concat(readRequest2, readResponse2)},
+			[]expected{{readRequest2, true}, {readResponse2, false}}, 0, 0},
+		{"garbage before a frame", [][]byte{concat(garbage, readRequest2)}, []expected{{readRequest2, true}},
+			len(garbage), 0},
+		{"corrupt frame then a valid one", [][]byte{concat(corrupt, readRequest2)},
+			[]expected{{readRequest2, true}}, len(corrupt), 1},
+		{"write and exception", [][]byte{concat(writeSingle, exception)},
+			[]expected{{writeSingle, true}, {exception, false}}, 0, 0},
+		{"incomplete frame flushed", [][]byte{concat(readRequest2, readResponse2[:4])},
+			[]expected{{readRequest2, true}}, 4, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := framers[FRAMING_RTU]()
+			var frames []frame
+			for _, chunk := range test.chunks {
+				frames = append(frames, f.feed(chunk)...)
+			}
+			frames = append(frames, f.flush()...)
+			checkFrames(t, frames, test.frames, false)
+			if dropped := f.dropped(); dropped != test.dropped {
+				t.Errorf("dropped %d bytes, want %d", dropped, test.dropped)
+			}
+			if corrupt := f.corrupt(); corrupt != test.corrupt {
+				t.Errorf("%d corrupt frames, want %d", corrupt, test.corrupt)
+			}
+		})
+	}
+}
+
+// Compares the frames with the expected RTU frames, without checksum when stripped
+func checkFrames(t *testing.T, frames []frame, want []expected, stripped bool) {
+	t.Helper()
+	if len(frames) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(frames), len(want))
+	}
+	for i, f := range frames {
+		data := want[i].data
+		if stripped {
+			data = data[:len(data)-2]
+		}
+		if !bytes.Equal(f.data, data) || f.request != want[i].request {
+			t.Errorf("frame %d = % x request=%t, want % x request=%t", i, f.data, f.request, data,
+				want[i].request)
+		}
+	}
+}
+
+func TestSequentialPairing(t *testing.T) {
+	now := time.Now()
+	f := framers[FRAMING_RTU]()
+	var p pairing
+	frames := f.feed(concat(readRequest2, readResponse2, readResponse2, readRequest10, readResponse2))
+	var paired, unpaired int
+	for _, frame := range frames {
+		if frame.request {
+			p.request(parseReadRequest(frame.data), now)
+			continue
+		}
+		if r, ok := p.response(frame.data, now); ok {
+			paired++
+			if r.start != 0 || r.quantity != 2 {
+				t.Errorf("paired with request %+v", r)
+			}
+		} else {
+			unpaired++
+		}
+	}
+	// The second response has no request, the last one does not match the quantity of its request
+	if paired != 1 || unpaired != 2 {
+		t.Errorf("paired %d, unpaired %d, want 1 and 2", paired, unpaired)
+	}
+	if p.health.UnpairedResponses != 2 || p.health.UnansweredRequests != 1 {
+		t.Errorf("bus health %s", &p)
+	}
+}
@@ -0,0 +1,400 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain"
+)
+
+const (
+	// Attempts of a write before the batch is spooled, the delay doubles after each attempt
+	INFLUX_ATTEMPTS    = 3
+	INFLUX_RETRY_DELAY = time.Second
+	INFLUX_TIMEOUT     = 10 * time.Second
+	// Batches are no longer spooled once the spool file reaches this size
+	INFLUX_SPOOL_MAX = 64 << 20
+)
+
+// Where and how the InfluxDB sink writes
+type InfluxConfig struct {
+	// Base URL of the InfluxDB server, e.g. http://localhost:8086
+	URL         string
+	Token       string
+	Org         string
+	Bucket      string
+	Measurement string
+	// Tags of every point, besides the slave address
+	Tags map[string]string
+	// A batch is written when it holds BatchSize points or FlushInterval after its first point
+	BatchSize     int
+	FlushInterval time.Duration
+	// File keeping the batches that could not be written, empty to drop them
+	Spool string
+}
+
+// Returns the InfluxDB configuration of the INFLUX_* environment variables for a site
+func SiteInfluxConfig(site *base.Site) InfluxConfig {
+	return InfluxConfig{
+		URL:           base.InfluxUrl,
+		Token:         base.InfluxToken,
+		Org:           base.InfluxOrg,
+		Bucket:        base.InfluxBucket,
+		Measurement:   base.InfluxMeasurement,
+		Tags:          map[string]string{"site": site.String()},
+		BatchSize:     base.InfluxBatchSize,
+		FlushInterval: time.Duration(base.InfluxFlushSeconds) * time.Second,
+		Spool:         base.InfluxSpoolDir + site.StateFilePrefix + "Influx.lp",
+	}
+}
+
+// Writes the snapshots to InfluxDB through the v2 HTTP write API, in batches of line protocol points. A batch that
+// cannot be written after INFLUX_ATTEMPTS is appended to the spool file, which is written back after the next
+// successful write. Batches rejected by InfluxDB as invalid are dropped. The points are added to the batch while a
+// full batch is being written and retried.
+type InfluxSink struct {
+	log      *log.Logger
+	config   InfluxConfig
+	writeUrl string
+	tags     string
+	client   *http.Client
+	// Delay before the second attempt of a write
+	retryDelay time.Duration
+
+	// Guards the batch being filled
+	mutex  sync.Mutex
+	batch  []string
+	timer  *time.Timer
+	closed bool
+	// Last log of a failed timed flush
+	errorLogged time.Time
+
+	// Held while a batch is written, so that the batches and the spool file are written one at a time
+	flushing sync.Mutex
+	// Last log of a failed replay of the spool file
+	replayLogged time.Time
+}
+
+// A write refused by InfluxDB because of its content, retrying cannot help
+type influxRejected struct {
+	status string
+	body   string
+}
+
+func (e *influxRejected) Error() string {
+	return strings.TrimSpace(fmt.Sprintf("InfluxDB rejected the points: %s %s", e.status, e.body))
+}
+
+func NewInfluxSink(logger *log.Logger, config InfluxConfig) *InfluxSink {
+	query := url.Values{}
+	query.Set("org", config.Org)
+	query.Set("bucket", config.Bucket)
+	query.Set("precision", "ns")
+	var keys []string
+	for key := range config.Tags {
+		keys = append(keys, key)
+	}
+	// The slave address is appended to the tags of each point
+	sort.Strings(keys)
+	var tags strings.Builder
+	for _, key := range keys {
+		tags.WriteString("," + influxEscape(key, ",= ") + "=" + influxEscape(config.Tags[key], ",= "))
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 1
+	}
+	return &InfluxSink{
+		log:        logger,
+		config:     config,
+		writeUrl:   strings.TrimSuffix(config.URL, "/") + "/api/v2/write?" + query.Encode(),
+		tags:       tags.String(),
+		client:     &http.Client{Timeout: INFLUX_TIMEOUT},
+		retryDelay: INFLUX_RETRY_DELAY,
+	}
+}
+
+func (s *InfluxSink) Name() string {
+	return SINK_INFLUX
+}
+
+func (s *InfluxSink) Write(e Event) error {
+	if e.Kind != KIND_SNAPSHOT {
+		return nil
+	}
+	line := s.line(e.Slave, e.Vitocal)
+	s.mutex.Lock()
+	s.batch = append(s.batch, line)
+	var lines []string
+	if len(s.batch) >= s.config.BatchSize {
+		lines = s.take()
+	} else if len(s.batch) == 1 && s.config.FlushInterval > 0 {
+		s.timer = time.AfterFunc(s.config.FlushInterval, s.timedFlush)
+	}
+	s.mutex.Unlock()
+	return s.flush(lines)
+}
+
+// Writes the last batch
+func (s *InfluxSink) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	lines := s.take()
+	s.mutex.Unlock()
+	return s.flush(lines)
+}
+
+func (s *InfluxSink) timedFlush() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	lines := s.take()
+	s.mutex.Unlock()
+	if err := s.flush(lines); err != nil {
+		s.mutex.Lock()
+		due := logDue(&s.errorLogged, time.Now())
+		s.mutex.Unlock()
+		if due {
+			s.log.Printf("sink %s: error: %s\n", SINK_INFLUX, err)
+		}
+	}
+}
+
+// Returns the batch and starts a new one, the caller holds the mutex
+func (s *InfluxSink) take() []string {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	lines := s.batch
+	s.batch = nil
+	return lines
+}
+
+// Writes the lines and then the spooled batches. Only the result of the lines is returned: once they are written, a
+// failed replay is logged and the spooled points are kept for the next flush.
+func (s *InfluxSink) flush(lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	if err := s.send(lines); err != nil {
+		var rejected *influxRejected
+		if errors.As(err, &rejected) {
+			return err
+		}
+		if spoolErr := s.spool(lines); spoolErr != nil {
+			return fmt.Errorf("%w, %d points lost: %s", err, len(lines), spoolErr)
+		}
+		return fmt.Errorf("%w, %d points spooled", err, len(lines))
+	}
+	if err := s.replay(); err != nil && logDue(&s.replayLogged, time.Now()) {
+		s.log.Printf("sink %s: error writing the spooled points: %s\n", SINK_INFLUX, err)
+	}
+	return nil
+}
+
+// Writes the lines, retrying unless InfluxDB rejects them
+func (s *InfluxSink) send(lines []string) error {
+	body := []byte(strings.Join(lines, "\n"))
+	delay := s.retryDelay
+	var err error
+	for attempt := 1; attempt <= INFLUX_ATTEMPTS; attempt++ {
+		if attempt > 1 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		err = s.post(body)
+		var rejected *influxRejected
+		if err == nil || errors.As(err, &rejected) {
+			return err
+		}
+	}
+	return err
+}
+
+func (s *InfluxSink) post(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, s.writeUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(s.config.Token) > 0 {
+		request.Header.Set("Authorization", "Token "+s.config.Token)
+	}
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode == http.StatusBadRequest || response.StatusCode == http.StatusRequestEntityTooLarge ||
+		response.StatusCode == http.StatusUnprocessableEntity:
+		return &influxRejected{status: response.Status, body: strings.TrimSpace(string(message))}
+	}
+	return fmt.Errorf("InfluxDB write: %s", strings.TrimSpace(response.Status+" "+string(message)))
+}
+
+// Appends the lines to the spool file
+func (s *InfluxSink) spool(lines []string) error {
+	if len(s.config.Spool) == 0 {
+		return errors.New("no spool file")
+	}
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	if info, err := os.Stat(s.config.Spool); err == nil && info.Size()+int64(len(data)) > INFLUX_SPOOL_MAX {
+		return fmt.Errorf("spool file %s full", s.config.Spool)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.config.Spool), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.config.Spool, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Writes the spooled lines in batches, the lines that cannot be written yet are kept in the spool file
+func (s *InfluxSink) replay() error {
+	if len(s.config.Spool) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(s.config.Spool)
+	if err != nil || len(data) == 0 {
+		// Nothing spooled
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	written := 0
+	for len(lines) > 0 {
+		size := s.config.BatchSize
+		if size > len(lines) {
+			size = len(lines)
+		}
+		if err := s.send(lines[:size]); err != nil {
+			var rejected *influxRejected
+			if !errors.As(err, &rejected) {
+				if writeErr := os.WriteFile(s.config.Spool, []byte(strings.Join(lines, "\n")+"\n"), 0644); writeErr != nil {
+					return writeErr
+				}
+				return fmt.Errorf("%w, %d spooled points left", err, len(lines))
+			}
+			s.log.Printf("sink %s: %s, %d spooled points dropped\n", SINK_INFLUX, err, size)
+		} else {
+			written += size
+		}
+		lines = lines[size:]
+	}
+	s.log.Printf("sink %s: %d spooled points written\n", SINK_INFLUX, written)
+	return os.Remove(s.config.Spool)
+}
+
+// Returns the line protocol point of a snapshot
+func (s *InfluxSink) line(slave int, v *domain.Vitocal) string {
+	var line strings.Builder
+	line.WriteString(influxEscape(s.config.Measurement, ", "))
+	line.WriteString(s.tags)
+	line.WriteString(",slave=" + strconv.Itoa(slave))
+	separator := " "
+	field := func(name string, value string) {
+		line.WriteString(separator + name + "=" + value)
+		separator = ","
+	}
+	number := func(name string, value float64) {
+		field(name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	number("control_mode", float64(v.ControlMode))
+	number("status", float64(v.Status))
+	number("mode", float64(v.Mode))
+	number("defrost", float64(v.Defrost))
+	number("oil_heater", float64(v.OilHeater))
+	field("compressor_required", strconv.FormatBool(v.CompressorRequired))
+	number("compressor_status", float64(v.CompressorStatus))
+	number("compressor_thrust", float64(v.CompressorThrust))
+	number("compressor_hz", float64(v.CompressorHz))
+	number("pump_status", float64(v.PumpStatus))
+	number("pump_speed", float64(v.PumpSpeed))
+	number("fan_speed", float64(v.FanSpeed))
+	for _, sensor := range []struct {
+		name  string
+		value string
+	}{
+		{"water_in", v.Temperatures.WaterIn},
+		{"water_out", v.Temperatures.WaterOut},
+		{"external", v.Temperatures.External},
+		{"compressor_in", v.Temperatures.CompressorIn},
+		{"compressor_out", v.Temperatures.CompressorOut},
+	} {
+		// Sensors that are not fitted have no value
+		if value, err := strconv.ParseFloat(sensor.value, 64); err == nil {
+			number(sensor.name, value)
+		}
+	}
+	number("pressure_suction", float64(v.PressureSuction))
+	number("pressure_condensation", float64(v.PressureCondensation))
+	number("hours", float64(v.Hours))
+	for i, value := range []uint16{v.Errors.Error1, v.Errors.Error2, v.Errors.Error3, v.Errors.Error4, v.Errors.Error5} {
+		number(fmt.Sprintf("error_%d", i+1), float64(value))
+	}
+	line.WriteString(" " + strconv.FormatInt(v.Timestamp.UnixNano(), 10))
+	return line.String()
+}
+
+// Escapes the characters of a measurement, tag key or tag value
+func influxEscape(value string, characters string) string {
+	var escaped strings.Builder
+	for _, c := range value {
+		if strings.ContainsRune(characters, c) || c == '\\' {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(c)
+	}
+	return escaped.String()
+}
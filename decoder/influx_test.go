@@ -0,0 +1,268 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"heatpump/domain"
+	"heatpump/domain/vitocal"
+)
+
+// Records the points written to the InfluxDB write API, answering each request with the next status of the queue or
+// 204 once it is empty. When hold is set, a request waits for it after signalling received.
+type influxStub struct {
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	points   []string
+	received chan struct{}
+	hold     chan struct{}
+}
+
+func (s *influxStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.hold != nil {
+		s.received <- struct{}{}
+		<-s.hold
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, r)
+	status := http.StatusNoContent
+	if len(s.statuses) > 0 {
+		status = s.statuses[0]
+		s.statuses = s.statuses[1:]
+	}
+	if status == http.StatusNoContent {
+		s.points = append(s.points, strings.Split(string(body), "\n")...)
+	}
+	w.WriteHeader(status)
+}
+
+func (s *influxStub) answer(statuses ...int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statuses = statuses
+}
+
+// Returns the number of requests and the points written
+func (s *influxStub) written() (int, []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.requests), append([]string(nil), s.points...)
+}
+
+func influxTest(t *testing.T, stub *influxStub, config InfluxConfig) *InfluxSink {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	config.URL = server.URL + "/"
+	if len(config.Measurement) == 0 {
+		config.Measurement = "heatpump"
+	}
+	sink := NewInfluxSink(log.New(io.Discard, "", 0), config)
+	sink.retryDelay = time.Millisecond
+	return sink
+}
+
+func snapshot(slave int, waterIn string) Event {
+	return Event{Kind: KIND_SNAPSHOT, Slave: slave, Vitocal: &domain.Vitocal{
+		Status:       domain.ON,
+		Temperatures: vitocal.Temperatures{WaterIn: waterIn, WaterOut: "38", External: "-"},
+		Timestamp:    time.Unix(1792321412, 128080538),
+	}}
+}
+
+func spooled(t *testing.T, spool string) []string {
+	data, err := os.ReadFile(spool)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestInfluxLine(t *testing.T) {
+	stub := &influxStub{}
+	sink := influxTest(t, stub, InfluxConfig{
+		Token:       "secret",
+		Org:         "home lab",
+		Bucket:      "heat&pump",
+		Measurement: "heat pump,1",
+		Tags:        map[string]string{"zone": `x\y`, "site name": "a=b,c"},
+		BatchSize:   1,
+	})
+	if err := sink.Write(snapshot(3, "33.1")); err != nil {
+		t.Fatal(err)
+	}
+	requests, points := stub.written()
+	if requests != 1 || len(points) != 1 {
+		t.Fatalf("%d requests, points %q, want 1 request of 1 point", requests, points)
+	}
+	r := stub.requests[0]
+	if r.URL.Path != "/api/v2/write" || r.URL.Query().Get("org") != "home lab" ||
+		r.URL.Query().Get("bucket") != "heat&pump" || r.URL.Query().Get("precision") != "ns" {
+		t.Errorf("request URL %s", r.URL)
+	}
+	if r.Header.Get("Authorization") != "Token secret" {
+		t.Errorf("authorization %q", r.Header.Get("Authorization"))
+	}
+
+	point := points[0]
+	prefix := `heat\ pump\,1,site\ name=a\=b\,c,zone=x\\y,slave=3 control_mode=0,status=1,`
+	if !strings.HasPrefix(point, prefix) {
+		t.Errorf("point %q, want the prefix %q", point, prefix)
+	}
+	if !strings.HasSuffix(point, ",error_5=0 1792321412128080538") {
+		t.Errorf("point %q, want the errors and timestamp at the end", point)
+	}
+	for _, field := range []string{",compressor_required=false,", ",water_in=33.1,water_out=38,pressure_suction="} {
+		if !strings.Contains(point, field) {
+			t.Errorf("point %q, want %q", point, field)
+		}
+	}
+	// The external sensor is not fitted
+	if strings.Contains(point, "external=") {
+		t.Errorf("point %q with an external temperature", point)
+	}
+}
+
+func TestInfluxRetrySpool(t *testing.T) {
+	stub := &influxStub{}
+	spool := filepath.Join(t.TempDir(), "spool", "Influx.lp")
+	sink := influxTest(t, stub, InfluxConfig{BatchSize: 2, Spool: spool})
+
+	stub.answer(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	sink.Write(snapshot(1, "30"))
+	if err := sink.Write(snapshot(2, "31")); err == nil || !strings.Contains(err.Error(), "2 points spooled") {
+		t.Errorf("error %v, want 2 points spooled", err)
+	}
+	if requests, points := stub.written(); requests != INFLUX_ATTEMPTS || len(points) != 0 {
+		t.Errorf("%d requests, %d points written, want %d requests", requests, len(points), INFLUX_ATTEMPTS)
+	}
+	if lines := spooled(t, spool); len(lines) != 2 || !strings.Contains(lines[1], "slave=2 ") {
+		t.Errorf("spooled %q, want the 2 points", lines)
+	}
+
+	// Points rejected as invalid are neither retried nor spooled
+	stub.answer(http.StatusBadRequest)
+	sink.Write(snapshot(3, "32"))
+	var rejected *influxRejected
+	if err := sink.Write(snapshot(4, "33")); !errors.As(err, &rejected) {
+		t.Errorf("error %v, want rejected", err)
+	}
+	if requests, _ := stub.written(); requests != INFLUX_ATTEMPTS+1 {
+		t.Errorf("%d requests, want %d", requests, INFLUX_ATTEMPTS+1)
+	}
+	if lines := spooled(t, spool); len(lines) != 2 {
+		t.Errorf("%d points spooled, want 2", len(lines))
+	}
+}
+
+func TestInfluxReplay(t *testing.T) {
+	stub := &influxStub{}
+	spool := filepath.Join(t.TempDir(), "Influx.lp")
+	sink := influxTest(t, stub, InfluxConfig{BatchSize: 2, Spool: spool})
+	stub.answer(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	sink.Write(snapshot(1, "30"))
+	sink.Write(snapshot(2, "31"))
+
+	// The batch is written but the spooled points are not: the write succeeds and the spool file is kept
+	stub.answer(http.StatusNoContent, http.StatusServiceUnavailable, http.StatusServiceUnavailable,
+		http.StatusServiceUnavailable)
+	sink.Write(snapshot(3, "32"))
+	if err := sink.Write(snapshot(4, "33")); err != nil {
+		t.Errorf("error %v after the batch was written", err)
+	}
+	if _, points := stub.written(); len(points) != 2 {
+		t.Errorf("%d points written, want 2", len(points))
+	}
+	if lines := spooled(t, spool); len(lines) != 2 {
+		t.Errorf("%d points spooled, want 2", len(lines))
+	}
+
+	// The spooled points follow the next batch, the last one written when the sink is closed
+	sink.Write(snapshot(5, "34"))
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, points := stub.written()
+	var slaves []string
+	for _, point := range points {
+		slaves = append(slaves, strings.Fields(point)[0][len("heatpump,slave="):])
+	}
+	if strings.Join(slaves, ",") != "3,4,5,1,2" {
+		t.Errorf("slaves %s written, want 3,4,5,1,2", strings.Join(slaves, ","))
+	}
+	if lines := spooled(t, spool); lines != nil {
+		t.Errorf("spool file left with %q", lines)
+	}
+}
+
+// A batch being retried does not hold back the next points
+func TestInfluxWriteWhileFlushing(t *testing.T) {
+	stub := &influxStub{received: make(chan struct{}), hold: make(chan struct{})}
+	sink := influxTest(t, stub, InfluxConfig{BatchSize: 10, FlushInterval: time.Millisecond})
+	sink.Write(snapshot(1, "30"))
+	<-stub.received
+
+	written := make(chan error)
+	go func() {
+		written <- sink.Write(snapshot(2, "31"))
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("write blocked by the timed flush")
+	}
+	close(stub.hold)
+	go func() {
+		// The second point is written by its own timed flush or by Close
+		for range stub.received {
+		}
+	}()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(stub.received)
+	if _, points := stub.written(); len(points) != 2 {
+		t.Errorf("%d points written, want 2", len(points))
+	}
+}
@@ -0,0 +1,118 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import "encoding/binary"
+
+const (
+	// MBAP header: transaction id (2 bytes), protocol id (2 bytes), length (2 bytes), unit id
+	MBAP_HEADER_SIZE int = 7
+	// The length field counts the unit id and the PDU, a PDU is at most 253 bytes
+	MBAP_MAX_LENGTH int = 254
+)
+
+// Modbus TCP gateways prefix each PDU with an MBAP header instead of the RTU address and checksum. The length field
+// delimits the frames, the framer resynchronises on the protocol id and length when the stream is out of sync.
+// Frames are normalised to the RTU layout (unit id, function, payload) without checksum.
+type mbapFramer struct {
+	buf       []byte
+	discarded int
+}
+
+func (f *mbapFramer) feed(data []byte) []frame {
+	f.buf = append(f.buf, data...)
+	return f.scan()
+}
+
+func (f *mbapFramer) flush() []frame {
+	frames := f.scan()
+	f.discarded += len(f.buf)
+	f.buf = f.buf[:0]
+	return frames
+}
+
+func (f *mbapFramer) dropped() int {
+	discarded := f.discarded
+	f.discarded = 0
+	return discarded
+}
+
+// MBAP frames have no checksum, TCP verifies the data
+func (f *mbapFramer) corrupt() int {
+	return 0
+}
+
+// Modbus TCP allows several requests in flight, the responses carry the transaction id of their request
+func (f *mbapFramer) transactions() bool {
+	return true
+}
+
+func (f *mbapFramer) encode(rtu []byte, transaction uint16) []byte {
+	return MBAP(transaction, rtu)
+}
+
+func (f *mbapFramer) scan() []frame {
+	var frames []frame
+	for len(f.buf) >= MBAP_HEADER_SIZE {
+		protocol := binary.BigEndian.Uint16(f.buf[2:4])
+		length := int(binary.BigEndian.Uint16(f.buf[4:6]))
+		if protocol != 0 || length < 2 || length > MBAP_MAX_LENGTH {
+			// Not the start of a frame, slide by one byte and try again
+			f.buf = f.buf[1:]
+			f.discarded++
+			continue
+		}
+		size := 6 + length
+		if len(f.buf) < size {
+			// Incomplete frame, kept until more data arrives
+			break
+		}
+		data := f.buf[6:size]
+		if request, ok := classify(data); ok {
+			frames = append(frames, frame{
+				data:        append([]byte(nil), data...),
+				request:     request,
+				transaction: binary.BigEndian.Uint16(f.buf[0:2]),
+			})
+		} else {
+			// A well formed frame of a function we do not decode
+			f.discarded += size
+		}
+		f.buf = f.buf[size:]
+	}
+	// Release the consumed part of the underlying array
+	f.buf = append([]byte(nil), f.buf...)
+	return frames
+}
+
+// Returns an RTU frame as the PDU of a Modbus TCP frame with transaction id
+func MBAP(transaction uint16, rtu []byte) []byte {
+	length := len(rtu) - 2
+	buf := make([]byte, 6, 6+length)
+	binary.BigEndian.PutUint16(buf[0:2], transaction)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(length))
+	return append(buf, rtu[:length]...)
+}
@@ -0,0 +1,114 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMBAP(t *testing.T) {
+	want := []byte{0x12, 0x34, 0x00, 0x00, 0x00, 0x06, 0x01, 0x03, 0x00, 0x00, 0x00, 0x0a}
+	if frame := MBAP(0x1234, readRequest10); !bytes.Equal(frame, want) {
+		t.Errorf("MBAP = % x, want % x", frame, want)
+	}
+}
+
+func TestMBAPFramer(t *testing.T) {
+	request := MBAP(7, readRequest2)
+	response := MBAP(7, readResponse2)
+	// A well formed frame of a function that is not decoded: read device identification
+	other := MBAP(8, rtu(0x01, 0x2b, 0x0e, 0x01, 0x00))
+	garbage := []byte{0x55, 0x00, 0x01}
+	tests := []struct {
+		name         string
+		chunks       [][]byte
+		frames       []expected
+		transactions []uint16
+		dropped      int
+	}{
+		{"request", [][]byte{request}, []expected{{readRequest2, true}}, []uint16{7}, 0},
+		{"split response", [][]byte{response[:4], response[4:9], response[9:]},
+			[]expected{{readResponse2, false}}, []uint16{7}, 0},
+		{"coalesced frames", [][]byte{concat(MBAP(1, readRequest2), MBAP(2, readRequest10), MBAP(1, readResponse2))},
+			[]expected{{readRequest2, true}, {readRequest10, true}, {readResponse2, false}}, []uint16{1, 2, 1}, 0},
+		{"garbage before a frame", [][]byte{concat(garbage, request)}, []expected{{readRequest2, true}},
+			[]uint16{7}, len(garbage)},
+		{"function not decoded", [][]byte{concat(other, request)}, []expected{{readRequest2, true}}, []uint16{7},
+			len(other)},
+		{"incomplete frame flushed", [][]byte{concat(request, response[:8])}, []expected{{readRequest2, true}},
+			[]uint16{7}, 8},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := framers[FRAMING_MBAP]()
+			var frames []frame
+			for _, chunk := range test.chunks {
+				frames = append(frames, f.feed(chunk)...)
+			}
+			frames = append(frames, f.flush()...)
+			checkFrames(t, frames, test.frames, true)
+			for i, frame := range frames {
+				if frame.transaction != test.transactions[i] {
+					t.Errorf("frame %d transaction %d, want %d", i, frame.transaction, test.transactions[i])
+				}
+			}
+			if dropped := f.dropped(); dropped != test.dropped {
+				t.Errorf("dropped %d bytes, want %d", dropped, test.dropped)
+			}
+		})
+	}
+}
+
+func TestTransactionPairing(t *testing.T) {
+	now := time.Now()
+	f := framers[FRAMING_MBAP]()
+	var p pairing
+	response10 := rtu(append([]byte{0x01, 0x03, 0x14}, make([]byte, 20)...)...)
+	// Two requests in flight, answered out of order, and a response to an unknown transaction
+	frames := f.feed(concat(MBAP(1, readRequest2), MBAP(2, readRequest10), MBAP(2, response10),
+		MBAP(1, readResponse2), MBAP(9, readResponse2)))
+	var quantities []uint16
+	var unpaired int
+	for _, frame := range frames {
+		if frame.request {
+			p.transactionRequest(frame.transaction, parseReadRequest(frame.data), now)
+			continue
+		}
+		if r, ok := p.transactionResponse(frame.transaction, frame.data, now); ok {
+			quantities = append(quantities, r.quantity)
+		} else {
+			unpaired++
+		}
+	}
+	if len(quantities) != 2 || quantities[0] != 10 || quantities[1] != 2 || unpaired != 1 {
+		t.Errorf("paired quantities %v, unpaired %d, want [10 2] and 1", quantities, unpaired)
+	}
+	if p.health.UnansweredRequests != 0 {
+		t.Errorf("bus health %s", &p)
+	}
+}
@@ -0,0 +1,144 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"heatpump/domain"
+	"heatpump/domain/vitocal"
+)
+
+// Counters of the frames decoded for a site, kept across its connections. Safe for concurrent use.
+type Counters struct {
+	frames    atomic.Uint64
+	resyncs   atomic.Uint64
+	discarded atomic.Uint64
+	crcErrors atomic.Uint64
+	unknown   atomic.Uint64
+}
+
+// Frames read from the stream
+func (c *Counters) Frames() uint64 {
+	return c.frames.Load()
+}
+
+// Times the framer lost the frame boundaries and discarded bytes to find the next frame. A resync is counted once
+// whatever the number of bytes and of corrupt frames discarded: frames failing the CRC, LRC or MBAP header checks,
+// partial frames and noise. The frames failing their checksum are also counted by CRCErrors.
+func (c *Counters) Resyncs() uint64 {
+	return c.resyncs.Load()
+}
+
+// Bytes discarded by the framer
+func (c *Counters) Discarded() uint64 {
+	return c.discarded.Load()
+}
+
+// Frames discarded because their CRC, or LRC in ASCII framing, failed while their address, function and length
+// matched. MBAP frames have no checksum.
+func (c *Counters) CRCErrors() uint64 {
+	return c.crcErrors.Load()
+}
+
+// Frames that could not be decoded by the register map: responses of other slaves, of unknown blocks or unpaired
+func (c *Counters) Unknown() uint64 {
+	return c.unknown.Load()
+}
+
+func (c *Counters) received(frames []frame, discarded int, corrupt int) {
+	c.frames.Add(uint64(len(frames)))
+	c.crcErrors.Add(uint64(corrupt))
+	if discarded > 0 {
+		c.resyncs.Add(1)
+		c.discarded.Add(uint64(discarded))
+	}
+}
+
+// Sink keeping the last snapshot and power state of each heatpump of a site and the last bus health, for the metrics
+// endpoint
+type Metrics struct {
+	mutex  sync.Mutex
+	slaves map[int]*SlaveMetrics
+	bus    *vitocal.Bus
+}
+
+// Last values of a heatpump
+type SlaveMetrics struct {
+	// Nil until the first snapshot
+	Vitocal *domain.Vitocal
+	Powered bool
+	Updated time.Time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{slaves: make(map[int]*SlaveMetrics)}
+}
+
+func (m *Metrics) Name() string {
+	return SINK_METRICS
+}
+
+func (m *Metrics) Write(e Event) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	switch e.Kind {
+	case KIND_SNAPSHOT:
+		slave := m.slave(e.Slave)
+		slave.Vitocal = e.Vitocal
+		slave.Updated = e.Time
+		m.bus = &e.Vitocal.Bus
+	case KIND_POWER:
+		slave := m.slave(e.Slave)
+		slave.Powered = e.Powered
+		slave.Updated = e.Time
+	case KIND_BUS:
+		m.bus = e.Bus
+	}
+	return nil
+}
+
+func (m *Metrics) slave(address int) *SlaveMetrics {
+	slave, ok := m.slaves[address]
+	if !ok {
+		slave = &SlaveMetrics{}
+		m.slaves[address] = slave
+	}
+	return slave
+}
+
+// Returns copies of the last values of the heatpumps by slave address, and the last bus health, nil until known
+func (m *Metrics) Snapshot() (map[int]SlaveMetrics, *vitocal.Bus) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	slaves := make(map[int]SlaveMetrics, len(m.slaves))
+	for address, slave := range m.slaves {
+		slaves[address] = *slave
+	}
+	return slaves, m.bus
+}
@@ -26,361 +26,115 @@
 package decoder
 
 import (
+	"context"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"net"
-	"os"
-	"os/exec"
+	"sync"
 	"time"
 
 	"heatpump/base"
 	"heatpump/domain"
-	"heatpump/mqtt"
 )
 
 const (
-	MODBUS_READ  uint8 = 0x03
-	ERRORS       uint8 = 0x08
-	TEMPERATURES uint8 = 0x04
-	STATES       uint8 = 0x02
-	MACHINE      uint8 = 0x01
-	COMPLETE     uint8 = 0x0F
+	MODBUS_READ           uint8 = 0x03
+	MODBUS_READ_INPUT     uint8 = 0x04
+	MODBUS_WRITE_SINGLE   uint8 = 0x06
+	MODBUS_WRITE_MULTIPLE uint8 = 0x10
+	// Set in the function code of exception responses
+	MODBUS_EXCEPTION uint8 = 0x80
+
+	// Without data for this long the heatpump is assumed to be powered off
+	READ_TIMEOUT = 15 * time.Second
 
 	OFF byte = 0x00
 	ON  byte = 0x01
 
-	//MACHINE
-	// byte 1
-	COMPRESSOR_OIL_HEATER byte = 0x80
-	// byte 2
-	COMPRESSOR_STARTING byte = 0x01
-	COMPRESSOR_RUNNING  byte = 0x04
-	COMPRESSOR_THRUST   byte = 0x08
-	CIRCULATION_PUMP_ON byte = 0x40
-	// byte 7 and 8
-	COMPRESSOR_ACTIVE        uint16 = 0x8000
-	CIRCULATION_PUMP_ACTIVE  uint16 = 0x0601
-	CIRCULATION_PUMP_VENTING uint16 = 0x0200
-
-	//STATUS
-	// byte 3
-	STATUS_STANDBY             byte = 0x02
-	STATUS_COMPRESSOR_REQUIRED byte = 0x10
-	STATUS_DEFROST_STARTING    byte = 0x30
-	STATUS_DEFROST_ACTIVE      byte = 0x50
-
-	// byte 4
-	VITOCAL_OFF       byte = 0x00
-	VITOCAL_AUTO_COOL byte = 0x01
-	VITOCAL_AUTO_HEAT byte = 0x02
-
-	// byte 7
-	HEAT        byte = 0x40
-	COOL        byte = 0x80
-	COOL_MANUAL byte = 0xc0
-
-	// BASE
-	VITOCAL_POWERED       string = "VitocalPowered"
-	VITOCAL_PUMP_ON       string = "VitocalPumpOn"
-	VITOCAL_STATUS_ON     string = "VitocalStatusOn"
-	VITOCAL_COMPRESSOR_ON string = "VitocalCompressorOn"
-	VITOCAL_MODE_COOL     string = "VitocalModeCool"
-	VITOCAL_DEFROST       string = "VitocalDefrost"
+	// BASE_SHM state files, prefixed by the model profile state file prefix
+	STATE_POWERED       string = "Powered"
+	STATE_PUMP_ON       string = "PumpOn"
+	STATE_STATUS_ON     string = "StatusOn"
+	STATE_COMPRESSOR_ON string = "CompressorOn"
+	STATE_MODE_COOL     string = "ModeCool"
+	STATE_DEFROST       string = "Defrost"
 )
 
-var (
-	vitocalPowered    uint8 = 0xFF
-	vitocalPump       uint8 = 0xFF
-	vitocalStatus     uint8 = 0xFF
-	vitocalCompressor uint8 = 0xFF
-	vitocalModeCool   uint8 = 0xFF
-	vitocalDefrost    uint8 = 0xFF
-)
-
-func Decode(c net.Conn) error {
-	defer c.Close()
-
-	var lastTime time.Time
-	var buf = []byte{}
-	var template uint8 = 0
-	var temperatures string
-	var states string
-	var machine string
-	var errors string
-	var raw_temperatures string
-	var vitocal domain.Vitocal
+// The register map of MODEL, or of the file set by REGISTER_MAP, loaded on first use
+var defaultRegisterMap struct {
+	once        sync.Once
+	registerMap *RegisterMap
+	err         error
+}
 
-	for {
-		buf = make([]byte, 256)
-		c.SetReadDeadline(time.Now().Add(15 * time.Second))
-		size, err := c.Read(buf)
+// Returns the register map of MODEL, or of the file set by REGISTER_MAP
+func DefaultRegisterMap() (*RegisterMap, error) {
+	defaultRegisterMap.once.Do(func() {
+		registerMap, err := LoadRegisterMap(base.Model.RegisterMap, base.RegisterMapFile)
 		if err != nil {
-			// If we have a connection, but there is no data stream then we assume that the heatpump is not powered
-			if os.IsTimeout(err) {
-				if vitocalPowered >= 1 {
-					cmd := exec.Command("/bin/rm", "-f", base.BaseSHM+VITOCAL_POWERED,
-						base.BaseSHM+VITOCAL_STATUS_ON, base.BaseSHM+VITOCAL_PUMP_ON, base.BaseSHM+VITOCAL_COMPRESSOR_ON,
-						base.BaseSHM+VITOCAL_MODE_COOL, base.BaseSHM+VITOCAL_DEFROST)
-					err := cmd.Run()
-					if err != nil {
-						log.Printf("error removing vitocal state files: %s\n", err)
-					} else {
-						vitocalPowered = OFF
-						vitocalStatus = OFF
-						vitocalCompressor = OFF
-						vitocalPump = OFF
-						vitocalModeCool = OFF
-					}
-				}
-				continue
-			}
-			if err != io.EOF {
-				log.Println("error reading MODBUS stream", err)
-				return err
-			}
+			err = fmt.Errorf("error loading register map: %w", err)
 		}
+		defaultRegisterMap.registerMap, defaultRegisterMap.err = registerMap, err
+	})
+	return defaultRegisterMap.registerMap, defaultRegisterMap.err
+}
 
-		// We can read the data stream therefore the heatpump is powered
-		vitocalPowered = setVitocalStateOn(vitocalPowered, VITOCAL_POWERED)
-
-		// Filter by known responses and CRC CHECK
-		// If the third byte (buf[2]) is equal record length less 5 then this is likely a response
-		if size > 2 && int(buf[2]) == (size-5) && int(buf[0]) == base.VitocalModbusAddr && uint8(buf[1]) == MODBUS_READ {
-			checksum := crc16(buf, size)
-			if checksum[0] != buf[size-2] || checksum[1] != buf[size-1] {
-				fmt.Println("CRC ERROR")
-				fmt.Println(size, buf[2], checksum, buf[size-2], buf[size-1], buf)
-				continue
-			}
-			//fmt.Println(size, buf[2], checksum, buf[size-2], buf[size-1], buf)
-
-			// TEMPERATURES and PRESSURES - Address 0x018f
-			if size == 105 && buf[2] == 100 && (template&TEMPERATURES) == 0 {
-				dataSize := int(buf[2])
-				value := getValues(buf, dataSize)
-				temperatureIn := float32(value[1]) / 10
-				temperatureOut := float32(value[2]) / 10
-				temperatureExt := float32(value[29]) / 10
-				ingressoComp := float32(value[23]) / 10
-				scaricoComp := float32(value[34]) / 10
-				suctionPressure := float32(value[15]) / 100
-				condensationPressure := float32(value[7]) / 100
-				vitocal.Temperatures.WaterIn = fmt.Sprintf("%.1f", float32(int16(value[1]))/10)
-				vitocal.Temperatures.WaterOut = fmt.Sprintf("%.1f", float32(int16(value[2]))/10)
-				vitocal.Temperatures.External = fmt.Sprintf("%.1f", float32(int16(value[29]))/10)
-				vitocal.Temperatures.CompressorIn = fmt.Sprintf("%.1f", float32(int16(value[23]))/10)
-				vitocal.Temperatures.CompressorOut = fmt.Sprintf("%.1f", float32(int16(value[34]))/10)
-				vitocal.PressureCondensation = int(value[7])
-				vitocal.PressureSuction = int(value[15])
-				temperatures = fmt.Sprintf("Temp: wtr_in=%.1f wtr_out=%.1f ext=%.1f cmp_in=%.1f cmp_out=%.1f - Press: suct=%.2f cond=%.2f",
-					temperatureIn, temperatureOut, temperatureExt, ingressoComp, scaricoComp,
-					suctionPressure, condensationPressure)
-
-				if base.RawLog {
-					raw_temperatures = ""
-					for i := 0; i < len(value)-2; i++ {
-						raw_temperatures = fmt.Sprintf("%s%04x ", raw_temperatures, value[i])
-					}
-				}
-				template |= TEMPERATURES
-			}
-
-			// STATES - Address 0x1c2e - Size 11
-			if size == 27 && buf[2] == 22 && (template&STATES) == 0 {
-				dataSize := int(buf[2])
-				value := getValues(buf, dataSize)
-				// if bit 2 = 0 standby otherwise on
-				if buf[3]&STATUS_STANDBY == 0 {
-					vitocal.Status = domain.ON
-					vitocalStatus = setVitocalStateOn(vitocalStatus, VITOCAL_STATUS_ON)
-				} else {
-					vitocal.Status = domain.OFF
-					vitocalStatus = setVitocalStateOff(vitocalStatus, VITOCAL_STATUS_ON)
-				}
-				if buf[3]&STATUS_COMPRESSOR_REQUIRED == STATUS_COMPRESSOR_REQUIRED {
-					vitocal.CompressorRequired = true
-					vitocalCompressor = setVitocalStateOn(vitocalCompressor, VITOCAL_COMPRESSOR_ON)
-				} else {
-					vitocal.CompressorRequired = false
-					vitocalCompressor = setVitocalStateOff(vitocalCompressor, VITOCAL_COMPRESSOR_ON)
-				}
-
-				// DEFROST
-				switch buf[3] {
-				case STATUS_DEFROST_STARTING:
-					vitocal.Defrost = domain.DEFROST_STARTING
-					vitocalModeCool = setVitocalStateOn(vitocalDefrost, VITOCAL_DEFROST)
-				case STATUS_DEFROST_ACTIVE:
-					vitocal.Defrost = domain.DEFROST_ACTIVE
-					vitocalModeCool = setVitocalStateOn(vitocalDefrost, VITOCAL_DEFROST)
-				default:
-					vitocal.Defrost = domain.DEFROST_INACTIVE
-					vitocalModeCool = setVitocalStateOff(vitocalDefrost, VITOCAL_DEFROST)
-				}
-				// ToDo CONTROL_MODE_HEAT and CONTROL_MODE_COOL have same value, need to manage difference in app
-				switch buf[4] {
-				case VITOCAL_OFF:
-					vitocal.ControlMode = domain.CONTROL_MODE_OFF
-				case VITOCAL_AUTO_COOL:
-					vitocal.ControlMode = domain.CONTROL_MODE_COOL
-				case VITOCAL_AUTO_HEAT:
-					vitocal.ControlMode = domain.CONTROL_MODE_HEAT
-				}
-				switch buf[7] {
-				case HEAT:
-					vitocal.Mode = domain.MODE_HEAT
-					vitocalModeCool = setVitocalStateOff(vitocalModeCool, VITOCAL_MODE_COOL)
-				case COOL:
-					vitocal.Mode = domain.MODE_COOL
-					vitocalModeCool = setVitocalStateOn(vitocalModeCool, VITOCAL_MODE_COOL)
-				}
-				vitocal.CompressorHz = int(value[5])
-				vitocal.FanSpeed = int(value[6])
-				vitocal.PumpSpeed = int(value[7])
-				vitocal.Hours = int(value[8])
-				states = fmt.Sprintf("%04x %04x %04x", value[0], value[1], value[2])
-				for i := 3; i < len(value)-2; i++ {
-					states = fmt.Sprintf("%s %5d ", states, value[i])
-				}
-				states = fmt.Sprintf("%s %04x %04x", states, value[9], value[10])
-				template |= STATES
-			}
-
-			// MACHINE - Address 0x01e0 - Size  3
-			if size == 11 && buf[2] == 6 && (template&MACHINE) == 0 {
-				dataSize := int(buf[2])
-				value := getValues(buf, dataSize)
-
-				if buf[3]&ON == 0 {
-					if vitocal.CompressorRequired {
-						if buf[4]&COMPRESSOR_STARTING == COMPRESSOR_STARTING {
-							vitocal.CompressorStatus = domain.STARTING2
-						} else {
-							vitocal.CompressorStatus = domain.STARTING
-						}
-					} else {
-						vitocal.CompressorStatus = domain.OFF
-					}
-				} else {
-					if buf[3]&OFF == 0 {
-						vitocal.CompressorStatus = domain.ON
-					}
-				}
-				if buf[3]&COMPRESSOR_OIL_HEATER == COMPRESSOR_OIL_HEATER {
-					vitocal.OilHeater = domain.ON
-				} else {
-					vitocal.OilHeater = domain.OFF
-				}
-				if buf[4]&COMPRESSOR_THRUST == COMPRESSOR_THRUST {
-					vitocal.CompressorThrust = domain.ON
-				} else {
-					vitocal.CompressorThrust = domain.OFF
-				}
-				if value[2]&CIRCULATION_PUMP_ACTIVE == CIRCULATION_PUMP_ACTIVE {
-					vitocal.PumpStatus = domain.ON
-					vitocalPump = setVitocalStateOn(vitocalPump, VITOCAL_PUMP_ON)
-				} else {
-					vitocal.PumpStatus = domain.OFF
-					vitocalPump = setVitocalStateOff(vitocalPump, VITOCAL_PUMP_ON)
-				}
-				for i := 0; i < len(value); i++ {
-					machine = fmt.Sprintf("%s %04x", machine, value[i])
-				}
-				template |= MACHINE
-			}
+// Source of the Modbus byte stream: a TCP connection to the gateway or a serial port
+type Conn interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
 
-			// ERRORS - Address 0x03ca - Size  5
-			if size == 15 && buf[2] == 10 && (template&ERRORS) == 0 {
-				dataSize := int(buf[2])
-				value := getValues(buf, dataSize)
-				for i := 0; i < len(value); i++ {
-					errors = fmt.Sprintf("%s %d", errors, value[i])
-				}
-				vitocal.Errors.Error1 = value[0]
-				vitocal.Errors.Error2 = value[1]
-				vitocal.Errors.Error3 = value[2]
-				vitocal.Errors.Error4 = value[3]
-				vitocal.Errors.Error5 = value[4]
-				template |= ERRORS
-			}
-		}
+// Decodes the Modbus byte stream of a site until it ends or the context is cancelled, hands the events to the sinks
+// of the site and counts the frames. The decoding state belongs to the call, several sites are decoded concurrently.
+func Decode(ctx context.Context, c Conn, site *base.Site, sinks *Dispatcher, counters *Counters) error {
+	defer c.Close()
 
-		// When all the records have been received, the TEMPLATE is complete, therefore we can send a message with
-		// the heatpump telemetry payload
-		if (template & COMPLETE) == COMPLETE {
-			vitocal.Timestamp = time.Now()
-			linearJSON, err := json.Marshal(vitocal)
-			if err != nil {
-				log.Fatal("failed to generate JSON")
-			} else {
-				// Throttle messages at different intervals when the heat pump is running or on stand by
-				// to contain real time network traffic destined to web and phone apps.
-				// Message throttling is disabled in case the payload contains errors.
-				var standbySeconds float64
-				if vitocal.Errors.Error1 != 0 || vitocal.Errors.Error2 != 0 || vitocal.Errors.Error3 != 0 ||
-					vitocal.Errors.Error4 != 0 || vitocal.Errors.Error5 != 0 {
-					// No throttling in case of errors
-					standbySeconds = 0
-				} else {
-					if vitocal.Status == domain.ON || vitocal.PumpStatus == domain.ON {
-						standbySeconds = base.RunningThrottleSeconds
-					} else {
-						standbySeconds = base.StandbyThrottleSeconds
-					}
-				}
-				// Throttle down to 1 message every standbySeconds
-				if vitocal.Timestamp.Sub(lastTime).Seconds() > standbySeconds {
-					log.Printf("%s - %s - %s -%s\n", machine, states, temperatures, errors)
-					if base.RawLog {
-						fmt.Printf("%s  %s\n", vitocal.Timestamp.Format("2006/01/02 15:04:05"), raw_temperatures)
-					}
-					err := mqtt.Publish(base.MqttTopic, true, string(linearJSON))
-					if err != nil {
-						log.Print("MQTT publish Error: ", err)
-					}
-					lastTime = vitocal.Timestamp
-				}
-			}
-			template = 0
-			machine = ""
-			states = ""
-			temperatures = ""
-			errors = ""
-		}
+	options := []Option{
+		WithSite(site),
+		WithHandler(sinks.Handle),
+		WithCounters(counters),
+	}
+	if base.Poll {
+		options = append(options, WithPolling(time.Duration(base.PollIntervalSeconds)*time.Second,
+			time.Duration(base.PollHoldoffSeconds)*time.Second))
+	}
+	d, err := New(options...)
+	if err != nil {
+		return err
 	}
-	return fmt.Errorf("modbus data stream reading interrupted")
+	return d.Run(ctx, c)
 }
 
-func setVitocalStateOn(state uint8, file string) uint8 {
-	if state == OFF || state == 0xFF {
-		_, err := os.Create(base.BaseSHM + file)
-		if err != nil {
-			fmt.Println("Error creating file: ", base.BaseSHM+file)
-			return state
-		} else {
-			return ON
+// Describes the active error codes found in the model profile error table
+func errorDescriptions(vitocal *domain.Vitocal) []string {
+	var descriptions []string
+	errors := vitocal.Errors
+	for _, code := range []uint16{errors.Error1, errors.Error2, errors.Error3, errors.Error4, errors.Error5} {
+		if code == 0 {
+			continue
+		}
+		if description, ok := base.Model.ErrorDescription(code); ok {
+			descriptions = append(descriptions, fmt.Sprintf("%d: %s", code, description))
 		}
-	} else {
-		return state
 	}
+	return descriptions
 }
 
-func setVitocalStateOff(state uint8, file string) uint8 {
-	if state == ON || state == 0xFF {
-		cmd := exec.Command("/bin/rm", "-f", base.BaseSHM+file)
-		err := cmd.Run()
-		if err != nil {
-			fmt.Printf("Error removing vitocal state file %s: %s\n", file, err)
-			return state
-		} else {
-			return OFF
+// Returns the register values of each block by block name, unused registers as nil
+func rawRegisters(registerMap *RegisterMap, registers [][]uint16) map[string][]*int {
+	raw := make(map[string][]*int)
+	for i, values := range registers {
+		block := make([]*int, len(values))
+		for j, value := range values {
+			if value != UNUSED_REGISTER {
+				v := int(value)
+				block[j] = &v
+			}
 		}
-	} else {
-		return state
+		raw[registerMap.Blocks[i].Name] = block
 	}
+	return raw
 }
 
 func getValues(buf []byte, size int) []uint16 {
@@ -0,0 +1,177 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// Run decodes the stream in four stages connected by bounded channels, so that a slow stage does not stall the
+// others: the reader drains the socket or serial port, the framer splits the stream into frames and detects the
+// silences, the decoder pairs and decodes the frames, the publisher hands the events to the handlers. While the
+// publisher waits for a slow MQTT broker the reader keeps receiving and the frames queue up in the channels, a frame
+// is only lost when all the buffers are full.
+const (
+	// Chunks read and batches of frames buffered between the stages
+	PIPELINE_BUFFER = 1024
+	// Events buffered for the publisher
+	PUBLISH_BUFFER = 256
+	// Size of the reads
+	READ_SIZE = 256
+	// The reader checks for the cancellation at least this often on streams with read deadlines
+	READ_CHECK_INTERVAL = time.Second
+)
+
+// Data read from the stream at a time, err ends the stream
+type chunk struct {
+	data []byte
+	time time.Time
+	err  error
+	// The stream has switched to another source before data
+	switched bool
+}
+
+// A stream read from several sources in turn, such as Failover: at each switch the stream restarts at an arbitrary
+// byte of the other source
+type switchingReader interface {
+	switches() uint64
+}
+
+// Frames split from a chunk, or flushed from the stream after a silence on the bus
+type batch struct {
+	frames []frame
+	// Bytes the framer discarded, and frames among them that failed their checksum
+	dropped int
+	corrupt int
+	time    time.Time
+	// Data was received, the chunk may not contain a complete frame
+	data    bool
+	silence bool
+	err     error
+	// The stream has switched to another source, the frames are those of the new source
+	switched bool
+}
+
+// Reader stage: reads the stream until it ends, fails or the context is cancelled. The read deadlines of the streams
+// that have them let the reader notice the cancellation, other readers are interrupted by closing them.
+func read(ctx context.Context, r io.Reader, chunks chan<- chunk) {
+	defer close(chunks)
+	deadlines, _ := r.(interface{ SetReadDeadline(t time.Time) error })
+	sources, _ := r.(switchingReader)
+	var switches uint64
+	if sources != nil {
+		switches = sources.switches()
+	}
+	for ctx.Err() == nil {
+		if deadlines != nil {
+			deadlines.SetReadDeadline(time.Now().Add(READ_CHECK_INTERVAL))
+		}
+		buf := make([]byte, READ_SIZE)
+		size, err := r.Read(buf)
+		if err != nil && os.IsTimeout(err) {
+			err = nil
+		}
+		if size == 0 && err == nil {
+			continue
+		}
+		c := chunk{data: buf[:size], time: time.Now(), err: err}
+		if sources != nil && sources.switches() != switches {
+			switches = sources.switches()
+			c.switched = true
+		}
+		select {
+		case chunks <- c:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Framer stage: splits the chunks into frames. Without data for READ_TIMEOUT, and again every READ_TIMEOUT while
+// the bus stays silent, the frames left in the stream are flushed as a silence.
+func frames(ctx context.Context, stream framer, chunks <-chan chunk, batches chan<- batch) {
+	defer close(batches)
+	silence := time.Now().Add(READ_TIMEOUT)
+	timer := time.NewTimer(READ_TIMEOUT)
+	defer timer.Stop()
+	for {
+		var b batch
+		select {
+		case c, ok := <-chunks:
+			if !ok {
+				return
+			}
+			b = batch{time: c.time, err: c.err, switched: c.switched}
+			if c.switched {
+				// The partial frame of the previous source would be completed with bytes of the new one
+				stream.flush()
+				stream.dropped()
+				stream.corrupt()
+			}
+			if len(c.data) > 0 {
+				b.frames = stream.feed(c.data)
+				b.dropped = stream.dropped()
+				b.corrupt = stream.corrupt()
+				b.data = true
+				silence = c.time.Add(READ_TIMEOUT)
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(time.Until(silence))
+			}
+		case <-timer.C:
+			b = batch{frames: stream.flush(), dropped: stream.dropped(), corrupt: stream.corrupt(), time: silence,
+				silence: true}
+			silence = silence.Add(READ_TIMEOUT)
+			timer.Reset(time.Until(silence))
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case batches <- b:
+		case <-ctx.Done():
+			return
+		}
+		if b.err != nil {
+			return
+		}
+	}
+}
+
+// Publisher stage: hands the events to the handlers, in the order they were decoded, until the channel is closed
+func (d *Decoder) publish(events <-chan Event) {
+	for e := range events {
+		for _, handler := range d.handlers {
+			handler(e)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"heatpump/base"
+	"heatpump/decoder"
+)
+
+const (
+	// A request/response cycle of the four blocks every period, a frame every 2.5ms
+	BENCHMARK_PERIOD = 20 * time.Millisecond
+	// Time taken by the slow sink to write an event, it falls behind the bus
+	BENCHMARK_SINK_DELAY  = 15 * time.Millisecond
+	BENCHMARK_SINK_BUFFER = 16
+	// An outage of the broker stalls the first write for several bus periods, then the writes fail until the client
+	// has reconnected
+	BENCHMARK_STALL    = 10 * BENCHMARK_PERIOD
+	BENCHMARK_FAILURES = 20
+)
+
+// Stands in for a slow MQTT broker. With failures, the broker is lost at the first write: the write stalls for stall
+// before failing, as does the publication of a client whose connection has dropped, and the next writes fail at once
+// until failures writes have failed.
+type slowSink struct {
+	delay    time.Duration
+	stall    time.Duration
+	failures int
+	mutex    sync.Mutex
+	// Events written and failed by kind
+	written, failed map[string]int
+}
+
+func (s *slowSink) Name() string {
+	return "broker"
+}
+
+func (s *slowSink) Write(e decoder.Event) error {
+	s.mutex.Lock()
+	if s.failures > 0 {
+		s.failures--
+		s.failed[e.Kind]++
+		stall := s.stall
+		s.stall = 0
+		s.mutex.Unlock()
+		time.Sleep(stall)
+		return errors.New("not connected")
+	}
+	s.mutex.Unlock()
+	time.Sleep(s.delay)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.written[e.Kind]++
+	return nil
+}
+
+// Writes the frames to conn at the pace of the bus. A frame that cannot be written before the next cycle is lost, as
+// it would be by a gateway.
+func playBus(conn net.Conn, frames []busFrame) (lost int) {
+	start := time.Now()
+	for _, frame := range frames {
+		time.Sleep(time.Until(start.Add(frame.elapsed)))
+		conn.SetWriteDeadline(start.Add(frame.elapsed + BENCHMARK_PERIOD))
+		if _, err := conn.Write(frame.data); err != nil {
+			if !os.IsTimeout(err) {
+				break
+			}
+			lost++
+		}
+	}
+	return lost
+}
+
+// Decodes b.N cycles of the bus read from a TCP connection in real time, with a sink slower than the bus, and with a
+// sink whose broker is lost and reconnected. Every snapshot on the bus is decoded whatever the policy: the events the
+// sink is too slow for wait in the pipeline with the block policy and are dropped from the sink buffer with the drop
+// policy, and counted, as are the events the sink fails to write.
+func BenchmarkPipeline(b *testing.B) {
+	for _, policy := range []string{decoder.SINK_BLOCK, decoder.SINK_DROP} {
+		b.Run(policy, func(b *testing.B) {
+			benchmarkPipeline(b, policy, 0)
+		})
+		b.Run(policy+"_outage", func(b *testing.B) {
+			benchmarkPipeline(b, policy, BENCHMARK_FAILURES)
+		})
+	}
+}
+
+func benchmarkPipeline(b *testing.B, policy string, failures int) {
+	frames := scenarioFrames(b, fmt.Sprintf("set status=on compressor=running water_out=38\nrun %s",
+		time.Duration(b.N)*BENCHMARK_PERIOD), BENCHMARK_PERIOD, []byte{1})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	gateway, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	logger := log.New(io.Discard, "", 0)
+	sink := &slowSink{delay: BENCHMARK_SINK_DELAY, stall: BENCHMARK_STALL, failures: failures,
+		written: make(map[string]int), failed: make(map[string]int)}
+	sinks := decoder.NewDispatcher(logger)
+	sinks.Add(sink, BENCHMARK_SINK_BUFFER, policy)
+	site := &base.Site{Name: "benchmark", ModbusFraming: decoder.FRAMING_RTU, ModbusAddrs: []int{1}}
+	decoded := make(map[string]int)
+	var events int
+	d, err := decoder.New(decoder.WithSite(site), decoder.WithLogger(logger), decoder.WithThrottle(0, 0),
+		decoder.WithHandler(func(e decoder.Event) {
+			decoded[e.Kind]++
+			events++
+		}), decoder.WithHandler(sinks.Handle))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	played := make(chan int)
+	go func() {
+		lost := playBus(gateway, frames)
+		gateway.Close()
+		played <- lost
+	}()
+	err = d.Run(context.Background(), conn)
+	lost := <-played
+	b.StopTimer()
+	sinks.Close()
+
+	if err != io.EOF {
+		b.Fatalf("Run returned %v, want io.EOF", err)
+	}
+	if lost > 0 {
+		b.Errorf("%d frames not written in time", lost)
+	}
+	if decoded[decoder.KIND_SNAPSHOT] != b.N {
+		b.Errorf("%d snapshots decoded, want %d", decoded[decoder.KIND_SNAPSHOT], b.N)
+	}
+	stats := sinks.Stats()[0]
+	delivered, failed := 0, 0
+	for _, count := range sink.written {
+		delivered += count
+	}
+	for _, count := range sink.failed {
+		failed += count
+	}
+	if delivered != stats.Written || failed != stats.Errors || delivered+failed+stats.Dropped != events {
+		b.Errorf("%d events decoded, %d delivered, %d failed and %d dropped", events, delivered, failed, stats.Dropped)
+	}
+	if delivered > 0 && failed != failures {
+		b.Errorf("%d writes failed before the broker was reconnected, want %d", failed, failures)
+	}
+	if policy == decoder.SINK_BLOCK &&
+		(stats.Dropped > 0 || sink.written[decoder.KIND_SNAPSHOT]+sink.failed[decoder.KIND_SNAPSHOT] != b.N) {
+		b.Errorf("block policy: %d snapshots delivered and %d failed of %d, %d events dropped",
+			sink.written[decoder.KIND_SNAPSHOT], sink.failed[decoder.KIND_SNAPSHOT], b.N, stats.Dropped)
+	}
+	b.ReportMetric(float64(events)/float64(b.N), "events/op")
+	b.ReportMetric(float64(stats.Dropped)/float64(b.N), "dropped/op")
+	b.ReportMetric(float64(failed)/float64(b.N), "failed/op")
+}
@@ -0,0 +1,193 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// The poller only transmits after the bus has been quiet for this long
+	POLL_QUIET = 100 * time.Millisecond
+	// Time allowed to the heatpump to answer a request before the next one is sent
+	POLL_RESPONSE_TIMEOUT = time.Second
+)
+
+// Function codes the poller is allowed to transmit. Reads only: whatever happens, the poller must never be able to
+// change the heatpump configuration.
+var pollAllowlist = map[byte]bool{
+	MODBUS_READ: true,
+}
+
+// Without a Remote Touch Controller nobody queries the heatpump. In polling mode the service acts as the MODBUS master
+// and reads the register map blocks of each slave itself. The poller yields the bus to any other master: as soon as a
+// request it did not send is seen on the bus, polling is suspended for the hold off time.
+type poller struct {
+	log         *log.Logger
+	w           io.Writer
+	registerMap *RegisterMap
+	slaves      []byte
+	interval    time.Duration
+	holdoff     time.Duration
+
+	// Next cycle through the register map blocks of every slave, and the next read in the current cycle: block
+	// read % blocks of slave read / blocks
+	cycle time.Time
+	read  int
+	// Request waiting for its response
+	waiting     *readRequest
+	echoed      bool
+	sent        time.Time
+	transaction uint16
+
+	lastData time.Time
+	// Last request seen from another master
+	foreign   time.Time
+	suspended bool
+}
+
+// The first cycle starts after listening to the bus for READ_TIMEOUT, so that a master already present is detected
+// before anything is transmitted
+func newPoller(logger *log.Logger, w io.Writer, registerMap *RegisterMap, slaves []byte, interval time.Duration,
+	holdoff time.Duration, now time.Time) *poller {
+	return &poller{
+		log:         logger,
+		w:           w,
+		registerMap: registerMap,
+		slaves:      slaves,
+		interval:    interval,
+		holdoff:     holdoff,
+		cycle:       now.Add(READ_TIMEOUT),
+		read:        len(slaves) * len(registerMap.Blocks),
+	}
+}
+
+// Number of reads in a cycle
+func (p *poller) reads() int {
+	return len(p.slaves) * len(p.registerMap.Blocks)
+}
+
+// Returns the time at which the poller has something to do
+func (p *poller) wake() time.Time {
+	if p.suspended {
+		return p.foreign.Add(p.holdoff)
+	}
+	if p.waiting != nil {
+		return p.sent.Add(POLL_RESPONSE_TIMEOUT)
+	}
+	if p.read < p.reads() {
+		return p.lastData.Add(POLL_QUIET)
+	}
+	return p.cycle
+}
+
+// Called whenever data is received
+func (p *poller) received(now time.Time) {
+	p.lastData = now
+}
+
+// Called for each request frame on the bus, returns true when the request is the echo of the poller's own request
+func (p *poller) request(buf []byte, now time.Time) bool {
+	if buf[1] == MODBUS_READ && p.waiting != nil && !p.echoed && *p.waiting == parseReadRequest(buf) &&
+		now.Sub(p.sent) < POLL_RESPONSE_TIMEOUT {
+		p.echoed = true
+		return true
+	}
+	p.foreign = now
+	if !p.suspended {
+		p.log.Printf("MODBUS function %d request from another master slave=%d address=%04x, polling suspended\n",
+			buf[1], buf[0], binary.BigEndian.Uint16(buf[2:4]))
+		p.suspended = true
+		p.waiting = nil
+	}
+	return false
+}
+
+// Called for each response frame on the bus
+func (p *poller) response() {
+	p.waiting = nil
+}
+
+// Sends the next request when it is time to, returns the request sent and its transaction id
+func (p *poller) poll(stream framer, now time.Time) (*readRequest, uint16, error) {
+	if p.suspended {
+		if now.Sub(p.foreign) < p.holdoff {
+			return nil, 0, nil
+		}
+		p.log.Printf("MODBUS no other master for %s, polling resumed\n", p.holdoff)
+		p.suspended = false
+		p.cycle = now
+		p.read = p.reads()
+	}
+	if p.waiting != nil {
+		if now.Sub(p.sent) < POLL_RESPONSE_TIMEOUT {
+			return nil, 0, nil
+		}
+		// No response, move on to the next block
+		p.waiting = nil
+	}
+	if p.read >= p.reads() {
+		if now.Before(p.cycle) {
+			return nil, 0, nil
+		}
+		p.read = 0
+		p.cycle = p.cycle.Add(p.interval)
+		if p.cycle.Before(now) {
+			p.cycle = now.Add(p.interval)
+		}
+	}
+	if now.Sub(p.lastData) < POLL_QUIET {
+		return nil, 0, nil
+	}
+
+	slave := p.slaves[p.read/len(p.registerMap.Blocks)]
+	block := p.registerMap.Blocks[p.read%len(p.registerMap.Blocks)]
+	request := ReadRequest(slave, uint16(block.Address), block.Registers)
+	p.transaction++
+	if err := p.send(stream, request, p.transaction); err != nil {
+		return nil, 0, err
+	}
+	r := parseReadRequest(request)
+	p.waiting = &r
+	p.echoed = false
+	p.sent = now
+	p.read++
+	return &r, p.transaction, nil
+}
+
+// The only way the poller writes to the bus: frames with a function code outside the allowlist are refused. The
+// frame is encoded for the stream here, after the check, so that what is written is always the frame checked.
+func (p *poller) send(stream framer, rtu []byte, transaction uint16) error {
+	if !pollAllowlist[rtu[1]] {
+		return fmt.Errorf("MODBUS function %02x is not allowed in polling mode", rtu[1])
+	}
+	_, err := p.w.Write(stream.encode(rtu, transaction))
+	return err
+}
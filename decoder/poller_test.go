@@ -0,0 +1,204 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"heatpump/base"
+)
+
+// Keeps each write of the poller
+type busWriter struct {
+	writes [][]byte
+}
+
+func (w *busWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (w *busWriter) take() [][]byte {
+	writes := w.writes
+	w.writes = nil
+	return writes
+}
+
+// The heatpumps polled by a session: the requests written are framed as the gateway reads them and answered with
+// zeros while answer is set, the time moves on by steps of 10 ms
+type pollBus struct {
+	s       *session
+	w       *busWriter
+	gateway framer
+	now     time.Time
+	answer  bool
+}
+
+func newPollBus(framing string, slaves []byte, interval time.Duration, holdoff time.Duration,
+	emit func(Event)) *pollBus {
+	registerMap, _ := DefaultRegisterMap()
+	var addrs []int
+	for _, slave := range slaves {
+		addrs = append(addrs, int(slave))
+	}
+	site := &base.Site{Name: "test", ModbusFraming: framing, ModbusAddrs: addrs}
+	b := &pollBus{w: &busWriter{}, gateway: framers[framing](), now: time.Unix(1700000000, 0), answer: true}
+	b.s = newSession(site, registerMap, log.New(io.Discard, "", 0), emit)
+	b.s.poll = newPoller(b.s.log, b.w, registerMap, slaves, interval, holdoff, b.now)
+	return b
+}
+
+// Moves the time on to until and returns the requests written meanwhile
+func (b *pollBus) run(t *testing.T, until time.Time) []frame {
+	t.Helper()
+	var requests []frame
+	for ; !b.now.After(until); b.now = b.now.Add(10 * time.Millisecond) {
+		if err := b.s.tick(b.now); err != nil {
+			t.Fatal(err)
+		}
+		for _, write := range b.w.take() {
+			frames := b.gateway.feed(write)
+			if len(frames) != 1 || b.gateway.dropped() > 0 {
+				t.Fatalf("write %x is not a frame", write)
+			}
+			f := frames[0]
+			requests = append(requests, f)
+			if b.answer && f.data[1] == MODBUS_READ {
+				values := make([]uint16, binary.BigEndian.Uint16(f.data[4:6]))
+				b.s.feed(b.gateway.encode(ReadResponse(f.data[0], values), f.transaction), b.now)
+			}
+		}
+	}
+	return requests
+}
+
+// Whatever the caller asks, send only writes the functions of the allowlist
+func TestPollerSendAllowlist(t *testing.T) {
+	for _, framing := range Framings() {
+		w := &busWriter{}
+		p := &poller{w: w}
+		stream := framers[framing]()
+		for _, request := range [][]byte{
+			rtu(0x01, MODBUS_WRITE_SINGLE, 0x1c, 0x2e, 0x00, 0x01),
+			rtu(0x01, MODBUS_WRITE_MULTIPLE, 0x1c, 0x2e, 0x00, 0x01, 0x02, 0x00, 0x01),
+			rtu(0x01, MODBUS_READ_INPUT, 0x00, 0x00, 0x00, 0x01),
+		} {
+			if err := p.send(stream, request, 1); err == nil {
+				t.Errorf("%s: function %02x sent", framing, request[1])
+			}
+		}
+		if len(w.writes) > 0 {
+			t.Errorf("%s: refused frames written: %x", framing, w.writes)
+		}
+		read := ReadRequest(1, 0x0100, 4)
+		if err := p.send(stream, read, 7); err != nil {
+			t.Errorf("%s: read refused: %s", framing, err)
+		}
+		if len(w.writes) != 1 || string(w.writes[0]) != string(stream.encode(read, 7)) {
+			t.Errorf("%s: read written as %x", framing, w.writes)
+		}
+	}
+}
+
+// In polling mode the connection only carries function 3 reads of the register map blocks of the slaves
+func TestPollingReadsOnly(t *testing.T) {
+	slaves := []byte{1, 2}
+	for _, framing := range Framings() {
+		t.Run(framing, func(t *testing.T) {
+			snapshots := 0
+			b := newPollBus(framing, slaves, time.Minute, time.Minute, func(e Event) {
+				if e.Kind == KIND_SNAPSHOT {
+					snapshots++
+				}
+			})
+			blocks := b.s.registerMap.Blocks
+			// Cycles at 15 s, 75 s and 135 s
+			requests := b.run(t, b.now.Add(150*time.Second))
+
+			reads := make(map[[3]uint16]int)
+			for _, f := range requests {
+				if !f.request || f.data[1] != MODBUS_READ {
+					t.Fatalf("frame %x written", f.data)
+				}
+				reads[[3]uint16{uint16(f.data[0]), binary.BigEndian.Uint16(f.data[2:4]),
+					binary.BigEndian.Uint16(f.data[4:6])}]++
+			}
+			if len(requests) != 3*len(slaves)*len(blocks) {
+				t.Errorf("%d requests, want %d", len(requests), 3*len(slaves)*len(blocks))
+			}
+			for _, slave := range slaves {
+				for _, block := range blocks {
+					read := [3]uint16{uint16(slave), uint16(block.Address), block.Registers}
+					if reads[read] != 3 {
+						t.Errorf("block %s of slave %d read %d times, want 3", block.Name, slave, reads[read])
+					}
+				}
+			}
+			if snapshots != 3*len(slaves) {
+				t.Errorf("%d snapshots, want %d", snapshots, 3*len(slaves))
+			}
+		})
+	}
+}
+
+// A request of a Remote Touch Controller suspends polling for the hold off time, from its last request
+func TestPollingBackoff(t *testing.T) {
+	const holdoff = 30 * time.Second
+	b := newPollBus(FRAMING_RTU, []byte{1}, 10*time.Second, holdoff, func(Event) {})
+	start := b.now
+	if requests := b.run(t, start.Add(20*time.Second)); len(requests) == 0 {
+		t.Fatal("nothing polled")
+	}
+	block := b.s.registerMap.Blocks[0]
+
+	// The controller reads while the poller waits for its response
+	b.answer = false
+	if requests := b.run(t, start.Add(25*time.Second)); len(requests) != 1 {
+		t.Fatalf("%d requests, want the one left unanswered", len(requests))
+	}
+	b.answer = true
+	controller := func() {
+		b.s.feed(ReadRequest(1, uint16(block.Address)+1, 1), b.now)
+		b.s.feed(ReadResponse(1, []uint16{0}), b.now)
+	}
+	controller()
+	if requests := b.run(t, b.now.Add(holdoff/2)); len(requests) > 0 {
+		t.Fatalf("%d requests while the controller is active", len(requests))
+	}
+	controller()
+	last := b.now
+	if requests := b.run(t, last.Add(holdoff-10*time.Millisecond)); len(requests) > 0 {
+		t.Fatalf("%d requests within the hold off time of the last controller request", len(requests))
+	}
+	requests := b.run(t, last.Add(holdoff+time.Second))
+	if len(requests) == 0 || requests[0].data[1] != MODBUS_READ {
+		t.Fatalf("polling not resumed after the hold off time: %d requests", len(requests))
+	}
+}
@@ -0,0 +1,105 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"heatpump/base"
+)
+
+// A recorded Modbus byte stream, Next returns the data in the order it was received with its capture time,
+// and io.EOF at the end of the recording
+type Recording interface {
+	Next() (time.Time, []byte, error)
+}
+
+// Decodes a recording and writes the JSON snapshots to w, one per line, timestamped with the capture time instead
+// of the current time. A gap longer than READ_TIMEOUT in the recording is handled as a silence on the bus.
+// The BASE_SHM state files are left untouched.
+func DecodeRecording(r Recording, w io.Writer) error {
+	registerMap, err := DefaultRegisterMap()
+	if err == nil {
+		err = CheckSite(base.DefaultSite)
+	}
+	if err != nil {
+		return err
+	}
+	logger := base.DefaultSite.Logger()
+	s := newSession(base.DefaultSite, registerMap, logger, func(e Event) {
+		if e.Kind != KIND_TELEMETRY {
+			return
+		}
+		logger.Println(e.Summary)
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s\n", e.Payload)
+		}
+	})
+	if e := feedRecording(r, s, &err); e != nil {
+		return e
+	}
+	return err
+}
+
+// Tracks the registers of the blocks read in a recording, nothing is published
+func DiscoverRecording(r Recording, discovery *Discovery) error {
+	registerMap, err := DefaultRegisterMap()
+	if err == nil {
+		err = CheckSite(base.DefaultSite)
+	}
+	if err != nil {
+		return err
+	}
+	s := newSession(base.DefaultSite, registerMap, base.DefaultSite.Logger(), func(e Event) {})
+	s.discovery = discovery
+	discovery.registerMap = registerMap
+	return feedRecording(r, s, &err)
+}
+
+// Feeds the recording to the session until its end or until the session fails with publishErr
+func feedRecording(r Recording, s *session, publishErr *error) error {
+	var last time.Time
+	for *publishErr == nil {
+		now, data, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !last.IsZero() && now.Sub(last) > READ_TIMEOUT {
+			s.silence(last.Add(READ_TIMEOUT))
+		}
+		s.feed(data, now)
+		last = now
+	}
+	if *publishErr == nil {
+		s.silence(last)
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"heatpump/base"
+	"heatpump/domain"
+)
+
+// The register map describes how the register blocks read by the Remote Touch Controller are decoded into
+// domain.Vitocal. Fields are addressed by their JSON path, e.g. "temperatures.water_in", and their value is taken
+// from a register of the block, optionally masked, shifted, signed and scaled, or translated through an enum.
+//
+// Enum cases are evaluated in order, the first match sets the field. A case matches when the register value, masked
+// by the case mask or else the field mask, equals the case value. A case without "equals" always matches, a case
+// with "when" only matches if the named boolean field is true. If no case matches, the field keeps its value.
+
+//go:embed maps/*.json
+var registerMaps embed.FS
+
+type RegisterMap struct {
+	Name   string  `json:"name"`
+	Blocks []Block `json:"blocks"`
+}
+
+type Block struct {
+	Name      string  `json:"name"`
+	Address   Hex     `json:"address"`
+	Registers uint16  `json:"registers"`
+	Fields    []Field `json:"fields"`
+}
+
+type Field struct {
+	Target   string  `json:"target"`
+	Register int     `json:"register"`
+	Mask     Hex     `json:"mask"`
+	Shift    uint    `json:"shift"`
+	Signed   bool    `json:"signed"`
+	Scale    float64 `json:"scale"`
+	Format   string  `json:"format"`
+	Enum     []Case  `json:"enum"`
+
+	index []int
+	cases []enumCase
+}
+
+type Case struct {
+	When   string          `json:"when"`
+	Mask   *Hex            `json:"mask"`
+	Equals *Hex            `json:"equals"`
+	Value  json.RawMessage `json:"value"`
+}
+
+// A register value, either a number or a hexadecimal string such as "0x018f"
+type Hex uint16
+
+func (h *Hex) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		text = string(data)
+	}
+	value, err := strconv.ParseUint(text, 0, 16)
+	if err != nil {
+		return fmt.Errorf("invalid register value %s", data)
+	}
+	*h = Hex(value)
+	return nil
+}
+
+type enumCase struct {
+	when   []int
+	mask   uint16
+	equals *uint16
+	value  reflect.Value
+}
+
+// Loads the register map from file, or the built-in map with the given name when the file name is empty
+func LoadRegisterMap(name string, file string) (*RegisterMap, error) {
+	var data []byte
+	var err error
+	if len(file) > 0 {
+		data, err = os.ReadFile(file)
+	} else {
+		data, err = registerMaps.ReadFile("maps/" + name + ".json")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseRegisterMap(data)
+}
+
+func ParseRegisterMap(data []byte) (*RegisterMap, error) {
+	var registerMap RegisterMap
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&registerMap); err != nil {
+		return nil, fmt.Errorf("register map: %w", err)
+	}
+	if err := registerMap.validate(); err != nil {
+		return nil, fmt.Errorf("register map %s: %w", registerMap.Name, err)
+	}
+	return &registerMap, nil
+}
+
+// Returns the block read by a request, nil if the request is not in the map
+func (m *RegisterMap) block(request readRequest) (int, *Block) {
+	for i := range m.Blocks {
+		if request.function == MODBUS_READ && uint16(m.Blocks[i].Address) == request.start &&
+			m.Blocks[i].Registers == request.quantity {
+			return i, &m.Blocks[i]
+		}
+	}
+	return -1, nil
+}
+
+// Returns the fields decoded from the register at address
+func (m *RegisterMap) targets(address uint16) []string {
+	var targets []string
+	for _, block := range m.Blocks {
+		if address < uint16(block.Address) || int(address) >= int(block.Address)+int(block.Registers) {
+			continue
+		}
+		for _, field := range block.Fields {
+			if field.Register == int(address-uint16(block.Address)) {
+				targets = append(targets, field.Target)
+			}
+		}
+	}
+	return targets
+}
+
+// Template bits set when all the blocks have been decoded
+func (m *RegisterMap) complete() uint64 {
+	return uint64(1)<<len(m.Blocks) - 1
+}
+
+func (m *RegisterMap) validate() error {
+	if len(m.Blocks) == 0 {
+		return fmt.Errorf("no blocks defined")
+	}
+	if len(m.Blocks) > 64 {
+		return fmt.Errorf("too many blocks: %d", len(m.Blocks))
+	}
+	vitocal := reflect.TypeOf(domain.Vitocal{})
+	for i := range m.Blocks {
+		b := &m.Blocks[i]
+		if b.Registers == 0 || b.Registers > 125 {
+			return fmt.Errorf("block %s: invalid number of registers %d", b.Name, b.Registers)
+		}
+		for j := range m.Blocks[:i] {
+			if m.Blocks[j].Address == b.Address && m.Blocks[j].Registers == b.Registers {
+				return fmt.Errorf("block %s: duplicate of block %s", b.Name, m.Blocks[j].Name)
+			}
+		}
+		for k := range b.Fields {
+			f := &b.Fields[k]
+			if err := f.validate(vitocal, b); err != nil {
+				return fmt.Errorf("block %s: field %s: %w", b.Name, f.Target, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (f *Field) validate(vitocal reflect.Type, b *Block) error {
+	var err error
+	var kind reflect.Type
+	f.index, kind, err = lookup(vitocal, f.Target)
+	if err != nil {
+		return err
+	}
+	if f.Register < 0 || f.Register >= int(b.Registers) {
+		return fmt.Errorf("register %d out of block", f.Register)
+	}
+	if f.Shift > 15 {
+		return fmt.Errorf("invalid shift %d", f.Shift)
+	}
+	if f.Mask == 0 {
+		f.Mask = 0xFFFF
+	}
+	if len(f.Enum) == 0 {
+		switch kind.Kind() {
+		case reflect.String:
+			if len(f.Format) == 0 {
+				f.Format = "%g"
+			}
+		case reflect.Int, reflect.Uint16, reflect.Float32, reflect.Float64, reflect.Bool:
+		default:
+			return fmt.Errorf("unsupported field type %s", kind)
+		}
+		return nil
+	}
+	f.cases = nil
+	for _, c := range f.Enum {
+		ec := enumCase{mask: uint16(f.Mask)}
+		if len(c.When) > 0 {
+			var whenType reflect.Type
+			ec.when, whenType, err = lookup(vitocal, c.When)
+			if err != nil {
+				return err
+			}
+			if whenType.Kind() != reflect.Bool {
+				return fmt.Errorf("enum condition %s is not a boolean", c.When)
+			}
+		}
+		if c.Mask != nil {
+			ec.mask = uint16(*c.Mask)
+		}
+		if c.Equals != nil {
+			equals := uint16(*c.Equals)
+			ec.equals = &equals
+		}
+		value := reflect.New(kind)
+		if err := json.Unmarshal(c.Value, value.Interface()); err != nil {
+			return fmt.Errorf("invalid enum value %s: %w", c.Value, err)
+		}
+		ec.value = value.Elem()
+		f.cases = append(f.cases, ec)
+	}
+	return nil
+}
+
+// Finds the struct field with the given JSON path
+func lookup(t reflect.Type, target string) ([]int, reflect.Type, error) {
+	var index []int
+	for _, name := range strings.Split(target, ".") {
+		if t.Kind() != reflect.Struct {
+			return nil, nil, fmt.Errorf("unknown target %s", target)
+		}
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if tag == name {
+				index = append(index, i)
+				t = t.Field(i).Type
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nil, fmt.Errorf("unknown target %s", target)
+		}
+	}
+	return index, t, nil
+}
+
+// Decodes the register values of the block into vitocal
+func (b *Block) decode(values []uint16, vitocal *domain.Vitocal) {
+	v := reflect.ValueOf(vitocal).Elem()
+	for i := range b.Fields {
+		f := &b.Fields[i]
+		raw := values[f.Register]
+		target := v.FieldByIndex(f.index)
+		if len(f.cases) > 0 {
+			for _, c := range f.cases {
+				if c.when != nil && !v.FieldByIndex(c.when).Bool() {
+					continue
+				}
+				if c.equals != nil && raw&c.mask != *c.equals {
+					continue
+				}
+				target.Set(c.value)
+				break
+			}
+			continue
+		}
+		raw = (raw & uint16(f.Mask)) >> f.Shift
+		value := float64(raw)
+		if f.Signed {
+			value = float64(int16(raw))
+		}
+		if f.Scale != 0 {
+			value = value / f.Scale
+		}
+		switch target.Kind() {
+		case reflect.String:
+			target.SetString(fmt.Sprintf(f.Format, value))
+		case reflect.Int:
+			target.SetInt(int64(value))
+		case reflect.Uint16:
+			target.SetUint(uint64(value))
+		case reflect.Float32, reflect.Float64:
+			target.SetFloat(value)
+		case reflect.Bool:
+			target.SetBool(value != 0)
+		}
+	}
+}
+
+// Returns the decoded fields of the block for logging, status values are labelled as defined by the model profile
+func (b *Block) summary(vitocal *domain.Vitocal) string {
+	v := reflect.ValueOf(vitocal).Elem()
+	summary := b.Name + ":"
+	for i := range b.Fields {
+		target := b.Fields[i].Target
+		name := target[strings.LastIndex(target, ".")+1:]
+		value := base.Model.Label(target, v.FieldByIndex(b.Fields[i].index).Interface())
+		summary = fmt.Sprintf("%s %s=%s", summary, name, value)
+	}
+	return summary
+}
@@ -0,0 +1,186 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"heatpump/domain"
+)
+
+// The hand written decoding of the Vitocal 100-A blocks that the register map replaced, kept as the reference the
+// built-in map must reproduce. buf holds the response bytes: slave, function, size then the registers.
+func legacyDecode(block string, buf []byte, vitocal *domain.Vitocal) {
+	value := getValues(buf, int(buf[2]))
+	switch block {
+	case "temperatures":
+		vitocal.Temperatures.WaterIn = fmt.Sprintf("%.1f", float32(int16(value[1]))/10)
+		vitocal.Temperatures.WaterOut = fmt.Sprintf("%.1f", float32(int16(value[2]))/10)
+		vitocal.Temperatures.External = fmt.Sprintf("%.1f", float32(int16(value[29]))/10)
+		vitocal.Temperatures.CompressorIn = fmt.Sprintf("%.1f", float32(int16(value[23]))/10)
+		vitocal.Temperatures.CompressorOut = fmt.Sprintf("%.1f", float32(int16(value[34]))/10)
+		vitocal.PressureCondensation = int(value[7])
+		vitocal.PressureSuction = int(value[15])
+	case "states":
+		if buf[3]&0x02 == 0 {
+			vitocal.Status = domain.ON
+		} else {
+			vitocal.Status = domain.OFF
+		}
+		vitocal.CompressorRequired = buf[3]&0x10 == 0x10
+		switch buf[3] {
+		case 0x30:
+			vitocal.Defrost = domain.DEFROST_STARTING
+		case 0x50:
+			vitocal.Defrost = domain.DEFROST_ACTIVE
+		default:
+			vitocal.Defrost = domain.DEFROST_INACTIVE
+		}
+		switch buf[4] {
+		case 0x00:
+			vitocal.ControlMode = domain.CONTROL_MODE_OFF
+		case 0x01:
+			vitocal.ControlMode = domain.CONTROL_MODE_COOL
+		case 0x02:
+			vitocal.ControlMode = domain.CONTROL_MODE_HEAT
+		}
+		switch buf[7] {
+		case 0x40:
+			vitocal.Mode = domain.MODE_HEAT
+		case 0x80:
+			vitocal.Mode = domain.MODE_COOL
+		}
+		vitocal.CompressorHz = int(value[5])
+		vitocal.FanSpeed = int(value[6])
+		vitocal.PumpSpeed = int(value[7])
+		vitocal.Hours = int(value[8])
+	case "machine":
+		if buf[3]&0x01 == 0 {
+			if vitocal.CompressorRequired {
+				if buf[4]&0x01 == 0x01 {
+					vitocal.CompressorStatus = domain.STARTING2
+				} else {
+					vitocal.CompressorStatus = domain.STARTING
+				}
+			} else {
+				vitocal.CompressorStatus = domain.OFF
+			}
+		} else {
+			vitocal.CompressorStatus = domain.ON
+		}
+		if buf[3]&0x80 == 0x80 {
+			vitocal.OilHeater = domain.ON
+		} else {
+			vitocal.OilHeater = domain.OFF
+		}
+		if buf[4]&0x08 == 0x08 {
+			vitocal.CompressorThrust = domain.ON
+		} else {
+			vitocal.CompressorThrust = domain.OFF
+		}
+		if value[2]&0x0601 == 0x0601 {
+			vitocal.PumpStatus = domain.ON
+		} else {
+			vitocal.PumpStatus = domain.OFF
+		}
+	case "errors":
+		vitocal.Errors.Error1 = value[0]
+		vitocal.Errors.Error2 = value[1]
+		vitocal.Errors.Error3 = value[2]
+		vitocal.Errors.Error4 = value[3]
+		vitocal.Errors.Error5 = value[4]
+	}
+}
+
+// Returns the response bytes of a read returning values
+func response(values []uint16) []byte {
+	buf := []byte{0x01, MODBUS_READ, byte(2 * len(values))}
+	for _, value := range values {
+		buf = append(buf, byte(value>>8), byte(value))
+	}
+	return buf
+}
+
+// Register values of a cycle, the unset registers are 0
+type cycle map[string]map[int]uint16
+
+func TestRegisterMapMatchesLegacyDecoding(t *testing.T) {
+	registerMap, err := LoadRegisterMap("vitocal100a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := map[string]*Block{}
+	for i := range registerMap.Blocks {
+		blocks[registerMap.Blocks[i].Name] = &registerMap.Blocks[i]
+	}
+
+	cycles := []cycle{
+		{"temperatures": {1: 352, 2: 0xffce, 7: 1820, 15: 712, 23: 0xff9c, 29: 0x8000, 34: 681}},
+		{"errors": {0: 1, 1: 0, 2: 45, 3: 0xffff, 4: 7}},
+		{"states": {5: 48, 6: 650, 7: 80, 8: 12345, 9: 0x7ffe, 10: 0x7ffe}},
+	}
+	// Every combination of the status, defrost, control mode and mode bytes with every machine word: the compressor
+	// status depends on compressor required decoded from the states block of the same cycle
+	for _, status := range []uint16{0x00, 0x02, 0x10, 0x12, 0x30, 0x32, 0x50, 0x52, 0x70, 0xff} {
+		for _, control := range []uint16{0x00, 0x01, 0x02, 0x03} {
+			for _, mode := range []uint16{0x00, 0x40, 0x80, 0xc0} {
+				for _, machine := range []uint16{0x0000, 0x0001, 0x0008, 0x0009, 0x0100, 0x0101, 0x8000, 0x8109, 0xfeff} {
+					for _, pump := range []uint16{0x0000, 0x0200, 0x0600, 0x0601, 0x0641, 0xffff} {
+						cycles = append(cycles, cycle{
+							"states":  {0: status<<8 | control, 2: mode << 8},
+							"machine": {0: machine, 2: pump},
+						})
+					}
+				}
+			}
+		}
+	}
+
+	for _, c := range cycles {
+		var got, want domain.Vitocal
+		for _, name := range []string{"temperatures", "errors", "states", "machine"} {
+			registers, ok := c[name]
+			if !ok {
+				continue
+			}
+			block := blocks[name]
+			if block == nil {
+				t.Fatalf("block %s is not in the map", name)
+			}
+			values := make([]uint16, block.Registers)
+			for register, value := range registers {
+				values[register] = value
+			}
+			block.decode(values, &got)
+			legacyDecode(name, response(values), &want)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("cycle %v\ngot  %+v\nwant %+v", c, got, want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain/vitocal"
+)
+
+const (
+	// Consecutive requests without a valid response after which the bus is in fault
+	BUS_FAULT_REQUESTS int = 3
+	// Modbus TCP requests not answered within this time are unanswered
+	RESPONSE_TIMEOUT = 3 * time.Second
+)
+
+// A function 3 (read holding registers) or function 4 (read input registers) request sent by the master
+type readRequest struct {
+	slave    byte
+	function byte
+	start    uint16
+	quantity uint16
+}
+
+func parseReadRequest(buf []byte) readRequest {
+	return readRequest{
+		slave:    buf[0],
+		function: buf[1],
+		start:    binary.BigEndian.Uint16(buf[2:4]),
+		quantity: binary.BigEndian.Uint16(buf[4:6]),
+	}
+}
+
+// Modbus RTU is strictly sequential: the master sends a request and waits for the reply before sending the next one,
+// therefore a response is paired with the request that precedes it. Modbus TCP allows several requests in flight,
+// a response is paired with the request that has the same transaction id.
+//
+// The outcome of each transaction is recorded in the bus health: after BUS_FAULT_REQUESTS consecutive requests
+// without a valid response the bus is in fault, which tells a communication fault apart from a heatpump that is
+// powered off and leaves the bus silent.
+type pairing struct {
+	pending  *readRequest
+	inFlight map[uint16]inFlightRequest
+
+	health vitocal.Bus
+	// Consecutive requests without a valid response
+	failures int
+	// The health state has changed since the last call to stateChanged
+	changed bool
+}
+
+func (p *pairing) request(r readRequest, now time.Time) {
+	if p.pending != nil {
+		p.unanswered(*p.pending, now)
+	}
+	p.pending = &r
+}
+
+// Returns the request answered by the response, false if the response cannot be paired
+func (p *pairing) response(buf []byte, now time.Time) (readRequest, bool) {
+	if p.pending == nil {
+		p.unpaired(buf, now)
+		return readRequest{}, false
+	}
+	r := *p.pending
+	p.pending = nil
+	return p.match(r, buf, now)
+}
+
+// A request waiting for the response with the same transaction id
+type inFlightRequest struct {
+	readRequest
+	sent time.Time
+}
+
+func (p *pairing) transactionRequest(transaction uint16, r readRequest, now time.Time) {
+	if p.inFlight == nil {
+		p.inFlight = make(map[uint16]inFlightRequest)
+	}
+	// Without a response by now the request will not be answered
+	for t, previous := range p.inFlight {
+		if t == transaction || now.Sub(previous.sent) > RESPONSE_TIMEOUT {
+			p.unanswered(previous.readRequest, now)
+			delete(p.inFlight, t)
+		}
+	}
+	p.inFlight[transaction] = inFlightRequest{readRequest: r, sent: now}
+}
+
+// Returns the request with the same transaction id as the response, false if the response cannot be paired
+func (p *pairing) transactionResponse(transaction uint16, buf []byte, now time.Time) (readRequest, bool) {
+	r, ok := p.inFlight[transaction]
+	if !ok {
+		p.unpaired(buf, now)
+		return readRequest{}, false
+	}
+	delete(p.inFlight, transaction)
+	return p.match(r.readRequest, buf, now)
+}
+
+// Checks that the response matches the slave, the function and the quantity of the request
+func (p *pairing) match(r readRequest, buf []byte, now time.Time) (readRequest, bool) {
+	if r.slave != buf[0] || r.function != buf[1] || int(r.quantity)*2 != int(buf[2]) {
+		p.unanswered(r, now)
+		p.unpaired(buf, now)
+		return readRequest{}, false
+	}
+	p.failures = 0
+	p.state(vitocal.BUS_OK, now)
+	return r, true
+}
+
+// Records an exception response. An exception to a read request ends the transaction of the request.
+func (p *pairing) exception(f frame, transactions bool, now time.Time) {
+	buf := f.data
+	function := buf[1] &^ MODBUS_EXCEPTION
+	if reading(function) {
+		if transactions {
+			delete(p.inFlight, f.transaction)
+		} else {
+			p.pending = nil
+		}
+	}
+	code := int(buf[2])
+	var e *vitocal.Exception
+	for i := range p.health.Exceptions {
+		if p.health.Exceptions[i].Function == int(function) && p.health.Exceptions[i].Code == code {
+			e = &p.health.Exceptions[i]
+		}
+	}
+	if e == nil {
+		p.health.Exceptions = append(p.health.Exceptions, vitocal.Exception{
+			Function:    int(function),
+			Code:        code,
+			Description: exceptionDescription(buf[2]),
+		})
+		e = &p.health.Exceptions[len(p.health.Exceptions)-1]
+	}
+	e.Count++
+	e.Last = now
+	if base.RawLog {
+		fmt.Printf("exception response slave=%d function=%d code=%d %s\n", buf[0], function, code, e.Description)
+	}
+	p.fault(vitocal.BUS_EXCEPTION, now)
+}
+
+// A silence on the bus ends any transaction in progress
+func (p *pairing) silence(now time.Time) {
+	if p.pending != nil {
+		p.unanswered(*p.pending, now)
+		p.pending = nil
+	}
+	for transaction, r := range p.inFlight {
+		p.unanswered(r.readRequest, now)
+		delete(p.inFlight, transaction)
+	}
+	if p.health.State != vitocal.BUS_SILENT {
+		p.health.Silences++
+		p.health.LastSilence = &now
+		p.failures = 0
+		p.state(vitocal.BUS_SILENT, now)
+	}
+}
+
+// Forgets the requests in progress without counting them as unanswered: their responses were on the bus but not in
+// the stream
+func (p *pairing) reset() {
+	p.pending = nil
+	for transaction := range p.inFlight {
+		delete(p.inFlight, transaction)
+	}
+}
+
+// Returns a copy of the bus health
+func (p *pairing) snapshot() vitocal.Bus {
+	health := p.health
+	health.Exceptions = append([]vitocal.Exception(nil), p.health.Exceptions...)
+	return health
+}
+
+// Reports whether the bus state has changed since the last call
+func (p *pairing) stateChanged() bool {
+	changed := p.changed
+	p.changed = false
+	return changed
+}
+
+func (p *pairing) String() string {
+	return fmt.Sprintf("unpaired responses=%d unanswered requests=%d", p.health.UnpairedResponses,
+		p.health.UnansweredRequests)
+}
+
+func (p *pairing) unanswered(r readRequest, now time.Time) {
+	p.health.UnansweredRequests++
+	p.health.LastUnanswered = &now
+	p.health.LastUnansweredRequest = fmt.Sprintf("slave=%d address=0x%04x quantity=%d", r.slave, r.start, r.quantity)
+	if base.RawLog {
+		fmt.Printf("no response to request slave=%d address=%04x quantity=%d\n", r.slave, r.start, r.quantity)
+	}
+	p.fault(vitocal.BUS_NO_RESPONSE, now)
+}
+
+func (p *pairing) unpaired(buf []byte, now time.Time) {
+	p.health.UnpairedResponses++
+	p.health.LastUnpaired = &now
+	if base.RawLog {
+		fmt.Printf("unpaired response slave=%d size=%d\n", buf[0], buf[2])
+	}
+}
+
+func (p *pairing) fault(state string, now time.Time) {
+	p.failures++
+	if p.failures >= BUS_FAULT_REQUESTS {
+		p.state(state, now)
+	}
+}
+
+func (p *pairing) state(state string, now time.Time) {
+	if p.health.State != state {
+		p.health.State = state
+		p.health.Since = now
+		p.changed = true
+	}
+}
+
+// Describes a MODBUS exception code
+func exceptionDescription(code byte) string {
+	switch code {
+	case 0x01:
+		return "illegal function"
+	case 0x02:
+		return "illegal data address"
+	case 0x03:
+		return "illegal data value"
+	case 0x04:
+		return "slave device failure"
+	case 0x05:
+		return "acknowledge"
+	case 0x06:
+		return "slave device busy"
+	case 0x08:
+		return "memory parity error"
+	case 0x0a:
+		return "gateway path unavailable"
+	case 0x0b:
+		return "gateway target device failed to respond"
+	}
+	return "unknown exception"
+}
+
+// Returns a function 3 read request frame
+func ReadRequest(slave byte, start uint16, quantity uint16) []byte {
+	buf := []byte{slave, MODBUS_READ, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(buf[2:4], start)
+	binary.BigEndian.PutUint16(buf[4:6], quantity)
+	return setChecksum(buf)
+}
+
+// Returns a function 3 read response frame holding the register values
+func ReadResponse(slave byte, values []uint16) []byte {
+	buf := []byte{slave, MODBUS_READ, byte(len(values) * 2)}
+	for _, value := range values {
+		buf = binary.BigEndian.AppendUint16(buf, value)
+	}
+	return setChecksum(append(buf, 0, 0))
+}
+
+// Returns an exception response frame to a request of the function
+func ExceptionResponse(slave byte, function byte, code byte) []byte {
+	return setChecksum([]byte{slave, function | MODBUS_EXCEPTION, code, 0, 0})
+}
+
+// Sets the checksum in the last two bytes of the frame
+func setChecksum(buf []byte) []byte {
+	checksum := crc16(buf, len(buf))
+	buf[len(buf)-2] = checksum[0]
+	buf[len(buf)-1] = checksum[1]
+	return buf
+}
@@ -0,0 +1,371 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"heatpump/base"
+	"heatpump/domain"
+)
+
+// Decoding state of a Modbus byte stream: the stream is split into frames, the responses are paired with their
+// requests and decoded into the template of the heatpump they come from, a snapshot of the heatpump is emitted when
+// its template is complete.
+type session struct {
+	site        *base.Site
+	log         *log.Logger
+	registerMap *RegisterMap
+	devices     []*device
+
+	stream      framer
+	pairs       pairing
+	audit       audit
+	diagnostics diagnostics
+	// Polling master, nil unless polling is enabled
+	poll *poller
+	// Register discovery, nil unless discovering
+	discovery *Discovery
+
+	// Telemetry throttling in seconds when the heatpump is running or on stand by
+	runningThrottle, standbyThrottle float64
+	// Adds the raw register values to the telemetry
+	raw bool
+	// Receives the decoded events
+	emit func(Event)
+	// Frame counters of the site
+	counters *Counters
+}
+
+func newSession(site *base.Site, registerMap *RegisterMap, logger *log.Logger, emit func(Event)) *session {
+	s := &session{
+		site:            site,
+		log:             logger,
+		registerMap:     registerMap,
+		devices:         newDevices(site, len(registerMap.Blocks)),
+		stream:          framers[site.ModbusFraming](),
+		runningThrottle: base.RunningThrottleSeconds,
+		standbyThrottle: base.StandbyThrottleSeconds,
+		raw:             base.RawRegisters,
+		emit:            emit,
+		counters:        &Counters{},
+	}
+	s.audit.registerMap = registerMap
+	s.diagnostics.log = logger
+	return s
+}
+
+// Returns the device of a slave address, nil if the slave is not monitored
+func (s *session) device(slave byte) *device {
+	for _, d := range s.devices {
+		if d.slave == slave {
+			return d
+		}
+	}
+	return nil
+}
+
+// Decodes data received at time now
+func (s *session) feed(data []byte, now time.Time) {
+	frames := s.stream.feed(data)
+	s.received(frames, s.stream.dropped(), s.stream.corrupt(), now)
+}
+
+// Called when no data has been received for READ_TIMEOUT
+func (s *session) silence(now time.Time) {
+	// The bus is silent, whatever is left in the stream can only be a complete frame or noise
+	frames := s.stream.flush()
+	s.quiet(frames, s.stream.dropped(), s.stream.corrupt(), now)
+}
+
+// Decodes the frames split from data received at time now, discarded is the number of bytes the framer dropped and
+// corrupt the number of frames among them that failed their checksum
+func (s *session) received(frames []frame, discarded int, corrupt int, now time.Time) {
+	if s.poll != nil {
+		s.poll.received(now)
+	}
+	s.counters.received(frames, discarded, corrupt)
+	s.process(frames, discarded, now)
+	// The bus is alive, a heatpump that has stopped answering is powered off
+	for _, d := range s.devices {
+		if now.Sub(d.lastResponse) >= READ_TIMEOUT {
+			s.power(d, false, now)
+		}
+	}
+	s.busState(now)
+	s.unrecognised(now)
+}
+
+// The stream has switched to another source, the responses to the requests in progress may have been received by the
+// previous source only
+func (s *session) switched() {
+	s.pairs.reset()
+	s.audit.silence()
+}
+
+// Decodes the frames flushed from the stream after a silence on the bus
+func (s *session) quiet(frames []frame, discarded int, corrupt int, now time.Time) {
+	for _, d := range s.devices {
+		s.power(d, false, now)
+	}
+	s.counters.received(frames, discarded, corrupt)
+	s.process(frames, discarded, now)
+	s.pairs.silence(now)
+	s.audit.silence()
+	s.busState(now)
+	s.unrecognised(now)
+}
+
+func (s *session) process(frames []frame, discarded int, now time.Time) {
+	if discarded > 0 && base.RawLog {
+		fmt.Printf("MODBUS stream out of sync, discarded %d bytes\n", discarded)
+	}
+
+	for _, f := range frames {
+		buf := f.data
+		if buf[1]&MODBUS_EXCEPTION != 0 {
+			s.exception(f, now)
+			continue
+		}
+		if !reading(buf[1]) {
+			s.write(f, now)
+			continue
+		}
+		if f.request {
+			if s.poll != nil && s.poll.request(buf, now) {
+				// Echo of the poller's own request, already paired when it was sent
+				continue
+			}
+			if s.stream.transactions() {
+				s.pairs.transactionRequest(f.transaction, parseReadRequest(buf), now)
+			} else {
+				s.pairs.request(parseReadRequest(buf), now)
+			}
+			continue
+		}
+		// Responses are identified by the start address of the request they answer,
+		// the framer has already verified the frame
+		if s.poll != nil {
+			s.poll.response()
+		}
+		var request readRequest
+		var paired bool
+		if s.stream.transactions() {
+			request, paired = s.pairs.transactionResponse(f.transaction, buf, now)
+		} else {
+			request, paired = s.pairs.response(buf, now)
+		}
+		if paired {
+			value := getValues(buf, int(buf[2]))
+			if request.function == MODBUS_READ {
+				// Writes address the holding registers
+				s.audit.read(request, value)
+			}
+			if s.discovery != nil {
+				s.discovery.read(request, value, now)
+			}
+			i, block := s.registerMap.block(request)
+			if d := s.device(request.slave); d != nil && block != nil {
+				s.decode(d, i, block, value, now)
+			} else {
+				s.counters.unknown.Add(1)
+				s.diagnostics.unrecognised(request, true, value, now)
+			}
+		} else {
+			// The start address of an unpaired response is unknown
+			s.counters.unknown.Add(1)
+			s.diagnostics.unrecognised(readRequest{slave: buf[0], function: buf[1], quantity: uint16(buf[2] / 2)},
+				false, getValues(buf, int(buf[2])), now)
+		}
+	}
+}
+
+// Decodes the i-th block of the register map into the template of the device
+func (s *session) decode(d *device, i int, block *Block, value []uint16, now time.Time) {
+	d.lastResponse = now
+	// The heatpump answers therefore it is powered
+	s.power(d, true, now)
+	if d.template&(1<<i) == 0 {
+		block.decode(value, &d.vitocal)
+		if s.discovery != nil {
+			s.discovery.state(d.slave, &d.vitocal, now)
+		}
+		d.summaries[i] = block.summary(&d.vitocal)
+		if s.raw {
+			d.registers[i] = value
+		}
+		if base.RawLog {
+			d.rawValues[i] = ""
+			for j := 0; j < len(value); j++ {
+				d.rawValues[i] = fmt.Sprintf("%s%04x ", d.rawValues[i], value[j])
+			}
+		}
+		d.template |= 1 << i
+	}
+
+	// When all the records have been received, the TEMPLATE is complete, therefore we can send a message with
+	// the heatpump telemetry payload
+	if d.template == s.registerMap.complete() {
+		s.complete(d, now)
+		d.template = 0
+	}
+}
+
+// Emits a power event when the heatpump starts or stops answering
+func (s *session) power(d *device, on bool, now time.Time) {
+	state := OFF
+	if on {
+		state = ON
+	}
+	if d.powered == state {
+		return
+	}
+	d.powered = state
+	s.emit(Event{Kind: KIND_POWER, Time: now, Slave: int(d.slave), Powered: on})
+}
+
+// Records an exception response, which ends the transaction of the request it answers
+func (s *session) exception(f frame, now time.Time) {
+	if s.poll != nil {
+		s.poll.response()
+	}
+	s.pairs.exception(f, s.stream.transactions(), now)
+	if !reading(f.data[1] &^ MODBUS_EXCEPTION) {
+		s.audit.rejected(f)
+	}
+}
+
+// Logs and emits the bus health when its state changes
+func (s *session) busState(now time.Time) {
+	if !s.pairs.stateChanged() {
+		return
+	}
+	bus := s.pairs.snapshot()
+	s.log.Printf("MODBUS bus state: %s, %s\n", bus.State, &s.pairs)
+	payload, err := json.Marshal(&bus)
+	if err != nil {
+		log.Fatal("failed to generate JSON")
+	}
+	s.emit(Event{Kind: KIND_BUS, Time: now, Topic: s.site.BusTopic, Payload: payload, Bus: &bus})
+}
+
+// Logs and emits the statistics of the unrecognised frames when they are due
+func (s *session) unrecognised(now time.Time) {
+	if !s.diagnostics.due(now) {
+		return
+	}
+	s.log.Printf("MODBUS unrecognised frames: %s\n", &s.diagnostics)
+	diagnostics := s.diagnostics.snapshot(now)
+	payload, err := json.Marshal(&diagnostics)
+	if err != nil {
+		log.Fatal("failed to generate JSON")
+	}
+	s.emit(Event{Kind: KIND_DIAGNOSTICS, Time: now, Topic: s.site.DiagnosticsTopic, Payload: payload,
+		Diagnostics: &diagnostics})
+}
+
+// Audits the register writes
+func (s *session) write(f frame, now time.Time) {
+	if f.request && s.poll != nil {
+		s.poll.request(f.data, now)
+	}
+	for _, write := range s.audit.frame(f, now) {
+		write := write
+		payload, err := json.Marshal(&write)
+		if err != nil {
+			log.Fatal("failed to generate JSON")
+		}
+		s.emit(Event{Kind: KIND_WRITE, Time: now, Slave: write.Slave, Topic: s.site.AuditTopic, Payload: payload,
+			Write: &write})
+	}
+}
+
+// Lets the poller send its next request, which is paired as if it had been read from the bus
+func (s *session) tick(now time.Time) error {
+	if s.poll == nil {
+		return nil
+	}
+	r, transaction, err := s.poll.poll(s.stream, now)
+	if err != nil || r == nil {
+		return err
+	}
+	if s.stream.transactions() {
+		s.pairs.transactionRequest(transaction, *r, now)
+	} else {
+		s.pairs.request(*r, now)
+	}
+	return nil
+}
+
+func (s *session) complete(d *device, now time.Time) {
+	vitocal := &d.vitocal
+	vitocal.Errors.Descriptions = errorDescriptions(vitocal)
+	vitocal.Bus = s.pairs.snapshot()
+	if s.raw {
+		vitocal.Raw = rawRegisters(s.registerMap, d.registers)
+	}
+	vitocal.Timestamp = now
+	snapshot := *vitocal
+	s.emit(Event{Kind: KIND_SNAPSHOT, Time: now, Slave: int(d.slave), Vitocal: &snapshot})
+	linearJSON, err := json.Marshal(vitocal)
+	if err != nil {
+		log.Fatal("failed to generate JSON")
+	}
+	// Throttle messages at different intervals when the heat pump is running or on stand by
+	// to contain real time network traffic destined to web and phone apps.
+	// Message throttling is disabled in case the payload contains errors.
+	var standbySeconds float64
+	if vitocal.Errors.Error1 != 0 || vitocal.Errors.Error2 != 0 || vitocal.Errors.Error3 != 0 ||
+		vitocal.Errors.Error4 != 0 || vitocal.Errors.Error5 != 0 {
+		// No throttling in case of errors
+		standbySeconds = 0
+	} else {
+		if vitocal.Status == domain.ON || vitocal.PumpStatus == domain.ON {
+			standbySeconds = s.runningThrottle
+		} else {
+			standbySeconds = s.standbyThrottle
+		}
+	}
+	// Throttle down to 1 message every standbySeconds
+	if vitocal.Timestamp.Sub(d.lastTime).Seconds() > standbySeconds {
+		s.emit(Event{Kind: KIND_TELEMETRY, Time: now, Slave: int(d.slave), Topic: d.topic, Payload: linearJSON,
+			Vitocal: &snapshot, Summary: d.logPrefix() + strings.Join(d.summaries, " - ")})
+		if s.pairs.health.UnpairedResponses > 0 || s.pairs.health.UnansweredRequests > 0 {
+			s.log.Printf("MODBUS %s\n", &s.pairs)
+		}
+		if base.RawLog {
+			for i := range d.rawValues {
+				fmt.Printf("%s  %s%s %s\n", vitocal.Timestamp.Format("2006/01/02 15:04:05"), d.logPrefix(),
+					s.registerMap.Blocks[i].Name, d.rawValues[i])
+			}
+		}
+		d.lastTime = vitocal.Timestamp
+	}
+}
@@ -0,0 +1,212 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// Policies when the buffer of a sink is full: drop the new event, or wait for the sink
+	SINK_DROP  string = "drop"
+	SINK_BLOCK string = "block"
+
+	// Time given to the sinks to write the queued events when the dispatcher is closed
+	SINK_CLOSE_TIMEOUT = 5 * time.Second
+	// Errors and drops of a sink are logged at most once per interval
+	SINK_LOG_INTERVAL = time.Minute
+)
+
+// A destination of the decoded events: MQTT, files, HTTP services, databases. A sink that buffers events implements
+// io.Closer as well, Close is called after the queued events when the dispatcher is closed.
+type Sink interface {
+	// Name of the sink in the logs and statistics
+	Name() string
+	// Writes an event, called by a single goroutine in the order of the events
+	Write(e Event) error
+}
+
+// Statistics of a sink since the dispatcher started
+type SinkStats struct {
+	Name          string     `json:"name"`
+	Policy        string     `json:"policy"`
+	Buffer        int        `json:"buffer"`
+	Queued        int        `json:"queued"`
+	Written       int        `json:"written"`
+	Dropped       int        `json:"dropped"`
+	Errors        int        `json:"errors"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// Dispatcher fans the events out to its sinks. Each sink has its own buffer and goroutine, so that a slow or failing
+// sink does not delay the others nor the decoding: with the drop policy the events that do not fit in the buffer
+// of the sink are dropped and counted, with the block policy the decoding waits for the sink. Handle is the event
+// handler to pass to the Decoder. Events handled after Close are discarded.
+type Dispatcher struct {
+	log *log.Logger
+	// Held for reading while events are queued, for writing while the sinks are added or closed
+	mutex   sync.RWMutex
+	outputs []*output
+	closed  bool
+}
+
+type output struct {
+	sink   Sink
+	policy string
+	events chan Event
+	done   chan struct{}
+
+	mutex sync.Mutex
+	stats SinkStats
+	// Last log of the drops and of the errors
+	droppedLogged, errorLogged time.Time
+}
+
+func NewDispatcher(logger *log.Logger) *Dispatcher {
+	return &Dispatcher{log: logger}
+}
+
+// Adds a sink with a buffer of events and the policy when the buffer is full, before the first event
+func (d *Dispatcher) Add(sink Sink, buffer int, policy string) {
+	o := &output{
+		sink:   sink,
+		policy: policy,
+		events: make(chan Event, buffer),
+		done:   make(chan struct{}),
+		stats:  SinkStats{Name: sink.Name(), Policy: policy, Buffer: buffer},
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.outputs = append(d.outputs, o)
+	go d.run(o)
+}
+
+// Queues the event to every sink
+func (d *Dispatcher) Handle(e Event) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, o := range d.outputs {
+		if o.policy == SINK_BLOCK {
+			o.events <- e
+			continue
+		}
+		select {
+		case o.events <- e:
+		default:
+			o.mutex.Lock()
+			o.stats.Dropped++
+			dropped := o.stats.Dropped
+			due := logDue(&o.droppedLogged, time.Now())
+			o.mutex.Unlock()
+			if due {
+				d.log.Printf("sink %s: buffer full, %d events dropped\n", o.stats.Name, dropped)
+			}
+		}
+	}
+}
+
+// Writes the queued events and stops the sinks, waiting at most SINK_CLOSE_TIMEOUT for them
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return
+	}
+	d.closed = true
+	outputs := d.outputs
+	for _, o := range outputs {
+		close(o.events)
+	}
+	d.mutex.Unlock()
+	timeout := time.After(SINK_CLOSE_TIMEOUT)
+	for _, o := range outputs {
+		select {
+		case <-o.done:
+		case <-timeout:
+			d.log.Printf("sink %s: %d events not written\n", o.stats.Name, len(o.events))
+		}
+	}
+}
+
+// Returns the statistics of the sinks
+func (d *Dispatcher) Stats() []SinkStats {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var stats []SinkStats
+	for _, o := range d.outputs {
+		o.mutex.Lock()
+		s := o.stats
+		o.mutex.Unlock()
+		s.Queued = len(o.events)
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+func (d *Dispatcher) run(o *output) {
+	defer close(o.done)
+	if closer, ok := o.sink.(io.Closer); ok {
+		defer func() {
+			if err := closer.Close(); err != nil {
+				d.log.Printf("sink %s: error closing: %s\n", o.stats.Name, err)
+			}
+		}()
+	}
+	for e := range o.events {
+		err := o.sink.Write(e)
+		now := time.Now()
+		o.mutex.Lock()
+		if err != nil {
+			o.stats.Errors++
+			o.stats.LastError = err.Error()
+			o.stats.LastErrorTime = &now
+		} else {
+			o.stats.Written++
+		}
+		errors := o.stats.Errors
+		due := err != nil && logDue(&o.errorLogged, now)
+		o.mutex.Unlock()
+		if due {
+			d.log.Printf("sink %s: error: %s, %d errors\n", o.stats.Name, err, errors)
+		}
+	}
+}
+
+// Reports whether a problem of the sink can be logged again, the caller holds the mutex
+func logDue(logged *time.Time, now time.Time) bool {
+	if now.Sub(*logged) < SINK_LOG_INTERVAL {
+		return false
+	}
+	*logged = now
+	return true
+}
@@ -0,0 +1,135 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records the events written, waiting for release before each write when set
+type testSink struct {
+	mutex   sync.Mutex
+	events  []Event
+	release chan struct{}
+	closed  bool
+}
+
+func (s *testSink) Name() string {
+	return "test"
+}
+
+func (s *testSink) Write(e Event) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *testSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *testSink) written() (int, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.events), s.closed
+}
+
+func TestDispatcherPolicies(t *testing.T) {
+	d := NewDispatcher(log.New(io.Discard, "", 0))
+	slow := &testSink{release: make(chan struct{})}
+	blocking := &testSink{}
+	d.Add(slow, 2, SINK_DROP)
+	d.Add(blocking, 1, SINK_BLOCK)
+	// The slow sink holds the first event, buffers the next two and drops the others
+	for i := 0; i < 10; i++ {
+		d.Handle(Event{Kind: KIND_SNAPSHOT, Slave: i})
+		for i == 0 && d.Stats()[0].Queued > 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	close(slow.release)
+	d.Close()
+
+	stats := d.Stats()
+	if stats[0].Written != 3 || stats[0].Dropped != 7 {
+		t.Errorf("drop policy: written %d dropped %d, want 3 and 7", stats[0].Written, stats[0].Dropped)
+	}
+	if stats[1].Written != 10 || stats[1].Dropped != 0 {
+		t.Errorf("block policy: written %d dropped %d, want 10 and 0", stats[1].Written, stats[1].Dropped)
+	}
+	for i, e := range blocking.events {
+		if e.Slave != i {
+			t.Fatalf("block policy: event %d written in position %d", e.Slave, i)
+		}
+	}
+	if _, closed := slow.written(); !closed {
+		t.Errorf("sink not closed")
+	}
+}
+
+// Events may still be handled while and after the dispatcher is closed, e.g. the status of a site given up
+func TestDispatcherHandleAfterClose(t *testing.T) {
+	d := NewDispatcher(log.New(io.Discard, "", 0))
+	sinks := []*testSink{{}, {}}
+	d.Add(sinks[0], 4, SINK_DROP)
+	d.Add(sinks[1], 4, SINK_BLOCK)
+	var handlers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			for j := 0; j < 100; j++ {
+				d.Handle(Event{Kind: KIND_SNAPSHOT})
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	d.Close()
+	handlers.Wait()
+	d.Handle(Event{Kind: KIND_SNAPSHOT})
+	d.Close()
+
+	for i, stats := range d.Stats() {
+		written, closed := sinks[i].written()
+		if !closed {
+			t.Errorf("sink %d not closed", i)
+		}
+		if written != stats.Written || stats.Written+stats.Dropped > 400 {
+			t.Errorf("sink %d: %d events written, stats %+v, at most 400 handled", i, written, stats)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"heatpump/base"
+	"heatpump/mqtt"
+)
+
+// Sinks selected by SINKS
+const (
+	SINK_MQTT   string = "mqtt"
+	SINK_FILES  string = "files"
+	SINK_LOG    string = "log"
+	SINK_AUDIT  string = "audit"
+	SINK_INFLUX string = "influx"
+
+	// Added to the sinks of every site when METRICS_LISTEN is set
+	SINK_METRICS string = "metrics"
+)
+
+// Sinks by SINKS name, the audit sink needs the audit log of the site, the influx sink INFLUX_URL
+var sinks = map[string]func(site *base.Site) Sink{
+	SINK_MQTT:  func(site *base.Site) Sink { return &mqttSink{} },
+	SINK_FILES: func(site *base.Site) Sink { return NewStateFiles(site) },
+	SINK_LOG:   func(site *base.Site) Sink { return &logSink{log: site.Logger()} },
+	SINK_AUDIT: func(site *base.Site) Sink {
+		if len(site.AuditLog) == 0 {
+			return nil
+		}
+		return &auditSink{name: site.AuditLog}
+	},
+	SINK_INFLUX: func(site *base.Site) Sink { return NewInfluxSink(site.Logger(), SiteInfluxConfig(site)) },
+}
+
+// Returns the dispatcher of the sinks set by SINKS for a site
+func NewSiteDispatcher(site *base.Site) (*Dispatcher, error) {
+	if base.SinkPolicy != SINK_DROP && base.SinkPolicy != SINK_BLOCK {
+		return nil, fmt.Errorf("unknown SINK_POLICY %q, available policies: %s, %s", base.SinkPolicy, SINK_DROP,
+			SINK_BLOCK)
+	}
+	for _, name := range base.Sinks {
+		if _, ok := sinks[name]; !ok {
+			return nil, fmt.Errorf("unknown sink %q in SINKS", name)
+		}
+		if name == SINK_INFLUX && len(base.InfluxUrl) == 0 {
+			return nil, fmt.Errorf("INFLUX_URL is required by the %s sink", SINK_INFLUX)
+		}
+	}
+	d := NewDispatcher(site.Logger())
+	for _, name := range base.Sinks {
+		if sink := sinks[name](site); sink != nil {
+			d.Add(sink, base.SinkBuffer, base.SinkPolicy)
+		}
+	}
+	return d, nil
+}
+
+// Publishes the telemetry, bus, diagnostics, audit and site status events to their MQTT topics
+type mqttSink struct{}
+
+func (s *mqttSink) Name() string {
+	return SINK_MQTT
+}
+
+func (s *mqttSink) Write(e Event) error {
+	var retain bool
+	switch e.Kind {
+	case KIND_WRITE:
+		// Audit events are not retained
+		retain = false
+	case KIND_TELEMETRY, KIND_BUS, KIND_DIAGNOSTICS, KIND_STATUS:
+		// Retained so that subscribers get the current state
+		retain = true
+	default:
+		return nil
+	}
+	return mqtt.Publish(e.Topic, retain, string(e.Payload))
+}
+
+// Logs the telemetry summaries and the register writes
+type logSink struct {
+	log *log.Logger
+}
+
+func (s *logSink) Name() string {
+	return SINK_LOG
+}
+
+func (s *logSink) Write(e Event) error {
+	switch e.Kind {
+	case KIND_TELEMETRY:
+		s.log.Println(e.Summary)
+	case KIND_WRITE:
+		s.log.Printf("AUDIT %s\n", e.Payload)
+	}
+	return nil
+}
+
+// Appends the register writes to the audit log file
+type auditSink struct {
+	name string
+}
+
+func (s *auditSink) Name() string {
+	return SINK_AUDIT
+}
+
+func (s *auditSink) Write(e Event) error {
+	if e.Kind != KIND_WRITE {
+		return nil
+	}
+	f, err := os.OpenFile(s.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening audit log: %w", err)
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\n", e.Payload)
+	return err
+}
@@ -0,0 +1,162 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package decoder
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	"heatpump/base"
+	"heatpump/domain"
+)
+
+// StateFiles reflects the state of the heatpumps of a site in flag files in BASE_SHM, for the scripts running on the
+// same host. The files of a heatpump are named after the state file prefix of the site, followed by the slave address
+// when several heatpumps share the bus, e.g. Vitocal2Powered.
+type StateFiles struct {
+	site    *base.Site
+	devices map[int]*deviceFiles
+}
+
+// State files of a heatpump: OFF, ON or 0xFF when unknown
+type deviceFiles struct {
+	prefix                                               string
+	powered, pump, status, compressor, modeCool, defrost uint8
+}
+
+func NewStateFiles(site *base.Site) *StateFiles {
+	return &StateFiles{site: site, devices: make(map[int]*deviceFiles)}
+}
+
+func (f *StateFiles) Name() string {
+	return SINK_FILES
+}
+
+// Updates the state files on power and snapshot events, failures are logged without failing the event
+func (f *StateFiles) Write(e Event) error {
+	switch e.Kind {
+	case KIND_POWER:
+		d := f.device(e.Slave)
+		if e.Powered {
+			// The heatpump answers therefore it is powered
+			d.setStateOn(&d.powered, STATE_POWERED)
+		} else {
+			d.powerOff()
+		}
+	case KIND_SNAPSHOT:
+		f.device(e.Slave).setStateFiles(e.Vitocal)
+	}
+	return nil
+}
+
+func (f *StateFiles) device(slave int) *deviceFiles {
+	d, ok := f.devices[slave]
+	if !ok {
+		d = &deviceFiles{
+			prefix:     f.site.StateFilePrefix,
+			powered:    0xFF,
+			pump:       0xFF,
+			status:     0xFF,
+			compressor: 0xFF,
+			modeCool:   0xFF,
+			defrost:    0xFF,
+		}
+		if len(f.site.ModbusAddrs) > 1 {
+			d.prefix = fmt.Sprintf("%s%d", f.site.StateFilePrefix, slave)
+		}
+		f.devices[slave] = d
+	}
+	return d
+}
+
+// Returns the path of a state file in BASE_SHM
+func (d *deviceFiles) stateFile(name string) string {
+	return base.BaseSHM + d.prefix + name
+}
+
+// Reflects the decoded heatpump state into the flag files in BASE_SHM
+func (d *deviceFiles) setStateFiles(vitocal *domain.Vitocal) {
+	d.setState(&d.status, STATE_STATUS_ON, vitocal.Status == domain.ON)
+	d.setState(&d.compressor, STATE_COMPRESSOR_ON, vitocal.CompressorRequired)
+	d.setState(&d.defrost, STATE_DEFROST, vitocal.Defrost != domain.DEFROST_INACTIVE)
+	d.setState(&d.modeCool, STATE_MODE_COOL, vitocal.Mode == domain.MODE_COOL)
+	d.setState(&d.pump, STATE_PUMP_ON, vitocal.PumpStatus == domain.ON)
+}
+
+func (d *deviceFiles) setState(state *uint8, file string, on bool) {
+	if on {
+		d.setStateOn(state, file)
+	} else {
+		d.setStateOff(state, file)
+	}
+}
+
+func (d *deviceFiles) setStateOn(state *uint8, file string) {
+	if *state == OFF || *state == 0xFF {
+		f, err := os.Create(d.stateFile(file))
+		if err != nil {
+			fmt.Println("Error creating file: ", d.stateFile(file))
+		} else {
+			f.Close()
+			*state = ON
+		}
+	}
+}
+
+func (d *deviceFiles) setStateOff(state *uint8, file string) {
+	if *state == ON || *state == 0xFF {
+		cmd := exec.Command("/bin/rm", "-f", d.stateFile(file))
+		err := cmd.Run()
+		if err != nil {
+			fmt.Printf("Error removing vitocal state file %s: %s\n", file, err)
+		} else {
+			*state = OFF
+		}
+	}
+}
+
+// Removes all the state files when the heatpump is powered off
+func (d *deviceFiles) powerOff() {
+	if d.powered < 1 {
+		return
+	}
+	cmd := exec.Command("/bin/rm", "-f", d.stateFile(STATE_POWERED),
+		d.stateFile(STATE_STATUS_ON), d.stateFile(STATE_PUMP_ON), d.stateFile(STATE_COMPRESSOR_ON),
+		d.stateFile(STATE_MODE_COOL), d.stateFile(STATE_DEFROST))
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("error removing vitocal state files: %s\n", err)
+	} else {
+		d.powered = OFF
+		d.status = OFF
+		d.compressor = OFF
+		d.pump = OFF
+		d.modeCool = OFF
+		d.defrost = OFF
+	}
+}
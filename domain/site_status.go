@@ -0,0 +1,58 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package domain
+
+import "time"
+
+const (
+	SITE_CONNECTING   string = "connecting"
+	SITE_CONNECTED    string = "connected"
+	SITE_DISCONNECTED string = "disconnected"
+	// Gave up after failing to connect for MODBUS_CONNECTION_TIMEOUT_MINUTES
+	SITE_FAILED string = "failed"
+
+	// Kinds of connection errors
+	ERROR_EOF     string = "eof"
+	ERROR_RESET   string = "reset"
+	ERROR_TIMEOUT string = "timeout"
+	ERROR_REFUSED string = "refused"
+	ERROR_OTHER   string = "error"
+)
+
+// Connection state of a monitored site, counts are since the service started
+type SiteStatus struct {
+	Site          string     `json:"site,omitempty"`
+	Source        string     `json:"source"`
+	State         string     `json:"state"`
+	Since         time.Time  `json:"since"`
+	Connections   int        `json:"connections"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorKind string     `json:"last_error_kind,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	// Failed connection attempts since the last connection, and the time of the next attempt while disconnected
+	Attempts    int        `json:"attempts"`
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+}
@@ -48,6 +48,7 @@ const (
 
 type Vitocal struct {
 	Timestamp            time.Time            `json:"timestamp"`
+	Slave                int                  `json:"slave,omitempty"`
 	ControlMode          int                  `json:"control_mode"`
 	Status               int                  `json:"status"`
 	Mode                 int                  `json:"mode"`
@@ -65,4 +66,7 @@ type Vitocal struct {
 	PressureCondensation int                  `json:"pressure_condensation"`
 	Hours                int                  `json:"hours"`
 	Errors               vitocal.Errors       `json:"errors"`
+	Bus                  vitocal.Bus          `json:"bus"`
+	// Every register of each block by block name, unused registers (7ffe) are null. Only with RAW_REGISTERS.
+	Raw map[string][]*int `json:"raw,omitempty"`
 }
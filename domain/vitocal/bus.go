@@ -0,0 +1,60 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package vitocal
+
+import "time"
+
+const (
+	BUS_OK          string = "ok"
+	BUS_NO_RESPONSE string = "no_response"
+	BUS_EXCEPTION   string = "exception"
+	BUS_SILENT      string = "silent"
+)
+
+// Health of the MODBUS communication between the Remote Touch Controller and the heatpump, counts are since the
+// connection to the gateway, or the serial port, was opened and restart at each reconnection
+type Bus struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+
+	UnansweredRequests    int         `json:"unanswered_requests"`
+	LastUnanswered        *time.Time  `json:"last_unanswered,omitempty"`
+	LastUnansweredRequest string      `json:"last_unanswered_request,omitempty"`
+	UnpairedResponses     int         `json:"unpaired_responses"`
+	LastUnpaired          *time.Time  `json:"last_unpaired,omitempty"`
+	Exceptions            []Exception `json:"exceptions,omitempty"`
+	Silences              int         `json:"silences"`
+	LastSilence           *time.Time  `json:"last_silence,omitempty"`
+}
+
+// Exception responses by function and exception code
+type Exception struct {
+	Function    int       `json:"function"`
+	Code        int       `json:"code"`
+	Description string    `json:"description"`
+	Count       int       `json:"count"`
+	Last        time.Time `json:"last"`
+}
@@ -31,4 +31,7 @@ type Errors struct {
 	Error3 uint16 `json:"error_3"`
 	Error4 uint16 `json:"error_4"`
 	Error5 uint16 `json:"error_5"`
+
+	// Descriptions of the active error codes, when known by the model profile
+	Descriptions []string `json:"descriptions,omitempty"`
 }
@@ -26,40 +26,116 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"heatpump/base"
 	"heatpump/decoder"
-	"io"
+	"heatpump/serial"
 	"log"
 	"net"
-	"time"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 )
 
-// Connects to the heatpump modbus service and then hands the connection to the decoder
-// Retries the connection in case of error up to the defined timeout
+// Connects to the heatpump modbus service, or opens the RS-485 serial port when MODBUS_SERIAL is set, and then hands
+// the connection to the decoder
+// Each site listed in SITES is monitored concurrently and reconnected independently, the service ends when every site
+// failed to connect for the defined timeout
 func main() {
-	var errorCount int = 0
-	for {
-		conn, err := net.Dial("tcp", base.VitocalModbusTcp)
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("unknown command: %s\n", os.Args[1])
+		}
+		if err := command(os.Args[2:]); err != nil {
+			log.Fatalf("%s: %s\n", os.Args[1], err)
+		}
+		return
+	}
+
+	registerMap, err := decoder.DefaultRegisterMap()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("register map: %s, %d blocks\n", registerMap.Name, len(registerMap.Blocks))
+
+	// Every site is checked before any is monitored
+	var supervisors []*supervisor
+	for _, site := range base.Sites {
+		s, err := newSupervisor(site)
 		if err != nil {
-			errorCount++
-			log.Printf("error: '%s' trying to connect to: '%s'\n", err, base.VitocalModbusTcp)
-			if errorCount > base.ModbusConnectionTimeoutMinutes {
-				log.Fatalf("failed to connect to %s for %d minutes\n", base.VitocalModbusTcp,
-					base.ModbusConnectionTimeoutMinutes)
-				break
-			} else {
-				time.Sleep(60 * time.Second)
-				continue
-			}
+			site.Logger().Fatalln(err)
 		}
-		errorCount = 0
-		err = decoder.Decode(conn)
-		if err == io.EOF {
-			log.Fatalf("end of data from %s", base.VitocalModbusTcp)
-			break
-		} else {
-			log.Println("error:", err)
+		supervisors = append(supervisors, s)
+	}
+	log.Printf("sinks: %s, buffer %d, policy %s\n", strings.Join(base.Sinks, ", "), base.SinkBuffer, base.SinkPolicy)
+	// SIGINT and SIGTERM stop the sites, which do not wait for their next connection attempt
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	failed := make(chan error, len(supervisors))
+	for _, s := range supervisors {
+		wg.Add(1)
+		go func(s *supervisor) {
+			defer wg.Done()
+			if err := s.run(ctx); err != nil {
+				failed <- fmt.Errorf("site %s: %w", s.site, err)
+			}
+		}(s)
+	}
+	if len(base.MetricsListen) > 0 {
+		serveMetrics(supervisors)
+	}
+	go summarise(supervisors)
+	go func() {
+		wg.Wait()
+		close(failed)
+	}()
+	err, exit := <-failed
+	stopped := ctx.Err() != nil
+	stop()
+	// The queued events of every site are written before the service ends, e.g. the batched InfluxDB points
+	for _, s := range supervisors {
+		s.sinks.Close()
+	}
+	if exit {
+		log.Fatalln(err)
+	}
+	if stopped {
+		log.Println("service stopped")
+		return
+	}
+	log.Fatalf("no site left to monitor\n")
+}
+
+// Reads the site through the failover between its primary and secondary sources when it has a secondary source
+func connect(site *base.Site) (decoder.Conn, error) {
+	if len(site.SecondarySource()) > 0 {
+		return decoder.NewFailover(site, func() (decoder.Conn, error) {
+			return dial(site.ModbusTcp, site.ModbusSerial)
+		}, func() (decoder.Conn, error) {
+			return dial(site.SecondaryTcp, site.SecondarySerial)
+		}), nil
+	}
+	return dial(site.ModbusTcp, site.ModbusSerial)
+}
+
+// Opens the serial port when set, otherwise connects to the gateway
+func dial(gateway string, device string) (decoder.Conn, error) {
+	if len(device) > 0 {
+		port, err := serial.Open(device, serial.Config{
+			Baud:     base.SerialBaud,
+			DataBits: base.SerialDataBits,
+			Parity:   base.SerialParity,
+			StopBits: base.SerialStopBits,
+		})
+		if err != nil {
+			return nil, err
 		}
-		conn.Close()
+		return port, nil
 	}
+	return net.DialTimeout("tcp", gateway, DIAL_TIMEOUT)
 }
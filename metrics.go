@@ -0,0 +1,257 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"heatpump/base"
+	"heatpump/decoder"
+	"heatpump/domain"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	METRICS_PATH         = "/metrics"
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+	GAUGE   = "gauge"
+	COUNTER = "counter"
+)
+
+// A metric and its samples in the Prometheus text exposition format
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// Adds a sample, labels are name and value pairs
+func (f *metricFamily) add(value float64, labels ...string) {
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	f.samples = append(f.samples, metricSample{labels: strings.Join(pairs, ","), value: value})
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// Gauges of the numeric values of a heatpump snapshot, labelled by site and slave
+var vitocalGauges = []struct {
+	name  string
+	help  string
+	value func(v *domain.Vitocal) float64
+}{
+	{"heatpump_control_mode", "Control mode", func(v *domain.Vitocal) float64 { return float64(v.ControlMode) }},
+	{"heatpump_status", "Status, 0 = off, 1 = on", func(v *domain.Vitocal) float64 { return float64(v.Status) }},
+	{"heatpump_mode", "Mode, 1 = heat, 2 = cool", func(v *domain.Vitocal) float64 { return float64(v.Mode) }},
+	{"heatpump_defrost", "Defrost, 0 = inactive, 1 = starting, 2 = active",
+		func(v *domain.Vitocal) float64 { return float64(v.Defrost) }},
+	{"heatpump_oil_heater", "Oil heater status", func(v *domain.Vitocal) float64 { return float64(v.OilHeater) }},
+	{"heatpump_compressor_required", "Compressor required, 0 = false, 1 = true",
+		func(v *domain.Vitocal) float64 { return boolValue(v.CompressorRequired) }},
+	{"heatpump_compressor_status", "Compressor status",
+		func(v *domain.Vitocal) float64 { return float64(v.CompressorStatus) }},
+	{"heatpump_compressor_thrust", "Compressor thrust",
+		func(v *domain.Vitocal) float64 { return float64(v.CompressorThrust) }},
+	{"heatpump_compressor_hz", "Compressor frequency in Hz",
+		func(v *domain.Vitocal) float64 { return float64(v.CompressorHz) }},
+	{"heatpump_pump_status", "Circulation pump status", func(v *domain.Vitocal) float64 { return float64(v.PumpStatus) }},
+	{"heatpump_pump_speed", "Circulation pump speed", func(v *domain.Vitocal) float64 { return float64(v.PumpSpeed) }},
+	{"heatpump_fan_speed", "Fan speed", func(v *domain.Vitocal) float64 { return float64(v.FanSpeed) }},
+	{"heatpump_pressure_suction", "Suction pressure as read from the register",
+		func(v *domain.Vitocal) float64 { return float64(v.PressureSuction) }},
+	{"heatpump_pressure_condensation", "Condensation pressure as read from the register",
+		func(v *domain.Vitocal) float64 { return float64(v.PressureCondensation) }},
+	{"heatpump_hours", "Operating hours", func(v *domain.Vitocal) float64 { return float64(v.Hours) }},
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// Listens on METRICS_LISTEN and serves the metrics of the sites until the service ends
+func serveMetrics(supervisors []*supervisor) {
+	listener, err := net.Listen("tcp", base.MetricsListen)
+	if err != nil {
+		log.Fatalf("error listening on METRICS_LISTEN %s: %s\n", base.MetricsListen, err)
+	}
+	log.Printf("METRICS_LISTEN: serving %s on %s\n", METRICS_PATH, listener.Addr())
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+		out := bufio.NewWriter(w)
+		writeMetrics(out, gatherMetrics(supervisors))
+		out.Flush()
+	})
+	go func() {
+		log.Fatalf("error serving metrics: %s\n", http.Serve(listener, mux))
+	}()
+}
+
+// Collects the last heatpump values and the counters of every site
+func gatherMetrics(supervisors []*supervisor) []*metricFamily {
+	gauges := make([]*metricFamily, len(vitocalGauges))
+	for i, gauge := range vitocalGauges {
+		gauges[i] = &metricFamily{name: gauge.name, help: gauge.help, kind: GAUGE}
+	}
+	temperature := &metricFamily{name: "heatpump_temperature_celsius", help: "Temperature by sensor", kind: GAUGE}
+	errorCode := &metricFamily{name: "heatpump_error_code", help: "Error register value, 0 = no error", kind: GAUGE}
+	powered := &metricFamily{name: "heatpump_powered", help: "The heatpump answers on the bus", kind: GAUGE}
+	updated := &metricFamily{name: "heatpump_last_update_timestamp_seconds",
+		help: "Time of the last snapshot or power change", kind: GAUGE}
+	unanswered := &metricFamily{name: "heatpump_bus_unanswered_requests",
+		help: "Requests without response on the current connection", kind: GAUGE}
+	unpaired := &metricFamily{name: "heatpump_bus_unpaired_responses",
+		help: "Responses without request on the current connection", kind: GAUGE}
+	silences := &metricFamily{name: "heatpump_bus_silences", help: "Silences on the current connection", kind: GAUGE}
+	up := &metricFamily{name: "heatpump_site_up", help: "The site is connected", kind: GAUGE}
+	reconnects := &metricFamily{name: "heatpump_reconnects_total", help: "Connections after the first one",
+		kind: COUNTER}
+	frames := &metricFamily{name: "heatpump_frames_received_total", help: "MODBUS frames received", kind: COUNTER}
+	resyncs := &metricFamily{name: "heatpump_resync_total",
+		help: "Times the framer discarded bytes to find the next frame: corrupt or partial frames, and noise",
+		kind: COUNTER}
+	discarded := &metricFamily{name: "heatpump_discarded_bytes_total", help: "Bytes discarded by the framer",
+		kind: COUNTER}
+	crcErrors := &metricFamily{name: "heatpump_crc_errors_total",
+		help: "Frames whose address, function and length matched but whose CRC or LRC failed", kind: COUNTER}
+	unknown := &metricFamily{name: "heatpump_unknown_frames_total",
+		help: "Frames not decoded by the register map", kind: COUNTER}
+	publishFailures := &metricFamily{name: "heatpump_mqtt_publish_failures_total",
+		help: "MQTT publishes that failed", kind: COUNTER}
+	written := &metricFamily{name: "heatpump_sink_written_total", help: "Events written by the sink", kind: COUNTER}
+	dropped := &metricFamily{name: "heatpump_sink_dropped_total", help: "Events dropped, the sink buffer was full",
+		kind: COUNTER}
+	sinkErrors := &metricFamily{name: "heatpump_sink_errors_total", help: "Events the sink failed to write",
+		kind: COUNTER}
+
+	for _, s := range supervisors {
+		site := s.site.String()
+		if s.metrics != nil {
+			slaves, bus := s.metrics.Snapshot()
+			addresses := make([]int, 0, len(slaves))
+			for address := range slaves {
+				addresses = append(addresses, address)
+			}
+			sort.Ints(addresses)
+			for _, address := range addresses {
+				slave := slaves[address]
+				labels := []string{"site", site, "slave", strconv.Itoa(address)}
+				powered.add(boolValue(slave.Powered), labels...)
+				updated.add(float64(slave.Updated.UnixMilli())/1000, labels...)
+				v := slave.Vitocal
+				if v == nil {
+					continue
+				}
+				for i, gauge := range vitocalGauges {
+					gauges[i].add(gauge.value(v), labels...)
+				}
+				for _, sensor := range []struct {
+					name  string
+					value string
+				}{
+					{"water_in", v.Temperatures.WaterIn},
+					{"water_out", v.Temperatures.WaterOut},
+					{"external", v.Temperatures.External},
+					{"compressor_in", v.Temperatures.CompressorIn},
+					{"compressor_out", v.Temperatures.CompressorOut},
+				} {
+					// Sensors that are not fitted have no value
+					if value, err := strconv.ParseFloat(sensor.value, 64); err == nil {
+						temperature.add(value, append(labels, "sensor", sensor.name)...)
+					}
+				}
+				for i, value := range []uint16{v.Errors.Error1, v.Errors.Error2, v.Errors.Error3, v.Errors.Error4,
+					v.Errors.Error5} {
+					errorCode.add(float64(value), append(labels, "register", strconv.Itoa(i+1))...)
+				}
+			}
+			if bus != nil {
+				unanswered.add(float64(bus.UnansweredRequests), "site", site)
+				unpaired.add(float64(bus.UnpairedResponses), "site", site)
+				silences.add(float64(bus.Silences), "site", site)
+			}
+		}
+
+		status := s.snapshot()
+		up.add(boolValue(status.State == domain.SITE_CONNECTED), "site", site)
+		if status.Connections > 1 {
+			reconnects.add(float64(status.Connections-1), "site", site)
+		} else {
+			reconnects.add(0, "site", site)
+		}
+		frames.add(float64(s.counters.Frames()), "site", site)
+		resyncs.add(float64(s.counters.Resyncs()), "site", site)
+		discarded.add(float64(s.counters.Discarded()), "site", site)
+		crcErrors.add(float64(s.counters.CRCErrors()), "site", site)
+		unknown.add(float64(s.counters.Unknown()), "site", site)
+		var failures int
+		for _, stats := range s.sinks.Stats() {
+			if stats.Name == decoder.SINK_MQTT {
+				failures += stats.Errors
+			}
+			written.add(float64(stats.Written), "site", site, "sink", stats.Name)
+			dropped.add(float64(stats.Dropped), "site", site, "sink", stats.Name)
+			sinkErrors.add(float64(stats.Errors), "site", site, "sink", stats.Name)
+		}
+		publishFailures.add(float64(failures), "site", site)
+	}
+	return append(gauges, temperature, errorCode, powered, updated, unanswered, unpaired, silences, up, reconnects,
+		frames, resyncs, discarded, crcErrors, unknown, publishFailures, written, dropped, sinkErrors)
+}
+
+// Writes the families that have samples in the Prometheus text exposition format
+func writeMetrics(w *bufio.Writer, families []*metricFamily) {
+	for _, f := range families {
+		if len(f.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		for _, sample := range f.samples {
+			fmt.Fprintf(w, "%s{%s} %s\n", f.name, sample.labels, strconv.FormatFloat(sample.value, 'g', -1, 64))
+		}
+	}
+}
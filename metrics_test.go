@@ -0,0 +1,104 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"heatpump/base"
+	"heatpump/decoder"
+	"heatpump/domain"
+	"heatpump/domain/vitocal"
+)
+
+func TestMetrics(t *testing.T) {
+	s := &supervisor{
+		site:    &base.Site{Name: `home "north"\1`},
+		sinks:   decoder.NewDispatcher(log.New(io.Discard, "", 0)),
+		metrics: decoder.NewMetrics(),
+		status:  domain.SiteStatus{State: domain.SITE_CONNECTED, Connections: 3},
+	}
+	now := time.Unix(1792321412, 500000000)
+	s.metrics.Write(decoder.Event{Kind: decoder.KIND_SNAPSHOT, Time: now, Slave: 1, Vitocal: &domain.Vitocal{
+		Status:       domain.ON,
+		CompressorHz: 55,
+		Temperatures: vitocal.Temperatures{WaterIn: "33.5", WaterOut: "38.1", External: "-"},
+		Errors:       vitocal.Errors{Error2: 17},
+		Bus:          vitocal.Bus{UnansweredRequests: 4},
+	}})
+	s.metrics.Write(decoder.Event{Kind: decoder.KIND_POWER, Time: now, Slave: 2, Powered: true})
+
+	var out strings.Builder
+	w := bufio.NewWriter(&out)
+	writeMetrics(w, gatherMetrics([]*supervisor{s}))
+	w.Flush()
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(out.String(), "\n") {
+		lines[line] = true
+	}
+
+	site := `site="home \"north\"\\1"`
+	for _, line := range []string{
+		"# HELP heatpump_compressor_hz Compressor frequency in Hz",
+		"# TYPE heatpump_compressor_hz gauge",
+		"heatpump_compressor_hz{" + site + `,slave="1"} 55`,
+		"heatpump_status{" + site + `,slave="1"} 1`,
+		"heatpump_temperature_celsius{" + site + `,slave="1",sensor="water_in"} 33.5`,
+		"heatpump_temperature_celsius{" + site + `,slave="1",sensor="water_out"} 38.1`,
+		"heatpump_error_code{" + site + `,slave="1",register="2"} 17`,
+		"heatpump_powered{" + site + `,slave="1"} 0`,
+		"heatpump_powered{" + site + `,slave="2"} 1`,
+		"heatpump_last_update_timestamp_seconds{" + site + `,slave="2"} 1.7923214125e+09`,
+		"heatpump_bus_unanswered_requests{" + site + "} 4",
+		"heatpump_site_up{" + site + "} 1",
+		"# TYPE heatpump_reconnects_total counter",
+		"heatpump_reconnects_total{" + site + "} 2",
+		"heatpump_crc_errors_total{" + site + "} 0",
+	} {
+		if !lines[line] {
+			t.Errorf("no line %s", line)
+		}
+	}
+	// Sensors without value, and the gauges of a slave without snapshot
+	for _, missing := range []string{`sensor="external"`, `sensor="compressor_in"`, `slave="2"} 0`} {
+		if strings.Contains(out.String(), missing) {
+			t.Errorf("unexpected %s in\n%s", missing, out.String())
+		}
+	}
+	// Without reconnection
+	s.status.Connections = 1
+	out.Reset()
+	writeMetrics(w, gatherMetrics([]*supervisor{s}))
+	w.Flush()
+	if !strings.Contains(out.String(), "heatpump_reconnects_total{"+site+"} 0\n") {
+		t.Errorf("reconnects of a first connection not 0 in\n%s", out.String())
+	}
+}
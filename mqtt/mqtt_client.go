@@ -31,6 +31,7 @@ import (
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 	"heatpump/base"
 	"log"
+	"sync"
 )
 
 const (
@@ -43,8 +44,12 @@ type Message struct{}
 
 var mqttClient MQTT.Client
 
+// Several sites publish concurrently, only one of them reconnects
+var connectMutex sync.Mutex
+
+// The connection to the broker is established by the first Publish, so that the offline commands which do not
+// publish never connect
 func init() {
-	log.Printf("%s connecting to mqtt server: %s", mqttLogPrefix, base.MqttServer)
 	tlsconfig := NewTLSConfig()
 	opts := MQTT.NewClientOptions().
 		AddBroker(base.MqttServer).
@@ -53,11 +58,12 @@ func init() {
 		SetTLSConfig(tlsconfig)
 
 	mqttClient = MQTT.NewClient(opts)
-	mqttConnect()
 }
 
 // If the connection to the MQTT broker is lost, try to reconnect
 func CheckConnection() {
+	connectMutex.Lock()
+	defer connectMutex.Unlock()
 	if !mqttClient.IsConnected() {
 		mqttConnect()
 	}
@@ -83,6 +89,7 @@ func Publish(topic string, retain bool, payload string) error {
 /*** PRIVATE FUNCTIONS ***/
 
 func mqttConnect() {
+	log.Printf("%s connecting to mqtt server: %s", mqttLogPrefix, base.MqttServer)
 	if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
 		log.Printf("%s could not get connection with broker: %v", mqttLogPrefix, token.Error())
 	}
@@ -0,0 +1,244 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pcap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Reader of tcpdump captures in pcap and pcapng format
+
+const (
+	pcapMagicMicroseconds uint32 = 0xa1b2c3d4
+	pcapMagicNanoseconds  uint32 = 0xa1b23c4d
+
+	pcapngSectionHeader   uint32 = 0x0a0d0d0a
+	pcapngInterface       uint32 = 0x00000001
+	pcapngEnhancedPacket  uint32 = 0x00000006
+	pcapngByteOrderMagic  uint32 = 0x1a2b3c4d
+	pcapngOptionEnd       uint16 = 0
+	pcapngOptionTsresol   uint16 = 9
+	pcapngDefaultUnits    uint64 = 1000000
+	maxBlockSize          uint32 = 16 * 1024 * 1024
+	pcapRecordHeaderSize  int    = 16
+	pcapGlobalHeaderSize  int    = 24
+	pcapngBlockHeaderSize int    = 8
+)
+
+type Packet struct {
+	Time     time.Time
+	LinkType uint32
+	Data     []byte
+}
+
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	ng    bool
+
+	// pcap
+	linkType    uint32
+	nanoseconds bool
+
+	// pcapng, per section
+	interfaces []iface
+}
+
+type iface struct {
+	linkType uint32
+	units    uint64 // timestamp units per second
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReaderSize(r, 65536)}
+	head, err := reader.r.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("not a capture file: %w", err)
+	}
+	if binary.LittleEndian.Uint32(head) == pcapngSectionHeader {
+		reader.ng = true
+		return reader, nil
+	}
+	var header [24]byte
+	if _, err := io.ReadFull(reader.r, header[:pcapGlobalHeaderSize]); err != nil {
+		return nil, fmt.Errorf("not a capture file: %w", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header[0:4]) {
+		case pcapMagicMicroseconds:
+			reader.order = order
+		case pcapMagicNanoseconds:
+			reader.order = order
+			reader.nanoseconds = true
+		}
+	}
+	if reader.order == nil {
+		return nil, fmt.Errorf("not a capture file: unknown magic %x", header[0:4])
+	}
+	reader.linkType = reader.order.Uint32(header[20:24]) & 0x0fffffff
+	return reader, nil
+}
+
+// Returns the next packet, io.EOF at the end of the capture
+func (r *Reader) ReadPacket() (Packet, error) {
+	if r.ng {
+		return r.readBlock()
+	}
+	var header [16]byte
+	if _, err := io.ReadFull(r.r, header[:pcapRecordHeaderSize]); err != nil {
+		return Packet{}, eof(err)
+	}
+	seconds := r.order.Uint32(header[0:4])
+	fraction := r.order.Uint32(header[4:8])
+	length := r.order.Uint32(header[8:12])
+	if length > maxBlockSize {
+		return Packet{}, fmt.Errorf("invalid packet length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return Packet{}, eof(err)
+	}
+	nanoseconds := int64(fraction) * 1000
+	if r.nanoseconds {
+		nanoseconds = int64(fraction)
+	}
+	return Packet{Time: time.Unix(int64(seconds), nanoseconds), LinkType: r.linkType, Data: data}, nil
+}
+
+// pcapng is a sequence of blocks: type, total length, body, total length.
+// Only the enhanced packet blocks carry packets with their interface and timestamp.
+func (r *Reader) readBlock() (Packet, error) {
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r.r, header[:pcapngBlockHeaderSize]); err != nil {
+			return Packet{}, eof(err)
+		}
+		blockType := binary.LittleEndian.Uint32(header[0:4])
+		if blockType == pcapngSectionHeader {
+			// The byte order of the section is given by the magic that follows the block length
+			magic, err := r.r.Peek(4)
+			if err != nil {
+				return Packet{}, eof(err)
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic:
+				r.order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic) == pcapngByteOrderMagic:
+				r.order = binary.BigEndian
+			default:
+				return Packet{}, fmt.Errorf("invalid pcapng byte order magic %x", magic)
+			}
+			r.interfaces = nil
+		} else if r.order == nil {
+			return Packet{}, fmt.Errorf("pcapng block %x before section header", blockType)
+		}
+		blockType = r.order.Uint32(header[0:4])
+		length := r.order.Uint32(header[4:8])
+		if length < 12 || length%4 != 0 || length > maxBlockSize {
+			return Packet{}, fmt.Errorf("invalid pcapng block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r.r, body); err != nil {
+			return Packet{}, eof(err)
+		}
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case pcapngInterface:
+			if len(body) < 8 {
+				return Packet{}, fmt.Errorf("invalid pcapng interface block")
+			}
+			r.interfaces = append(r.interfaces, iface{
+				linkType: uint32(r.order.Uint16(body[0:2])),
+				units:    r.tsresol(body[8:]),
+			})
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return Packet{}, fmt.Errorf("invalid pcapng packet block")
+			}
+			id := r.order.Uint32(body[0:4])
+			if int(id) >= len(r.interfaces) {
+				return Packet{}, fmt.Errorf("pcapng packet for unknown interface %d", id)
+			}
+			timestamp := uint64(r.order.Uint32(body[4:8]))<<32 | uint64(r.order.Uint32(body[8:12]))
+			length := r.order.Uint32(body[12:16])
+			if int(length) > len(body)-20 {
+				return Packet{}, fmt.Errorf("invalid pcapng packet length %d", length)
+			}
+			units := r.interfaces[id].units
+			seconds := timestamp / units
+			nanoseconds := float64(timestamp%units) * float64(time.Second) / float64(units)
+			return Packet{
+				Time:     time.Unix(int64(seconds), int64(nanoseconds)),
+				LinkType: r.interfaces[id].linkType,
+				Data:     body[20 : 20+length],
+			}, nil
+		}
+	}
+}
+
+// Returns the timestamp units per second of an interface from its if_tsresol option
+func (r *Reader) tsresol(options []byte) uint64 {
+	for len(options) >= 4 {
+		code := r.order.Uint16(options[0:2])
+		length := int(r.order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+length > len(options) {
+			break
+		}
+		if code == pcapngOptionTsresol && length == 1 {
+			resolution := options[4]
+			units := uint64(1)
+			for i := 0; i < int(resolution&0x7f); i++ {
+				if resolution&0x80 != 0 {
+					units *= 2
+				} else {
+					units *= 10
+				}
+			}
+			if units > 0 {
+				return units
+			}
+		}
+		// The last option may lack its padding
+		next := 4 + (length+3)/4*4
+		if next > len(options) {
+			break
+		}
+		options = options[next:]
+	}
+	return pcapngDefaultUnits
+}
+
+func eof(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// Both binary.LittleEndian and binary.BigEndian
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// Returns a pcap capture of the packets, all of the link type and each with its capture time
+func capture(order byteOrder, magic uint32, linkType uint32, times []time.Time, packets [][]byte) []byte {
+	b := order.AppendUint32(nil, magic)
+	b = order.AppendUint16(b, 2)
+	b = order.AppendUint16(b, 4)
+	b = append(b, make([]byte, 8)...)
+	b = order.AppendUint32(b, 65535)
+	b = order.AppendUint32(b, linkType)
+	for i, packet := range packets {
+		fraction := uint32(times[i].Nanosecond() / 1000)
+		if magic == pcapMagicNanoseconds {
+			fraction = uint32(times[i].Nanosecond())
+		}
+		b = order.AppendUint32(b, uint32(times[i].Unix()))
+		b = order.AppendUint32(b, fraction)
+		b = order.AppendUint32(b, uint32(len(packet)))
+		b = order.AppendUint32(b, uint32(len(packet)))
+		b = append(b, packet...)
+	}
+	return b
+}
+
+// Returns a pcapng block with its body padded to 32 bits
+func block(order byteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	b := order.AppendUint32(nil, blockType)
+	b = order.AppendUint32(b, uint32(12+len(body)))
+	b = append(b, body...)
+	return order.AppendUint32(b, uint32(12+len(body)))
+}
+
+func section(order byteOrder) []byte {
+	body := order.AppendUint32(nil, pcapngByteOrderMagic)
+	body = order.AppendUint16(body, 1)
+	body = order.AppendUint16(body, 0)
+	body = append(body, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	return block(order, pcapngSectionHeader, body)
+}
+
+func interfaceBlock(order byteOrder, linkType uint16, options []byte) []byte {
+	body := order.AppendUint16(nil, linkType)
+	body = order.AppendUint16(body, 0)
+	body = order.AppendUint32(body, 65535)
+	return block(order, pcapngInterface, append(body, options...))
+}
+
+func packetBlock(order byteOrder, id uint32, timestamp uint64, data []byte) []byte {
+	body := order.AppendUint32(nil, id)
+	body = order.AppendUint32(body, uint32(timestamp>>32))
+	body = order.AppendUint32(body, uint32(timestamp))
+	body = order.AppendUint32(body, uint32(len(data)))
+	body = order.AppendUint32(body, uint32(len(data)))
+	return block(order, pcapngEnhancedPacket, append(body, data...))
+}
+
+// Returns the if_tsresol option followed by the end of options
+func tsresolOption(order byteOrder, resolution byte) []byte {
+	option := order.AppendUint16(nil, pcapngOptionTsresol)
+	option = order.AppendUint16(option, 1)
+	option = append(option, resolution, 0, 0, 0)
+	return append(option, 0, 0, 0, 0)
+}
+
+func readAll(t *testing.T, data []byte) []Packet {
+	t.Helper()
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packets []Packet
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			return packets
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func checkPackets(t *testing.T, packets []Packet, want []Packet) {
+	t.Helper()
+	if len(packets) != len(want) {
+		t.Fatalf("%d packets, want %d", len(packets), len(want))
+	}
+	for i, packet := range packets {
+		if !packet.Time.Equal(want[i].Time) || packet.LinkType != want[i].LinkType ||
+			!bytes.Equal(packet.Data, want[i].Data) {
+			t.Errorf("packet %d: %v %d %x, want %v %d %x", i, packet.Time, packet.LinkType, packet.Data,
+				want[i].Time, want[i].LinkType, want[i].Data)
+		}
+	}
+}
+
+func TestReadPcap(t *testing.T) {
+	times := []time.Time{time.Unix(1700000000, 123456000), time.Unix(1700000001, 5000)}
+	data := [][]byte{{1, 2, 3}, {4, 5, 6, 7, 8}}
+	for _, format := range []struct {
+		name  string
+		order byteOrder
+		magic uint32
+	}{
+		{"microseconds", binary.LittleEndian, pcapMagicMicroseconds},
+		{"nanoseconds", binary.BigEndian, pcapMagicNanoseconds},
+	} {
+		t.Run(format.name, func(t *testing.T) {
+			file := capture(format.order, format.magic, linkTypeRaw, times, data)
+			want := []Packet{
+				{Time: times[0], LinkType: linkTypeRaw, Data: data[0]},
+				{Time: times[1], LinkType: linkTypeRaw, Data: data[1]},
+			}
+			checkPackets(t, readAll(t, file), want)
+			// A capture cut in the last packet ends before it
+			checkPackets(t, readAll(t, file[:len(file)-2]), want[:1])
+		})
+	}
+	if _, err := NewReader(bytes.NewReader(make([]byte, 24))); err == nil {
+		t.Errorf("capture with an unknown magic accepted")
+	}
+}
+
+func TestReadPcapng(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	var file []byte
+	file = append(file, section(le)...)
+	// Microseconds by default, nanoseconds and 1/1024 seconds with if_tsresol
+	file = append(file, interfaceBlock(le, uint16(linkTypeEthernet), nil)...)
+	file = append(file, interfaceBlock(le, uint16(linkTypeRaw), tsresolOption(le, 9))...)
+	file = append(file, interfaceBlock(le, uint16(linkTypeRaw), tsresolOption(le, 0x8a))...)
+	file = append(file, packetBlock(le, 0, 1700000000123456, []byte{1})...)
+	file = append(file, packetBlock(le, 1, 1700000000123456789, []byte{2, 3})...)
+	file = append(file, block(le, 5, make([]byte, 8))...)
+	file = append(file, packetBlock(le, 2, 1700000000*1024+512, []byte{4, 5, 6})...)
+	// A new section has its own byte order and interfaces
+	file = append(file, section(be)...)
+	file = append(file, interfaceBlock(be, uint16(linkTypeLinuxSLL), nil)...)
+	file = append(file, packetBlock(be, 0, 1700000001000001, []byte{7, 8, 9, 10, 11})...)
+
+	checkPackets(t, readAll(t, file), []Packet{
+		{Time: time.Unix(1700000000, 123456000), LinkType: linkTypeEthernet, Data: []byte{1}},
+		{Time: time.Unix(1700000000, 123456789), LinkType: linkTypeRaw, Data: []byte{2, 3}},
+		{Time: time.Unix(1700000000, 500000000), LinkType: linkTypeRaw, Data: []byte{4, 5, 6}},
+		{Time: time.Unix(1700000001, 1000), LinkType: linkTypeLinuxSLL, Data: []byte{7, 8, 9, 10, 11}},
+	})
+
+	reader, err := NewReader(bytes.NewReader(append(section(le), packetBlock(le, 0, 0, []byte{1})...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.ReadPacket(); err == nil {
+		t.Errorf("packet of an unknown interface accepted")
+	}
+}
+
+func TestTsresol(t *testing.T) {
+	le := binary.LittleEndian
+	option := func(code uint16, length uint16, value ...byte) []byte {
+		return append(le.AppendUint16(le.AppendUint16(nil, code), length), value...)
+	}
+	for _, test := range []struct {
+		name    string
+		options []byte
+		units   uint64
+	}{
+		{"none", nil, pcapngDefaultUnits},
+		{"decimal", tsresolOption(le, 3), 1000},
+		{"binary", tsresolOption(le, 0x83), 8},
+		{"after another option", append(option(2, 5, 'e', 't', 'h', '0', 0, 0, 0, 0), tsresolOption(le, 9)...), 1e9},
+		{"after the end", append(option(pcapngOptionEnd, 0), tsresolOption(le, 9)...), pcapngDefaultUnits},
+		{"unpadded", option(pcapngOptionTsresol, 1, 6), 1000000},
+		{"unpadded other", option(2, 1, 'x'), pcapngDefaultUnits},
+		{"truncated", option(pcapngOptionTsresol, 4, 6), pcapngDefaultUnits},
+	} {
+		r := &Reader{order: le}
+		if units := r.tsresol(test.options); units != test.units {
+			t.Errorf("%s: %d units, want %d", test.name, units, test.units)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pcap
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Reassembly of the TCP stream sent by the Modbus gateway
+
+const (
+	linkTypeNull     uint32 = 0
+	linkTypeEthernet uint32 = 1
+	linkTypeRaw      uint32 = 101
+	linkTypeLinuxSLL uint32 = 113
+	linkTypeLinuxSL2 uint32 = 276
+
+	etherTypeIPv4 uint16 = 0x0800
+	etherTypeIPv6 uint16 = 0x86dd
+	etherTypeVLAN uint16 = 0x8100
+	etherTypeQinQ uint16 = 0x88a8
+
+	protocolTCP byte = 6
+
+	tcpFIN byte = 0x01
+	tcpSYN byte = 0x02
+	tcpRST byte = 0x04
+
+	// Out of order segments kept waiting for a missing one before the gap is skipped
+	maxPendingSegments int = 64
+)
+
+type segment struct {
+	flow    string
+	seq     uint32
+	flags   byte
+	payload []byte
+}
+
+type flow struct {
+	next    uint32
+	pending map[uint32][]byte
+}
+
+// The data sent from port by the gateway, in the order it was captured
+type Stream struct {
+	reader *Reader
+	port   uint16
+	flows  map[string]*flow
+}
+
+func NewStream(reader *Reader, port uint16) *Stream {
+	return &Stream{reader: reader, port: port, flows: make(map[string]*flow)}
+}
+
+// Returns the next chunk of the stream with its capture time, io.EOF at the end of the capture
+func (s *Stream) Next() (time.Time, []byte, error) {
+	for {
+		packet, err := s.reader.ReadPacket()
+		if err != nil {
+			return time.Time{}, nil, err
+		}
+		seg, ok := parse(packet, s.port)
+		if !ok {
+			continue
+		}
+		if data := s.reassemble(seg); len(data) > 0 {
+			return packet.Time, data, nil
+		}
+	}
+}
+
+// Returns the data that can be delivered in sequence after the segment
+func (s *Stream) reassemble(seg segment) []byte {
+	f, ok := s.flows[seg.flow]
+	if seg.flags&tcpSYN != 0 {
+		s.flows[seg.flow] = &flow{next: seg.seq + 1, pending: make(map[uint32][]byte)}
+		return nil
+	}
+	if !ok {
+		// The capture started after the connection was established
+		f = &flow{next: seg.seq, pending: make(map[uint32][]byte)}
+		s.flows[seg.flow] = f
+	}
+	if seg.flags&(tcpFIN|tcpRST) != 0 {
+		defer delete(s.flows, seg.flow)
+	}
+	if len(seg.payload) > 0 {
+		f.pending[seg.seq] = seg.payload
+	}
+	data := f.drain()
+	if len(data) == 0 && len(f.pending) > maxPendingSegments {
+		// A segment is missing from the capture, skip to the first one available
+		first, next := true, f.next
+		for seq := range f.pending {
+			if first || int32(seq-f.next) < int32(next-f.next) {
+				next = seq
+				first = false
+			}
+		}
+		f.next = next
+		data = f.drain()
+	}
+	return data
+}
+
+// Delivers the pending segments that continue the stream, dropping retransmitted data
+func (f *flow) drain() []byte {
+	var data []byte
+	for progress := true; progress; {
+		progress = false
+		for seq, payload := range f.pending {
+			offset := int32(f.next - seq)
+			if offset < 0 {
+				continue
+			}
+			delete(f.pending, seq)
+			progress = true
+			if int(offset) < len(payload) {
+				data = append(data, payload[offset:]...)
+				f.next += uint32(len(payload)) - uint32(offset)
+			}
+		}
+	}
+	return data
+}
+
+// Extracts the TCP segment from a packet sent from port, false if it is not such a packet
+func parse(packet Packet, port uint16) (segment, bool) {
+	data := packet.Data
+	var etherType uint16
+	switch packet.LinkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return segment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		for (etherType == etherTypeVLAN || etherType == etherTypeQinQ) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return segment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+	case linkTypeLinuxSL2:
+		if len(data) < 20 {
+			return segment{}, false
+		}
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+	case linkTypeNull:
+		if len(data) < 4 {
+			return segment{}, false
+		}
+		data = data[4:]
+	case linkTypeRaw:
+	default:
+		return segment{}, false
+	}
+	if etherType != 0 && etherType != etherTypeIPv4 && etherType != etherTypeIPv6 {
+		return segment{}, false
+	}
+	if len(data) < 1 {
+		return segment{}, false
+	}
+
+	var src, dst []byte
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return segment{}, false
+		}
+		headerLength := int(data[0]&0x0f) * 4
+		totalLength := int(binary.BigEndian.Uint16(data[2:4]))
+		fragment := binary.BigEndian.Uint16(data[6:8])
+		if data[9] != protocolTCP || fragment&0x3fff != 0 || headerLength < 20 ||
+			totalLength < headerLength || totalLength > len(data) {
+			return segment{}, false
+		}
+		src, dst = data[12:16], data[16:20]
+		data = data[headerLength:totalLength]
+	case 6:
+		if len(data) < 40 {
+			return segment{}, false
+		}
+		payloadLength := int(binary.BigEndian.Uint16(data[4:6]))
+		if data[6] != protocolTCP || 40+payloadLength > len(data) {
+			return segment{}, false
+		}
+		src, dst = data[8:24], data[24:40]
+		data = data[40 : 40+payloadLength]
+	default:
+		return segment{}, false
+	}
+
+	if len(data) < 20 || binary.BigEndian.Uint16(data[0:2]) != port {
+		return segment{}, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return segment{}, false
+	}
+	return segment{
+		flow:    string(src) + string(data[0:2]) + string(dst) + string(data[2:4]),
+		seq:     binary.BigEndian.Uint32(data[4:8]),
+		flags:   data[13],
+		payload: data[offset:],
+	}, true
+}
@@ -0,0 +1,122 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+const gatewayPort uint16 = 502
+
+// Returns an IPv4 packet carrying a TCP segment
+func tcpPacket(src uint16, dst uint16, seq uint32, flags byte, payload []byte) []byte {
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, 64, protocolTCP, 0, 0, 192, 168, 1, 10, 192, 168, 1, 20}
+	tcp := binary.BigEndian.AppendUint16(nil, src)
+	tcp = binary.BigEndian.AppendUint16(tcp, dst)
+	tcp = binary.BigEndian.AppendUint32(tcp, seq)
+	tcp = append(tcp, 0, 0, 0, 0, 5<<4, flags|0x10, 0xff, 0xff, 0, 0, 0, 0)
+	packet := append(append(ip, tcp...), payload...)
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	return packet
+}
+
+// Returns the packet in an Ethernet frame with a VLAN tag
+func ethernet(packet []byte) []byte {
+	frame := make([]byte, 12, 18+len(packet))
+	frame = binary.BigEndian.AppendUint16(frame, etherTypeVLAN)
+	frame = append(frame, 0, 1)
+	frame = binary.BigEndian.AppendUint16(frame, etherTypeIPv4)
+	return append(frame, packet...)
+}
+
+func chunks(t *testing.T, linkType uint32, packets [][]byte) []string {
+	t.Helper()
+	times := make([]time.Time, len(packets))
+	for i := range times {
+		times[i] = time.Unix(1700000000+int64(i), 0)
+	}
+	reader, err := NewReader(bytes.NewReader(capture(binary.LittleEndian, pcapMagicMicroseconds, linkType, times,
+		packets)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := NewStream(reader, gatewayPort)
+	var chunks []string
+	for {
+		_, data, err := stream.Next()
+		if err == io.EOF {
+			return chunks
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, string(data))
+	}
+}
+
+func TestStream(t *testing.T) {
+	var packets [][]byte
+	for _, packet := range [][]byte{
+		tcpPacket(gatewayPort, 40000, 1000, tcpSYN, nil),
+		tcpPacket(gatewayPort, 40000, 1001, 0, []byte("ab")),
+		// The requests sent to the gateway are not part of the stream
+		tcpPacket(40000, gatewayPort, 7000, 0, []byte("request")),
+		// Out of order, then retransmitted
+		tcpPacket(gatewayPort, 40000, 1005, 0, []byte("ef")),
+		tcpPacket(gatewayPort, 40000, 1003, 0, []byte("cd")),
+		tcpPacket(gatewayPort, 40000, 1001, 0, []byte("abc")),
+		tcpPacket(gatewayPort, 40000, 1005, 0, []byte("efgh")),
+		tcpPacket(gatewayPort, 40000, 1009, tcpFIN, nil),
+		// A connection established before the capture started
+		tcpPacket(gatewayPort, 40001, 5000, 0, []byte("xy")),
+	} {
+		packets = append(packets, ethernet(packet))
+	}
+	// A truncated frame is skipped
+	packets = append(packets, ethernet(nil)[:10])
+	got := chunks(t, linkTypeEthernet, packets)
+	want := []string{"ab", "cdef", "gh", "xy"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] || got[3] != want[3] {
+		t.Errorf("chunks %q, want %q", got, want)
+	}
+}
+
+// A segment missing from the capture is skipped once too many segments wait for it
+func TestStreamGap(t *testing.T) {
+	packets := [][]byte{tcpPacket(gatewayPort, 40000, 100, 0, []byte("a"))}
+	var rest []byte
+	for i := 0; i <= maxPendingSegments; i++ {
+		packets = append(packets, tcpPacket(gatewayPort, 40000, uint32(102+i), 0, []byte{'b' + byte(i%20)}))
+		rest = append(rest, 'b'+byte(i%20))
+	}
+	got := chunks(t, linkTypeRaw, packets)
+	if len(got) != 2 || got[0] != "a" || got[1] != string(rest) {
+		t.Errorf("chunks %q, want %q and %q", got, "a", rest)
+	}
+}
@@ -0,0 +1,126 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package recorder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Recording of the raw byte stream received from the gateway.
+//
+// File format: the magic "HPR1", the wall clock time of the start of the recording in nanoseconds since the epoch
+// (8 bytes, big endian), followed by one entry per chunk of data read: the monotonic time elapsed since the previous
+// chunk in nanoseconds (uvarint), the chunk length (uvarint) and the chunk data.
+
+const magic = "HPR1"
+
+type Writer struct {
+	w     *bufio.Writer
+	start time.Time
+	last  time.Duration
+}
+
+// Starts a recording, start is used as the origin of the monotonic chunk times
+func NewWriter(w io.Writer, start time.Time) (*Writer, error) {
+	writer := &Writer{w: bufio.NewWriter(w), start: start}
+	header := make([]byte, len(magic)+8)
+	copy(header, magic)
+	binary.BigEndian.PutUint64(header[len(magic):], uint64(start.UnixNano()))
+	if _, err := writer.w.Write(header); err != nil {
+		return nil, err
+	}
+	return writer, writer.w.Flush()
+}
+
+// Records a chunk of data received now
+func (w *Writer) Write(data []byte) (int, error) {
+	elapsed := time.Since(w.start)
+	var header [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(header[:], uint64(elapsed-w.last))
+	n += binary.PutUvarint(header[n:], uint64(len(data)))
+	w.last = elapsed
+	if _, err := w.w.Write(header[:n]); err != nil {
+		return 0, err
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return 0, err
+	}
+	return len(data), w.w.Flush()
+}
+
+type Reader struct {
+	r       *bufio.Reader
+	start   time.Time
+	elapsed time.Duration
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+	header := make([]byte, len(magic)+8)
+	if _, err := io.ReadFull(reader.r, header); err != nil || string(header[:len(magic)]) != magic {
+		return nil, fmt.Errorf("not a recording")
+	}
+	reader.start = time.Unix(0, int64(binary.BigEndian.Uint64(header[len(magic):])))
+	return reader, nil
+}
+
+// Returns the next chunk with the time it was received, io.EOF at the end of the recording
+func (r *Reader) Next() (time.Time, []byte, error) {
+	delta, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return time.Time{}, nil, truncated(err)
+	}
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return time.Time{}, nil, truncated(err)
+	}
+	if length > 1<<20 {
+		return time.Time{}, nil, fmt.Errorf("invalid chunk length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return time.Time{}, nil, truncated(err)
+	}
+	r.elapsed += time.Duration(delta)
+	return r.start.Add(r.elapsed), data, nil
+}
+
+// Returns the time elapsed from the start of the recording to the last chunk returned by Next
+func (r *Reader) Elapsed() time.Duration {
+	return r.elapsed
+}
+
+// A recording interrupted while writing a chunk ends with the last complete one
+func truncated(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
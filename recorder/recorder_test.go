@@ -0,0 +1,197 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package recorder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A chunk of a recording and the time elapsed since the previous one
+type entry struct {
+	gap  time.Duration
+	data []byte
+}
+
+// Returns a recording of the entries in the file format
+func recording(start time.Time, entries []entry) []byte {
+	b := []byte(magic)
+	b = binary.BigEndian.AppendUint64(b, uint64(start.UnixNano()))
+	for _, e := range entries {
+		b = binary.AppendUvarint(b, uint64(e.gap))
+		b = binary.AppendUvarint(b, uint64(len(e.data)))
+		b = append(b, e.data...)
+	}
+	return b
+}
+
+func readAll(t *testing.T, data []byte) ([]time.Duration, [][]byte, error) {
+	t.Helper()
+	reader, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var elapsed []time.Duration
+	var chunks [][]byte
+	for {
+		received, chunk, err := reader.Next()
+		if err != nil {
+			return elapsed, chunks, err
+		}
+		if !received.Equal(reader.start.Add(reader.Elapsed())) {
+			t.Errorf("chunk %d received at %s, %s after the start %s", len(chunks), received, reader.Elapsed(),
+				reader.start)
+		}
+		elapsed = append(elapsed, reader.Elapsed())
+		chunks = append(chunks, chunk)
+	}
+}
+
+// The chunks are read back unchanged, each at the time it was written
+func TestRoundTrip(t *testing.T) {
+	var file bytes.Buffer
+	start := time.Now()
+	w, err := NewWriter(&file, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks := [][]byte{{0x01, 0x03, 0x00, 0x00}, {}, bytes.Repeat([]byte{0xaa}, 300), {0x42}}
+	var before, after []time.Duration
+	for i, chunk := range chunks {
+		time.Sleep(time.Duration(i) * 5 * time.Millisecond)
+		before = append(before, time.Since(start))
+		if n, err := w.Write(chunk); err != nil || n != len(chunk) {
+			t.Fatalf("write %d: %d bytes, %v", i, n, err)
+		}
+		after = append(after, time.Since(start))
+	}
+
+	elapsed, read, err := readAll(t, file.Bytes())
+	if err != io.EOF {
+		t.Fatalf("error %v, want io.EOF", err)
+	}
+	if len(read) != len(chunks) {
+		t.Fatalf("%d chunks read, want %d", len(read), len(chunks))
+	}
+	for i := range chunks {
+		if !bytes.Equal(read[i], chunks[i]) {
+			t.Errorf("chunk %d read as %x, want %x", i, read[i], chunks[i])
+		}
+		if elapsed[i] < before[i] || elapsed[i] > after[i] {
+			t.Errorf("chunk %d at %s, written between %s and %s", i, elapsed[i], before[i], after[i])
+		}
+	}
+}
+
+func TestReadEntries(t *testing.T) {
+	start := time.Unix(1792321412, 0)
+	entries := []entry{{0, []byte{1, 2}}, {150 * time.Millisecond, []byte{3}}, {2 * time.Second, []byte{4, 5, 6}}}
+	file := recording(start, entries)
+	elapsed, chunks, err := readAll(t, file)
+	if err != io.EOF || len(chunks) != 3 {
+		t.Fatalf("%d chunks, error %v, want 3 and io.EOF", len(chunks), err)
+	}
+	for i, want := range []time.Duration{0, 150 * time.Millisecond, 2150 * time.Millisecond} {
+		if elapsed[i] != want || !bytes.Equal(chunks[i], entries[i].data) {
+			t.Errorf("chunk %d: %x at %s, want %x at %s", i, chunks[i], elapsed[i], entries[i].data, want)
+		}
+	}
+
+	// A recording interrupted in the time, the length or the data of the last chunk ends with the chunk before it
+	for _, cut := range []int{1, 3, 4, 6} {
+		_, chunks, err := readAll(t, file[:len(file)-cut])
+		if err != io.EOF || len(chunks) != 2 {
+			t.Errorf("cut by %d bytes: %d chunks, error %v, want 2 and io.EOF", cut, len(chunks), err)
+		}
+	}
+
+	oversized := recording(start, entries[:1])
+	oversized = binary.AppendUvarint(oversized, 0)
+	oversized = binary.AppendUvarint(oversized, 1<<20+1)
+	oversized = append(oversized, make([]byte, 1<<20+1)...)
+	if _, chunks, err := readAll(t, oversized); err == nil || err == io.EOF || len(chunks) != 1 {
+		t.Errorf("chunk over 1 MB: %d chunks, error %v", len(chunks), err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("HPR0\x00\x00\x00\x00\x00\x00\x00\x00"))); err == nil {
+		t.Errorf("recording with another magic accepted")
+	}
+}
+
+// Records the time of each write since the first one
+type pacedWriter struct {
+	mutex sync.Mutex
+	first time.Time
+	times []time.Duration
+}
+
+func (w *pacedWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.first.IsZero() {
+		w.first = time.Now()
+	}
+	w.times = append(w.times, time.Since(w.first))
+	return len(p), nil
+}
+
+func TestReplaySpeed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "recording.hpr")
+	gaps := []time.Duration{0, 100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}
+	var entries []entry
+	for _, gap := range gaps {
+		entries = append(entries, entry{gap, []byte{0x01}})
+	}
+	if err := os.WriteFile(file, recording(time.Unix(1792321412, 0), entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		speed float64
+		// Time of the chunks from the first one
+		times []time.Duration
+	}{
+		{2, []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{0.5, []time.Duration{0, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond}},
+		{0, []time.Duration{0, 0, 0, 0}},
+	} {
+		w := &pacedWriter{}
+		chunks, err := replay(w, file, test.speed)
+		if err != nil || chunks != len(gaps) {
+			t.Fatalf("speed %g: %d chunks, error %v", test.speed, chunks, err)
+		}
+		for i, want := range test.times {
+			if got := w.times[i]; got < want-5*time.Millisecond || got > want+50*time.Millisecond {
+				t.Errorf("speed %g: chunk %d sent at %s, want %s", test.speed, i, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package recorder
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const logPrefix = "REPLAY -"
+
+// Serves a recording as a MODBUS gateway: each client connection receives the recorded stream from the start and is
+// closed at the end of the recording. The chunks are sent at their original pace multiplied by speed, or as fast as
+// possible when speed is 0.
+func Serve(listener net.Listener, file string, speed float64) error {
+	// Fail early on a missing or invalid recording
+	if err := check(file); err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		log.Printf("%s %s connected\n", logPrefix, conn.RemoteAddr())
+		go func() {
+			defer conn.Close()
+			chunks, err := replay(conn, file, speed)
+			if err != nil {
+				log.Printf("%s %s: %s after %d chunks\n", logPrefix, conn.RemoteAddr(), err, chunks)
+			} else {
+				log.Printf("%s %s: end of recording after %d chunks\n", logPrefix, conn.RemoteAddr(), chunks)
+			}
+		}()
+	}
+}
+
+func replay(w io.Writer, file string, speed float64) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	reader, err := NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	chunks := 0
+	for {
+		_, data, err := reader.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return chunks, err
+		}
+		if speed > 0 {
+			// Sleep until the scheduled time of the chunk rather than for the gap, so that delays do not accumulate
+			time.Sleep(time.Until(start.Add(time.Duration(float64(reader.Elapsed()) / speed))))
+		}
+		if _, err := w.Write(data); err != nil {
+			return chunks, err
+		}
+		chunks++
+	}
+}
+
+func check(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = NewReader(f)
+	return err
+}
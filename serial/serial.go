@@ -0,0 +1,119 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package serial
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// RS-485 serial port reading the Modbus RTU bus directly, e.g. through a USB dongle.
+// Modbus RTU frames are separated by a silence of at least 3.5 characters, Read returns the bytes received up to
+// the next silence so that each read normally holds one frame.
+
+type Config struct {
+	Baud     int
+	DataBits int    // 8 for Modbus RTU, 7 for Modbus ASCII
+	Parity   string // N = none, E = even, O = odd
+	StopBits int
+}
+
+type Port struct {
+	file     *os.File
+	silence  time.Duration
+	deadline time.Time
+}
+
+// Opens the serial device, it can also be one end of a pseudo-terminal pair
+func Open(device string, config Config) (*Port, error) {
+	if config.DataBits != 7 && config.DataBits != 8 {
+		return nil, fmt.Errorf("invalid data bits: %d", config.DataBits)
+	}
+	if config.StopBits != 1 && config.StopBits != 2 {
+		return nil, fmt.Errorf("invalid stop bits: %d", config.StopBits)
+	}
+	if config.Parity != "N" && config.Parity != "E" && config.Parity != "O" {
+		return nil, fmt.Errorf("invalid parity: %s", config.Parity)
+	}
+	file, err := open(device, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Port{file: file, silence: Silence(config)}, nil
+}
+
+// Returns the Modbus RTU inter-frame silence for the configuration: 3.5 characters,
+// fixed at 1.75ms above 19200 baud as recommended by the Modbus serial line specification
+func Silence(config Config) time.Duration {
+	if config.Baud > 19200 {
+		return 1750 * time.Microsecond
+	}
+	// start bit, 8 data bits, parity bit (or extra stop bit) and stop bit
+	bits := 11
+	if config.Parity == "N" && config.StopBits == 1 {
+		bits = 10
+	}
+	if config.DataBits == 7 {
+		bits--
+	}
+	return time.Duration(float64(bits) * 3.5 * float64(time.Second) / float64(config.Baud))
+}
+
+func (p *Port) Read(buf []byte) (int, error) {
+	// Wait for the start of a frame until the deadline set by the caller
+	p.file.SetReadDeadline(p.deadline)
+	n, err := p.file.Read(buf)
+	if err != nil {
+		return n, err
+	}
+	// Then read until the line stays silent
+	for n < len(buf) {
+		p.file.SetReadDeadline(time.Now().Add(p.silence))
+		size, err := p.file.Read(buf[n:])
+		n += size
+		if err != nil {
+			if os.IsTimeout(err) {
+				break
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (p *Port) Write(buf []byte) (int, error) {
+	return p.file.Write(buf)
+}
+
+func (p *Port) SetReadDeadline(t time.Time) error {
+	p.deadline = t
+	return nil
+}
+
+func (p *Port) Close() error {
+	return p.file.Close()
+}
@@ -0,0 +1,245 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux
+
+package serial
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// Mask of the baud rate bits in the control flags, not exported by syscall
+const cbaud = 0010017
+
+func ioctl(file *os.File, request uintptr, arg unsafe.Pointer) error {
+	raw, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = raw.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	return err
+}
+
+// Returns the master side of a new pseudo terminal and the path of its slave side, which stands in for the serial device
+func openPty(t *testing.T) (*os.File, string) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Skipf("no pseudo terminals: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+	var unlock int32
+	if err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		t.Fatal(err)
+	}
+	var number uint32
+	if err := ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&number)); err != nil {
+		t.Fatal(err)
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", number)
+}
+
+func openPort(t *testing.T, config Config) (*os.File, *Port) {
+	master, device := openPty(t)
+	port, err := Open(device, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { port.Close() })
+	return master, port
+}
+
+func TestSilence(t *testing.T) {
+	tests := []struct {
+		config  Config
+		silence time.Duration
+	}{
+		// 3.5 characters of 10 bits
+		{Config{Baud: 9600, DataBits: 8, Parity: "N", StopBits: 1}, 3645833 * time.Nanosecond},
+		// 11 bits with parity or a second stop bit
+		{Config{Baud: 9600, DataBits: 8, Parity: "E", StopBits: 1}, 4010416 * time.Nanosecond},
+		{Config{Baud: 9600, DataBits: 8, Parity: "N", StopBits: 2}, 4010416 * time.Nanosecond},
+		{Config{Baud: 9600, DataBits: 7, Parity: "E", StopBits: 1}, 3645833 * time.Nanosecond},
+		{Config{Baud: 19200, DataBits: 8, Parity: "E", StopBits: 1}, 2005208 * time.Nanosecond},
+		// Fixed above 19200 baud
+		{Config{Baud: 38400, DataBits: 8, Parity: "E", StopBits: 1}, 1750 * time.Microsecond},
+		{Config{Baud: 115200, DataBits: 8, Parity: "N", StopBits: 1}, 1750 * time.Microsecond},
+	}
+	for _, test := range tests {
+		if silence := Silence(test.config); silence != test.silence {
+			t.Errorf("Silence(%+v) = %v, want %v", test.config, silence, test.silence)
+		}
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	_, device := openPty(t)
+	configs := []Config{
+		{Baud: 9600, DataBits: 6, Parity: "N", StopBits: 1},
+		{Baud: 9600, DataBits: 8, Parity: "X", StopBits: 1},
+		{Baud: 9600, DataBits: 8, Parity: "N", StopBits: 3},
+		{Baud: 12345, DataBits: 8, Parity: "N", StopBits: 1},
+	}
+	for _, config := range configs {
+		if port, err := Open(device, config); err == nil {
+			port.Close()
+			t.Errorf("Open(%+v) succeeded", config)
+		}
+	}
+}
+
+func TestTermios(t *testing.T) {
+	// A pseudo terminal forces 8 data bits and no parity, the other control flags are kept as set
+	const mask = cbaud | syscall.CSTOPB | syscall.PARODD | syscall.CREAD | syscall.CLOCAL
+	tests := []struct {
+		config Config
+		cflag  uint32
+	}{
+		{Config{Baud: 9600, DataBits: 8, Parity: "N", StopBits: 1}, syscall.B9600 | syscall.CREAD | syscall.CLOCAL},
+		{Config{Baud: 19200, DataBits: 8, Parity: "E", StopBits: 1}, syscall.B19200 | syscall.CREAD | syscall.CLOCAL},
+		{Config{Baud: 4800, DataBits: 7, Parity: "O", StopBits: 2},
+			syscall.B4800 | syscall.CSTOPB | syscall.PARODD | syscall.CREAD | syscall.CLOCAL},
+	}
+	for _, test := range tests {
+		_, port := openPort(t, test.config)
+		var termios syscall.Termios
+		if err := ioctl(port.file, syscall.TCGETS, unsafe.Pointer(&termios)); err != nil {
+			t.Fatal(err)
+		}
+		if termios.Cflag&mask != test.cflag {
+			t.Errorf("%+v: cflag %o, want %o", test.config, termios.Cflag&mask, test.cflag)
+		}
+		// Raw mode: no echo, no line editing and no output processing
+		if termios.Lflag&(syscall.ECHO|syscall.ICANON|syscall.ISIG) != 0 || termios.Oflag&syscall.OPOST != 0 {
+			t.Errorf("%+v: lflag %o oflag %o, want raw mode", test.config, termios.Lflag, termios.Oflag)
+		}
+		if termios.Cc[syscall.VMIN] != 1 || termios.Cc[syscall.VTIME] != 0 {
+			t.Errorf("%+v: vmin %d vtime %d, want 1 and 0", test.config, termios.Cc[syscall.VMIN], termios.Cc[syscall.VTIME])
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	master, port := openPort(t, Config{Baud: 9600, DataBits: 8, Parity: "E", StopBits: 1})
+	// Every byte value goes through unchanged in raw mode
+	request := []byte{0x01, 0x03, 0x1c, 0x2e, 0x00, 0x0b, 0x0d, 0x0a, 0x11, 0x13, 0x7f, 0xff, 0x00, 0x03}
+	if _, err := master.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 256)
+	port.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := port.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(request) {
+		t.Errorf("port read % x, want % x", buf[:n], request)
+	}
+
+	response := []byte{0x01, 0x03, 0x02, 0x0d, 0x0a, 0xff, 0x00}
+	if _, err := port.Write(response); err != nil {
+		t.Fatal(err)
+	}
+	master.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = master.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(response) {
+		t.Errorf("master read % x, want % x", buf[:n], response)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	_, port := openPort(t, Config{Baud: 9600, DataBits: 8, Parity: "N", StopBits: 1})
+	port.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	_, err := port.Read(make([]byte, 16))
+	if !os.IsTimeout(err) {
+		t.Fatalf("read on a silent line returned %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("read returned after %v, before the deadline", elapsed)
+	}
+}
+
+// A read returns at the first gap of the line longer than the silence interval, and not at shorter gaps
+func TestReadSilence(t *testing.T) {
+	// 3.5 characters of 11 bits at 1200 baud: 32ms
+	config := Config{Baud: 1200, DataBits: 8, Parity: "E", StopBits: 1}
+	master, port := openPort(t, config)
+	silence := Silence(config)
+	buf := make([]byte, 64)
+
+	write := func(gap time.Duration, parts ...string) {
+		go func() {
+			for i, part := range parts {
+				if i > 0 {
+					time.Sleep(gap)
+				}
+				master.Write([]byte(part))
+			}
+		}()
+	}
+	read := func() string {
+		port.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := port.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	write(silence/8, "first ", "half")
+	if frame := read(); frame != "first half" {
+		t.Errorf("gap of %v: read %q, want one frame", silence/8, frame)
+	}
+	write(4*silence, "one", "two")
+	if frame := read(); frame != "one" {
+		t.Errorf("gap of %v: read %q, want the first frame only", 4*silence, frame)
+	}
+	if frame := read(); frame != "two" {
+		t.Errorf("gap of %v: read %q, want the second frame", 4*silence, frame)
+	}
+
+	// The read waits for the silence after the last byte before returning
+	start := time.Now()
+	write(0, "frame")
+	read()
+	if elapsed := time.Since(start); elapsed < silence {
+		t.Errorf("read returned after %v, before %v of silence", elapsed, silence)
+	}
+}
@@ -0,0 +1,397 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package simulator
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"heatpump/decoder"
+)
+
+// Scenario scripts drive the simulated heatpump, one command per line, # starts a comment:
+//
+//	set name=value ...            sets values, e.g. set status=on compressor=running water_out=35.5
+//	run 5m                        emits request/response cycles for the duration
+//	ramp 10m name=value ...       emits cycles while numeric values change linearly to the targets
+//	silence 30s                   no traffic, as when the heatpump is powered off
+//	noreply 1m                    emits cycles where the heatpump does not answer the requests
+//	exception 1m 6                emits cycles where the heatpump answers with the exception code, e.g. 6 = busy
+//	write 0x1c2e=0x0202 ...       the controller writes a register (function 6), or consecutive registers from the
+//	                              address with comma separated values (function 16), the heatpump acknowledges
+//	read 0x0200=1,2,3 ...         the controller reads registers outside the four record types (function 3), the
+//	                              heatpump answers with the values
+//	repeat 3                      repeats the commands up to the matching end
+//	end
+//
+// Durations are simulated time: a run of 5m emits five minutes worth of cycles. Writes do not change the simulated
+// values, a write is normally followed by the set command that reflects it. With several slaves every heatpump runs the
+// scenario, writes and reads address the first slave.
+
+//go:embed scenarios/*.txt
+var scenarios embed.FS
+
+type Scenario struct {
+	Name  string
+	steps []step
+}
+
+type step struct {
+	line     int
+	command  string
+	duration time.Duration
+	count    int
+	values   [][2]string
+	body     []step
+}
+
+// A frame emitted at a simulated time since the start of the scenario, request reports whether the frame is sent by
+// the Remote Touch Controller
+type Emit func(elapsed time.Duration, frame []byte, request bool) error
+
+// Loads a built-in scenario by name or a scenario file
+func Load(name string) (*Scenario, error) {
+	data, err := scenarios.ReadFile("scenarios/" + name + ".txt")
+	if err != nil {
+		data, err = os.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("unknown scenario %s, built-in scenarios: %s", name, strings.Join(Scenarios(), ", "))
+		}
+	}
+	return Parse(name, data)
+}
+
+// Returns the names of the built-in scenarios
+func Scenarios() []string {
+	var names []string
+	entries, _ := scenarios.ReadDir("scenarios")
+	for _, entry := range entries {
+		names = append(names, strings.TrimSuffix(entry.Name(), ".txt"))
+	}
+	return names
+}
+
+func Parse(name string, script []byte) (*Scenario, error) {
+	var stack [][]step
+	var current []step
+	scanner := bufio.NewScanner(bytes.NewReader(script))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		s := step{line: line, command: fields[0]}
+		args := fields[1:]
+		var err error
+		switch s.command {
+		case "set":
+			s.values, err = parseValues(args)
+		case "run", "silence", "noreply":
+			if len(args) != 1 {
+				err = fmt.Errorf("%s requires a duration", s.command)
+				break
+			}
+			s.duration, err = time.ParseDuration(args[0])
+		case "ramp":
+			if len(args) < 2 {
+				err = fmt.Errorf("ramp requires a duration and values")
+				break
+			}
+			s.duration, err = time.ParseDuration(args[0])
+			if err == nil {
+				s.values, err = parseValues(args[1:])
+			}
+			for _, value := range s.values {
+				if _, e := strconv.ParseFloat(value[1], 64); e != nil && err == nil {
+					err = fmt.Errorf("ramp requires numeric values: %s", value[0])
+				}
+			}
+		case "exception":
+			if len(args) != 2 {
+				err = fmt.Errorf("exception requires a duration and an exception code")
+				break
+			}
+			s.duration, err = time.ParseDuration(args[0])
+			if err == nil {
+				s.count, err = strconv.Atoi(args[1])
+				if err == nil && (s.count < 1 || s.count > 255) {
+					err = fmt.Errorf("invalid exception code %d", s.count)
+				}
+			}
+		case "write", "read":
+			s.values, err = parseValues(args)
+			for _, value := range s.values {
+				if _, _, e := parseWrite(value); e != nil && err == nil {
+					err = e
+				}
+			}
+		case "repeat":
+			if len(args) != 1 {
+				err = fmt.Errorf("repeat requires a count")
+				break
+			}
+			s.count, err = strconv.Atoi(args[0])
+			if err == nil {
+				stack = append(stack, append(current, s))
+				current = nil
+				continue
+			}
+		case "end":
+			if len(stack) == 0 {
+				err = fmt.Errorf("end without repeat")
+				break
+			}
+			parent := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			parent[len(parent)-1].body = current
+			current = parent
+			continue
+		default:
+			err = fmt.Errorf("unknown command %s", s.command)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scenario %s line %d: %w", name, line, err)
+		}
+		current = append(current, s)
+	}
+	if len(stack) > 0 {
+		return nil, fmt.Errorf("scenario %s: repeat without end", name)
+	}
+	scenario := &Scenario{Name: name, steps: current}
+	// Catch invalid values before the scenario runs
+	if err := scenario.Generate(time.Second, []byte{1}, func(time.Duration, []byte, bool) error { return nil }); err != nil {
+		return nil, err
+	}
+	return scenario, nil
+}
+
+func parseValues(args []string) ([][2]string, error) {
+	var values [][2]string
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid value %s, expected name=value", arg)
+		}
+		values = append(values, [2]string{name, value})
+	}
+	return values, nil
+}
+
+// Parses the register address and the values of a write or a read
+func parseWrite(value [2]string) (uint16, []uint16, error) {
+	address, err := strconv.ParseUint(value[0], 0, 16)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid register address %s", value[0])
+	}
+	var values []uint16
+	for _, text := range strings.Split(value[1], ",") {
+		v, err := strconv.ParseUint(text, 0, 16)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid register value %s", text)
+		}
+		values = append(values, uint16(v))
+	}
+	return uint16(address), values, nil
+}
+
+// Runs the scenario in simulated time, emitting the frames of the Remote Touch Controller requests and of the
+// heatpump responses. A request/response cycle for the four record types of each slave is emitted every period.
+func (s *Scenario) Generate(period time.Duration, slaves []byte, emit Emit) error {
+	g := generator{unit: NewUnit(), period: period, slaves: slaves, emit: emit}
+	if err := g.run(s.steps); err != nil {
+		return fmt.Errorf("scenario %s %w", s.Name, err)
+	}
+	return nil
+}
+
+type generator struct {
+	unit    Unit
+	period  time.Duration
+	slaves  []byte
+	emit    Emit
+	elapsed time.Duration
+	// Set while the heatpump does not answer (noreply) or answers with an exception
+	fault     string
+	exception byte
+}
+
+func (g *generator) run(steps []step) error {
+	for _, s := range steps {
+		var err error
+		switch s.command {
+		case "set":
+			for _, value := range s.values {
+				if err = g.unit.Set(value[0], value[1]); err != nil {
+					break
+				}
+			}
+		case "run":
+			for i := 0; i < g.cycles(s.duration) && err == nil; i++ {
+				err = g.cycle()
+			}
+		case "ramp":
+			start := make(map[string]float64)
+			for _, value := range s.values {
+				start[value[0]] = g.unit[value[0]]
+			}
+			cycles := g.cycles(s.duration)
+			for i := 1; i <= cycles && err == nil; i++ {
+				for _, value := range s.values {
+					target, _ := strconv.ParseFloat(value[1], 64)
+					progress := start[value[0]] + (target-start[value[0]])*float64(i)/float64(cycles)
+					if err = g.unit.Set(value[0], strconv.FormatFloat(progress, 'f', -1, 64)); err != nil {
+						break
+					}
+				}
+				if err == nil {
+					err = g.cycle()
+				}
+			}
+		case "silence":
+			g.elapsed += s.duration
+		case "noreply", "exception":
+			g.fault, g.exception = s.command, byte(s.count)
+			for i := 0; i < g.cycles(s.duration) && err == nil; i++ {
+				err = g.cycle()
+			}
+			g.fault = ""
+		case "write":
+			for _, value := range s.values {
+				if err = g.write(value); err != nil {
+					break
+				}
+			}
+		case "read":
+			for _, value := range s.values {
+				if err = g.read(value); err != nil {
+					break
+				}
+			}
+		case "repeat":
+			for i := 0; i < s.count && err == nil; i++ {
+				err = g.run(s.body)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", s.line, err)
+		}
+	}
+	return nil
+}
+
+func (g *generator) cycles(duration time.Duration) int {
+	cycles := int(duration / g.period)
+	if cycles < 1 {
+		cycles = 1
+	}
+	return cycles
+}
+
+// Emits the requests and responses of one cycle, spread over the period
+func (g *generator) cycle() error {
+	blocks := []struct {
+		address uint16
+		values  []uint16
+	}{
+		{STATES_ADDRESS, g.unit.states()},
+		{MACHINE_ADDRESS, g.unit.machine()},
+		{TEMPERATURES_ADDRESS, g.unit.temperatures()},
+		{ERRORS_ADDRESS, g.unit.errors()},
+	}
+	gap := g.period / time.Duration(2*len(blocks)*len(g.slaves))
+	start := g.elapsed
+	for n, slave := range g.slaves {
+		for j, block := range blocks {
+			i := n*len(blocks) + j
+			request := decoder.ReadRequest(slave, block.address, uint16(len(block.values)))
+			if err := g.emit(start+time.Duration(2*i)*gap, request, true); err != nil {
+				return err
+			}
+			response := decoder.ReadResponse(slave, block.values)
+			switch g.fault {
+			case "noreply":
+				continue
+			case "exception":
+				response = decoder.ExceptionResponse(slave, decoder.MODBUS_READ, g.exception)
+			}
+			if err := g.emit(start+time.Duration(2*i+1)*gap, response, false); err != nil {
+				return err
+			}
+		}
+	}
+	g.elapsed += g.period
+	return nil
+}
+
+// Emits a write request and its acknowledgement
+func (g *generator) write(value [2]string) error {
+	address, values, err := parseWrite(value)
+	if err != nil {
+		return err
+	}
+	request := decoder.WriteSingle(g.slaves[0], address, values[0])
+	response := request
+	if len(values) > 1 {
+		request = decoder.WriteMultiple(g.slaves[0], address, values)
+		response = decoder.WriteMultipleResponse(g.slaves[0], address, uint16(len(values)))
+	}
+	gap := g.period / 8
+	if err := g.emit(g.elapsed, request, true); err != nil {
+		return err
+	}
+	if err := g.emit(g.elapsed+gap, response, false); err != nil {
+		return err
+	}
+	g.elapsed += 2 * gap
+	return nil
+}
+
+// Emits a read request and its response
+func (g *generator) read(value [2]string) error {
+	address, values, err := parseWrite(value)
+	if err != nil {
+		return err
+	}
+	gap := g.period / 8
+	if err := g.emit(g.elapsed, decoder.ReadRequest(g.slaves[0], address, uint16(len(values))), true); err != nil {
+		return err
+	}
+	if err := g.emit(g.elapsed+gap, decoder.ReadResponse(g.slaves[0], values), false); err != nil {
+		return err
+	}
+	g.elapsed += 2 * gap
+	return nil
+}
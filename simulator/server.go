@@ -0,0 +1,119 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package simulator
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"heatpump/decoder"
+)
+
+const logPrefix = "SIMULATOR -"
+
+type Options struct {
+	// Modbus addresses of the simulated heatpumps, which run the same scenario
+	Slaves []byte
+	// Interval between request/response cycles
+	Period time.Duration
+	// Simulated time runs Speed times faster than real time, as fast as possible when 0.
+	// Silences produce read timeouts only when the speed is not 0.
+	Speed float64
+	// Restart the scenario when it ends instead of closing the connection
+	Loop bool
+	// Framing of the gateway output: RTU frames as on the bus, Modbus TCP frames with MBAP header or Modbus ASCII
+	Framing string
+}
+
+func DefaultOptions() Options {
+	return Options{Slaves: []byte{1}, Period: time.Second, Speed: 1, Framing: decoder.FRAMING_RTU}
+}
+
+// Writes the scenario traffic to w as a MODBUS gateway would, paced in real time
+func (s *Scenario) Run(ctx context.Context, w io.Writer, options Options) error {
+	for {
+		start := time.Now()
+		var transaction uint16
+		err := s.Generate(options.Period, options.Slaves, func(elapsed time.Duration, frame []byte, request bool) error {
+			if options.Speed > 0 {
+				timer := time.NewTimer(time.Until(start.Add(time.Duration(float64(elapsed) / options.Speed))))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			switch options.Framing {
+			case decoder.FRAMING_MBAP:
+				// A response shares the transaction id of the request that precedes it
+				if request {
+					transaction++
+				}
+				frame = decoder.MBAP(transaction, frame)
+			case decoder.FRAMING_ASCII:
+				frame = decoder.ASCII(frame)
+			}
+			_, err := w.Write(frame)
+			return err
+		})
+		if err != nil || !options.Loop {
+			return err
+		}
+	}
+}
+
+// Acts as a MODBUS gateway: each client connection receives the scenario traffic from the start
+func (s *Scenario) Serve(ctx context.Context, listener net.Listener, options Options) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		log.Printf("%s %s connected, scenario %s\n", logPrefix, conn.RemoteAddr(), s.Name)
+		go func() {
+			defer conn.Close()
+			err := s.Run(ctx, conn, options)
+			if err != nil {
+				log.Printf("%s %s: %s\n", logPrefix, conn.RemoteAddr(), err)
+			} else {
+				log.Printf("%s %s: end of scenario %s\n", logPrefix, conn.RemoteAddr(), s.Name)
+			}
+		}()
+	}
+}
@@ -0,0 +1,123 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package simulator
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"heatpump/base"
+	"heatpump/decoder"
+	"heatpump/domain"
+)
+
+const testScenario = `
+set status=on control=heat mode=heat pump=on pump_speed=70 required=on compressor=running hz=55 fan=600
+set water_in=33 water_out=38.5 external=-4.5 compressor_in=1 compressor_out=68 hours=1200 error_2=12
+run 3s
+set mode=cool water_out=12 required=off compressor=off
+run 2s
+`
+
+// Serves the scenario on a loopback listener and decodes the traffic of a client connection as the service would
+func TestServe(t *testing.T) {
+	scenario, err := Parse("test", []byte(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, framing := range decoder.Framings() {
+		t.Run(framing, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			// One cycle every 50ms
+			options := Options{Slaves: []byte{1, 2}, Period: time.Second, Speed: 20, Framing: framing}
+			served := make(chan error, 1)
+			go func() {
+				served <- scenario.Serve(ctx, listener, options)
+			}()
+
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			site := &base.Site{Name: "test", ModbusTcp: listener.Addr().String(), ModbusFraming: framing,
+				ModbusAddrs: []int{1, 2}}
+			snapshots := make(map[int][]domain.Vitocal)
+			d, err := decoder.New(decoder.WithSite(site), decoder.WithLogger(log.New(io.Discard, "", 0)),
+				decoder.WithHandler(func(e decoder.Event) {
+					if e.Kind == decoder.KIND_SNAPSHOT {
+						snapshots[e.Slave] = append(snapshots[e.Slave], *e.Vitocal)
+					}
+				}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The simulator closes the connection at the end of the scenario
+			if err := d.Run(ctx, conn); err != io.EOF {
+				t.Fatalf("Run returned %v, want io.EOF", err)
+			}
+			cancel()
+			if err := <-served; err != context.Canceled {
+				t.Errorf("Serve returned %v, want context.Canceled", err)
+			}
+
+			for _, slave := range []int{1, 2} {
+				got := snapshots[slave]
+				if len(got) != 5 {
+					t.Fatalf("slave %d: %d snapshots, want one per cycle: 5", slave, len(got))
+				}
+				for i, v := range got {
+					heating := i < 3
+					mode, compressor, waterOut := domain.MODE_COOL, domain.OFF, "12.0"
+					if heating {
+						mode, compressor, waterOut = domain.MODE_HEAT, domain.ON, "38.5"
+					}
+					if v.Slave != slave || v.Status != domain.ON || v.ControlMode != domain.CONTROL_MODE_HEAT ||
+						v.Mode != mode || v.CompressorRequired != heating || v.CompressorStatus != compressor ||
+						v.PumpStatus != domain.ON || v.PumpSpeed != 70 || v.FanSpeed != 600 || v.Hours != 1200 {
+						t.Errorf("slave %d snapshot %d: states %+v", slave, i, v)
+					}
+					if v.Temperatures.WaterIn != "33.0" || v.Temperatures.WaterOut != waterOut ||
+						v.Temperatures.External != "-4.5" || v.Temperatures.CompressorOut != "68.0" {
+						t.Errorf("slave %d snapshot %d: temperatures %+v", slave, i, v.Temperatures)
+					}
+					if v.Errors.Error1 != 0 || v.Errors.Error2 != 12 {
+						t.Errorf("slave %d snapshot %d: errors %+v", slave, i, v.Errors)
+					}
+				}
+			}
+		})
+	}
+}
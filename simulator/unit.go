@@ -0,0 +1,207 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// State of the simulated heatpump and its encoding into the Vitocal 100A register blocks.
+// Every value is held as a number, named values such as status=standby are translated through the enums table.
+
+const (
+	STATES_ADDRESS       uint16 = 0x1c2e
+	MACHINE_ADDRESS      uint16 = 0x01e0
+	TEMPERATURES_ADDRESS uint16 = 0x018f
+	ERRORS_ADDRESS       uint16 = 0x03ca
+
+	STATES_REGISTERS       int = 11
+	MACHINE_REGISTERS      int = 3
+	TEMPERATURES_REGISTERS int = 50
+	ERRORS_REGISTERS       int = 5
+
+	UNUSED uint16 = 0x7ffe
+)
+
+var enums = map[string]map[string]float64{
+	"status":     {"standby": 0, "on": 1},
+	"control":    {"off": 0, "cool": 1, "heat": 2},
+	"mode":       {"heat": 1, "cool": 2},
+	"defrost":    {"off": 0, "starting": 1, "active": 2},
+	"required":   {"off": 0, "on": 1},
+	"compressor": {"off": 0, "starting": 1, "starting2": 2, "running": 3},
+	"thrust":     {"off": 0, "on": 1},
+	"oil_heater": {"off": 0, "on": 1},
+	"pump":       {"off": 0, "venting": 1, "on": 2},
+}
+
+var numbers = []string{
+	"hz", "fan", "pump_speed", "hours",
+	"water_in", "water_out", "external", "compressor_in", "compressor_out",
+	"pressure_suction", "pressure_condensation",
+	"error_1", "error_2", "error_3", "error_4", "error_5",
+}
+
+// TEMPERATURES registers that always read 0x7ffe, see RECORDS.md
+var unused = []int{3, 4, 5, 6, 8, 9, 10, 11, 12, 13, 14, 16, 17, 18, 19, 20, 21, 22, 24, 25, 26, 27, 28, 30, 31,
+	32, 33, 35, 36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47}
+
+type Unit map[string]float64
+
+// A heatpump in standby, heating mode
+func NewUnit() Unit {
+	return Unit{
+		"control":               2,
+		"mode":                  1,
+		"water_in":              30,
+		"water_out":             30,
+		"external":              10,
+		"compressor_in":         10,
+		"compressor_out":        20,
+		"pressure_suction":      9,
+		"pressure_condensation": 9,
+	}
+}
+
+// Sets a value by name, named values are accepted for enumerations
+func (u Unit) Set(name string, value string) error {
+	if values, ok := enums[name]; ok {
+		if number, ok := values[value]; ok {
+			u[name] = number
+			return nil
+		}
+		return fmt.Errorf("invalid %s: %s", name, value)
+	}
+	for _, number := range numbers {
+		if number == name {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %s", name, value)
+			}
+			u[name] = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown value %s", name)
+}
+
+func (u Unit) is(name string, value string) bool {
+	return u[name] == enums[name][value]
+}
+
+func (u Unit) states() []uint16 {
+	values := make([]uint16, STATES_REGISTERS)
+	var status uint16
+	switch {
+	case u.is("defrost", "starting"):
+		status = 0x30
+	case u.is("defrost", "active"):
+		status = 0x50
+	default:
+		if u.is("status", "standby") {
+			status |= 0x02
+		}
+		if u.is("required", "on") {
+			status |= 0x10
+		}
+	}
+	values[0] = status<<8 | uint16(u["control"])
+	switch {
+	case u.is("mode", "heat"):
+		values[2] = 0x4000
+	case u.is("mode", "cool"):
+		values[2] = 0x8000
+	}
+	values[5] = register(u["hz"])
+	values[6] = register(u["fan"])
+	values[7] = register(u["pump_speed"])
+	values[8] = register(u["hours"])
+	return values
+}
+
+func (u Unit) machine() []uint16 {
+	values := make([]uint16, MACHINE_REGISTERS)
+	var status, pump uint16 = 0x10, 0
+	running := u.is("compressor", "running")
+	if running {
+		status |= 0x01
+		pump |= 0x04
+		values[2] |= 0x8000
+	}
+	if u.is("oil_heater", "on") {
+		status |= 0x80
+	}
+	if u.is("thrust", "on") {
+		pump |= 0x08
+	}
+	if u.is("compressor", "starting2") {
+		pump |= 0x01
+	}
+	switch {
+	case u.is("pump", "on"):
+		pump |= 0x40
+		values[2] |= 0x0601
+	case u.is("pump", "venting"):
+		values[2] |= 0x0200
+	}
+	values[0] = status<<8 | pump
+	return values
+}
+
+func (u Unit) temperatures() []uint16 {
+	values := make([]uint16, TEMPERATURES_REGISTERS)
+	for _, i := range unused {
+		values[i] = UNUSED
+	}
+	values[1] = register(u["water_in"] * 10)
+	values[2] = register(u["water_out"] * 10)
+	values[0] = values[2]
+	values[7] = register(u["pressure_condensation"] * 100)
+	values[15] = register(u["pressure_suction"] * 100)
+	values[23] = register(u["compressor_in"] * 10)
+	values[29] = register(u["external"] * 10)
+	values[34] = register(u["compressor_out"] * 10)
+	return values
+}
+
+func (u Unit) errors() []uint16 {
+	values := make([]uint16, ERRORS_REGISTERS)
+	for i := range values {
+		values[i] = register(u[fmt.Sprintf("error_%d", i+1)])
+	}
+	return values
+}
+
+// Converts a value to a 16 bit register, negative values in two's complement
+func register(value float64) uint16 {
+	value = math.Round(value)
+	if value < 0 {
+		return uint16(int16(value))
+	}
+	return uint16(value)
+}
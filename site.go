@@ -0,0 +1,269 @@
+//BSD 2-Clause License
+//
+//Copyright (c) 2023, Mauro Mozzarelli
+//
+//Redistribution and use in source and binary forms, with or without
+//modification, are permitted provided that the following conditions are met:
+//
+//1. Redistributions of source code must retain the above copyright notice, this
+//list of conditions and the following disclaimer.
+//
+//2. Redistributions in binary form must reproduce the above copyright notice,
+//this list of conditions and the following disclaimer in the documentation
+//and/or other materials provided with the distribution.
+//
+//THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+//AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+//IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+//DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+//FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+//DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+//SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+//CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+//OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+//OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"heatpump/base"
+	"heatpump/decoder"
+	"heatpump/domain"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// A gateway that does not accept the connection within this time is unreachable
+	DIAL_TIMEOUT = 10 * time.Second
+	// A connection that lasted this long resets the backoff
+	SITE_STABLE_CONNECTION = time.Minute
+	// Interval of the status and sink summary of all sites
+	SITE_SUMMARY_INTERVAL = 10 * time.Minute
+)
+
+// Monitors one site: connects to its gateway, decodes the stream until the connection ends and reconnects. The
+// failure of a site does not affect the others.
+type supervisor struct {
+	site *base.Site
+	log  *log.Logger
+	// Kept across the connections
+	sinks    *decoder.Dispatcher
+	counters decoder.Counters
+	// Nil unless METRICS_LISTEN is set
+	metrics *decoder.Metrics
+
+	mutex  sync.Mutex
+	status domain.SiteStatus
+}
+
+func newSupervisor(site *base.Site) (*supervisor, error) {
+	if err := decoder.CheckSite(site); err != nil {
+		return nil, err
+	}
+	sinks, err := decoder.NewSiteDispatcher(site)
+	if err != nil {
+		return nil, err
+	}
+	s := &supervisor{
+		site:  site,
+		log:   site.Logger(),
+		sinks: sinks,
+		status: domain.SiteStatus{
+			Site:   site.Name,
+			Source: site.Source(),
+		},
+	}
+	if len(base.MetricsListen) > 0 {
+		s.metrics = decoder.NewMetrics()
+		s.sinks.Add(s.metrics, base.SinkBuffer, base.SinkPolicy)
+	}
+	s.log.Printf("MODBUS framing: %s\n", site.ModbusFraming)
+	return s, nil
+}
+
+// Retries the connection with exponential backoff. When the site cannot be connected for the defined timeout the
+// give up policy decides whether to keep retrying, to stop monitoring the site or to exit the service: the error
+// returned asks the caller to stop the service, once the sinks of every site are closed. Monitoring stops when the
+// context is cancelled.
+func (s *supervisor) run(ctx context.Context) error {
+	defer s.sinks.Close()
+	source := s.site.Source()
+	retry := newBackoff(time.Duration(base.ReconnectMinSeconds)*time.Second,
+		time.Duration(base.ReconnectMaxSeconds)*time.Second)
+	timeout := time.Duration(base.ModbusConnectionTimeoutMinutes) * time.Minute
+	var failing time.Time
+	s.setState(domain.SITE_CONNECTING, nil, 0)
+	for {
+		start := time.Now()
+		conn, err := connect(s.site)
+		if err != nil {
+			now := time.Now()
+			if failing.IsZero() {
+				failing = start
+			}
+			kind := errorKind(err)
+			s.log.Printf("error: '%s' trying to connect to: '%s'\n", err, source)
+			if base.ReconnectGiveUp != base.GIVE_UP_NEVER && now.Sub(failing) >= timeout {
+				s.setState(domain.SITE_FAILED, err, 0)
+				if base.ReconnectGiveUp == base.GIVE_UP_EXIT {
+					return fmt.Errorf("failed to connect to %s for %d minutes", source,
+						base.ModbusConnectionTimeoutMinutes)
+				}
+				s.log.Printf("failed to connect to %s for %d minutes, giving up\n", source,
+					base.ModbusConnectionTimeoutMinutes)
+				return nil
+			}
+			delay := retry.next()
+			if kind == domain.ERROR_TIMEOUT {
+				// The gateway is unreachable, the dial has already waited
+				delay -= now.Sub(start)
+				if delay < 0 {
+					delay = 0
+				}
+			}
+			s.setState(domain.SITE_DISCONNECTED, err, delay)
+			if !sleep(ctx, delay) {
+				return nil
+			}
+			continue
+		}
+		failing = time.Time{}
+		s.setState(domain.SITE_CONNECTED, nil, 0)
+		err = decoder.Decode(ctx, conn, s.site, s.sinks, &s.counters)
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil
+		}
+		stable := time.Since(start) >= SITE_STABLE_CONNECTION
+		if stable {
+			retry.reset()
+		}
+		delay := retry.next()
+		switch errorKind(err) {
+		case domain.ERROR_EOF:
+			// The gateway closed the connection, it is probably rebooting
+			s.log.Printf("end of data from %s\n", source)
+		case domain.ERROR_RESET:
+			s.log.Printf("connection to %s reset: %s\n", source, err)
+			if stable {
+				// A network interruption, the gateway is likely to accept a new connection at once
+				delay = 0
+			}
+		default:
+			s.log.Println("error:", err)
+		}
+		s.setState(domain.SITE_DISCONNECTED, err, delay)
+		if !sleep(ctx, delay) {
+			return nil
+		}
+	}
+}
+
+// Waits for the delay, returns false when the context is cancelled first
+func sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Classifies a connection error to choose the reconnection
+func errorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, io.EOF):
+		return domain.ERROR_EOF
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNABORTED):
+		return domain.ERROR_RESET
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return domain.ERROR_REFUSED
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return domain.ERROR_TIMEOUT
+	}
+	return domain.ERROR_OTHER
+}
+
+// Records the connection state and publishes it when it changes or after a failed attempt, delay is the wait before
+// the next attempt. The state is handed to the sinks of the site: the MQTT sink publishes it without holding up the
+// reconnection.
+func (s *supervisor) setState(state string, err error, delay time.Duration) {
+	now := time.Now()
+	s.mutex.Lock()
+	changed := state != s.status.State
+	if err != nil {
+		s.status.LastError = err.Error()
+		s.status.LastErrorKind = errorKind(err)
+		s.status.LastErrorTime = &now
+	}
+	switch state {
+	case domain.SITE_CONNECTED:
+		s.status.Connections++
+		s.status.Attempts = 0
+		s.status.NextAttempt = nil
+	case domain.SITE_DISCONNECTED:
+		if s.status.State != domain.SITE_CONNECTED {
+			s.status.Attempts++
+		}
+		next := now.Add(delay)
+		s.status.NextAttempt = &next
+	default:
+		s.status.NextAttempt = nil
+	}
+	if changed {
+		s.status.State = state
+		s.status.Since = now
+	}
+	payload, jsonErr := json.Marshal(&s.status)
+	s.mutex.Unlock()
+	if jsonErr != nil {
+		s.log.Println("error marshalling site status:", jsonErr)
+		return
+	}
+	if changed {
+		s.log.Printf("site %s\n", state)
+	}
+	s.sinks.Handle(decoder.Event{Kind: decoder.KIND_STATUS, Time: now, Topic: s.site.StatusTopic, Payload: payload})
+}
+
+func (s *supervisor) snapshot() domain.SiteStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.status
+}
+
+// Logs the state and the sink statistics of every site periodically
+func summarise(supervisors []*supervisor) {
+	for range time.Tick(SITE_SUMMARY_INTERVAL) {
+		for _, s := range supervisors {
+			status := s.snapshot()
+			line := status.State + " since " + status.Since.Format(time.RFC3339)
+			if len(status.LastError) > 0 {
+				line += ", last error " + status.LastErrorTime.Format(time.RFC3339) + ": " + status.LastError
+			}
+			log.Printf("site %s (%s): %s, %d connections\n", s.site, status.Source, line,
+				status.Connections)
+			var sinks []string
+			for _, sink := range s.sinks.Stats() {
+				sinks = append(sinks, fmt.Sprintf("%s written=%d dropped=%d errors=%d queued=%d", sink.Name,
+					sink.Written, sink.Dropped, sink.Errors, sink.Queued))
+			}
+			s.log.Printf("sinks: %s\n", strings.Join(sinks, ", "))
+		}
+	}
+}